@@ -165,7 +165,7 @@ def commands():
                             'required': True
                         },
                         '--options': {
-                            'help': 'Options (specifically, access) to be set on the volume.',
+                            'help': 'Options (access, attach-as or trim) to be set on the volume.',
                             'required': True
                         }
                     }
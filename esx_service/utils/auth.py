@@ -34,6 +34,8 @@ CMD_REMOVE = 'remove'
 CMD_ATTACH = 'attach'
 CMD_DETACH = 'detach'
 CMD_GET    = 'get'
+CMD_ADD_SUBVOLUME = 'addsubvolume'
+CMD_REMOVE_SUBVOLUME = 'removesubvolume'
 
 SIZE = 'size'
 
@@ -348,6 +350,15 @@ def check_privileges_for_command(cmd, opts, tenant_uuid, datastore_url, privileg
         if not has_privilege(privileges, auth_data_const.COL_ALLOW_CREATE):
             result = error_code_to_message[ErrorCode.PRIVILEGE_NO_DELETE_PRIVILEGE]
 
+    # sub-volumes live in the disk of their parent, they take no quota
+    if cmd == CMD_ADD_SUBVOLUME:
+        if not has_privilege(privileges, auth_data_const.COL_ALLOW_CREATE):
+            result = error_code_to_message[ErrorCode.PRIVILEGE_NO_CREATE_PRIVILEGE]
+
+    if cmd == CMD_REMOVE_SUBVOLUME:
+        if not has_privilege(privileges, auth_data_const.COL_ALLOW_CREATE):
+            result = error_code_to_message[ErrorCode.PRIVILEGE_NO_DELETE_PRIVILEGE]
+
     return result
 
 def err_msg_no_table(table_name):
@@ -120,12 +120,27 @@ LOCATION = 'datastore'
 CREATED_BY_VM = 'created by VM'
 ATTACHED_TO_VM = 'attached to VM'
 
+# Name of the sub-volume in addsubvolume and removesubvolume requests
+SUBVOLUME_NAME = 'name'
+
 # Virtual machine power states
 VM_POWERED_OFF = "poweredOff"
 
 # Maximum number of PVSCSI targets
 PVSCSI_MAX_TARGETS = 16
 
+# Controller types volumes are attached to, in order of preference.
+# A PVSCSI controller is added when none of them has a free slot.
+CONTROLLER_PVSCSI = "pvscsi"
+CONTROLLER_LSISAS = "lsisas"
+CONTROLLER_NVME = "nvme"
+CONTROLLER_TYPES = [CONTROLLER_PVSCSI, CONTROLLER_LSISAS, CONTROLLER_NVME]
+
+# NVMe controllers take 15 disks (namespaces 1 to 15, unit 0 to 14)
+# and have keys 31000 + bus number
+NVME_MAX_TARGETS = 15
+NVME_KEY_OFFSET = 31000
+
 # Service instance provide from connection to local hostd
 _service_instance = None
 
@@ -172,6 +187,10 @@ def createVMDK(vmdk_path, vm_name, vol_name,
         logging.warning("File %s already exists", vmdk_path)
         return None
 
+    parent, _ = find_parent(os.path.dirname(vmdk_path), vol_name)
+    if parent:
+        return err("Volume {0} already exists, as a sub-volume of {1}".format(vol_name, parent))
+
     try:
         validate_opts(opts, vmdk_path)
     except ValidationError as e:
@@ -349,6 +368,15 @@ def cloneVMDK(vm_name, vmdk_path, opts={}, vm_uuid=None, datastore_url=None):
         vol_meta[kv.VOL_OPTS][kv.ACCESS] = opts[kv.ACCESS]
     if kv.ATTACH_AS in opts:
         vol_meta[kv.VOL_OPTS][kv.ATTACH_AS] = opts[kv.ATTACH_AS]
+    if kv.TRIM in opts:
+        vol_meta[kv.VOL_OPTS][kv.TRIM] = opts[kv.TRIM]
+    if kv.RO_FOR in opts:
+        vol_meta[kv.VOL_OPTS][kv.RO_FOR] = opts[kv.RO_FOR]
+    # the Docker name of the source doesn't apply to the clone
+    if kv.DOCKER_NAME in opts:
+        vol_meta[kv.VOL_OPTS][kv.DOCKER_NAME] = opts[kv.DOCKER_NAME]
+    elif kv.DOCKER_NAME in vol_meta[kv.VOL_OPTS]:
+        del vol_meta[kv.VOL_OPTS][kv.DOCKER_NAME]
 
     if not kv.setAll(vmdk_path, vol_meta):
         msg = "Failed to create metadata kv store for {0}".format(vmdk_path)
@@ -371,12 +399,22 @@ def validate_opts(opts, vmdk_path):
      * size - The size of the disk to create
      * vsan-policy-name - The name of an existing policy to use
      * diskformat - The allocation format of allocated disk
+     * docker-name - Docker name of a volume created under an alias
+     * trim - on or off, whether the volume-plugin trims the filesystem
+     * uid, gid, mode - owner and permissions of the volume root
+     * subvolumes - on if the volume can be the parent of sub-volumes
+     * ro-for - containers which get the volume read-only
     """
     valid_opts = [kv.SIZE, kv.VSAN_POLICY_NAME, kv.DISK_ALLOCATION_FORMAT,
-                  kv.ATTACH_AS, kv.ACCESS, kv.FILESYSTEM_TYPE, kv.CLONE_FROM]
+                  kv.ATTACH_AS, kv.ACCESS, kv.FILESYSTEM_TYPE, kv.CLONE_FROM,
+                  kv.DOCKER_NAME, kv.TRIM, kv.UID, kv.GID, kv.MODE,
+                  kv.SUBVOLUMES, kv.RO_FOR]
     defaults = [kv.DEFAULT_DISK_SIZE, kv.DEFAULT_VSAN_POLICY,\
                 kv.DEFAULT_ALLOCATION_FORMAT, kv.DEFAULT_ATTACH_AS,\
-                kv.DEFAULT_ACCESS, kv.DEFAULT_FILESYSTEM_TYPE, kv.DEFAULT_CLONE_FROM]
+                kv.DEFAULT_ACCESS, kv.DEFAULT_FILESYSTEM_TYPE, kv.DEFAULT_CLONE_FROM,\
+                kv.DEFAULT_DOCKER_NAME, kv.DEFAULT_TRIM, kv.DEFAULT_UID,\
+                kv.DEFAULT_GID, kv.DEFAULT_MODE, kv.DEFAULT_SUBVOLUMES,\
+                kv.DEFAULT_RO_FOR]
     invalid = frozenset(opts.keys()).difference(valid_opts)
     if len(invalid) != 0:
         msg = 'Invalid options: {0} \n'.format(list(invalid)) \
@@ -399,6 +437,15 @@ def validate_opts(opts, vmdk_path):
         validate_access(opts[kv.ACCESS])
     if kv.FILESYSTEM_TYPE in opts:
         validate_fstype(opts[kv.FILESYSTEM_TYPE], clone)
+    if kv.TRIM in opts:
+        validate_trim(opts[kv.TRIM])
+    for key in [kv.UID, kv.GID, kv.MODE]:
+        if key in opts:
+            validate_root_opt(key, opts[key], clone)
+    if kv.SUBVOLUMES in opts:
+        validate_subvolumes(opts[kv.SUBVOLUMES], clone)
+    if kv.RO_FOR in opts:
+        validate_ro_for(opts[kv.RO_FOR])
 
 
 def validate_size(size, clone=False):
@@ -475,6 +522,46 @@ def validate_attach_as(attach_type):
         raise ValidationError("Attach type '{0}' is not supported."
                               " Valid options are: {1}".format(attach_type, kv.ATTACH_AS_TYPES))
 
+def validate_root_opt(key, value, clone=False):
+    """
+    Ensure uid and gid are numeric IDs and mode is octal permissions
+    """
+    if clone:
+        raise ValidationError("Cannot define the {0} for a clone".format(key))
+    base = 8 if key == kv.MODE else 10
+    try:
+        number = int(value, base)
+    except ValueError:
+        number = -1
+    if number < 0 or (key == kv.MODE and number > 0o7777):
+        raise ValidationError("Invalid {0} '{1}'.".format(key, value))
+
+def validate_trim(trim):
+    """
+    Ensure that we recognize the trim setting
+    """
+    if not trim in kv.TRIM_TYPES:
+       raise ValidationError("Trim '{0}' is not supported."
+                             " Valid options are: {1}".format(trim, kv.TRIM_TYPES))
+
+def validate_subvolumes(subvolumes, clone=False):
+    """
+    Ensure that we recognize the subvolumes setting, a clone has the one of
+    its source
+    """
+    if clone:
+        raise ValidationError("Cannot define subvolumes for a clone")
+    if not subvolumes in kv.SUBVOLUMES_TYPES:
+       raise ValidationError("Subvolumes '{0}' is not supported."
+                             " Valid options are: {1}".format(subvolumes, kv.SUBVOLUMES_TYPES))
+
+def validate_ro_for(ro_for):
+    """
+    Ensure that ro-for has rules, the volume-plugin parses them
+    """
+    if not ro_for.strip(" ,"):
+       raise ValidationError("ro-for '{0}' has no rules".format(ro_for))
+
 def validate_access(access_type):
     """
     Ensure that we recognize the access type
@@ -549,9 +636,53 @@ def vol_info(vol_meta, vol_size_info, datastore):
           vinfo[kv.CLONE_FROM] = vol_meta[kv.VOL_OPTS][kv.CLONE_FROM]
        else:
           vinfo[kv.CLONE_FROM] = kv.DEFAULT_CLONE_FROM
+       if kv.DOCKER_NAME in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.DOCKER_NAME] = vol_meta[kv.VOL_OPTS][kv.DOCKER_NAME]
+       if kv.TRIM in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.TRIM] = vol_meta[kv.VOL_OPTS][kv.TRIM]
+       else:
+          vinfo[kv.TRIM] = kv.DEFAULT_TRIM
+       for key in [kv.UID, kv.GID, kv.MODE]:
+          if key in vol_meta[kv.VOL_OPTS]:
+             vinfo[key] = vol_meta[kv.VOL_OPTS][key]
+       if kv.SUBVOLUMES in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.SUBVOLUMES] = vol_meta[kv.VOL_OPTS][kv.SUBVOLUMES]
+       else:
+          vinfo[kv.SUBVOLUMES] = kv.DEFAULT_SUBVOLUMES
+       if kv.RO_FOR in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.RO_FOR] = vol_meta[kv.VOL_OPTS][kv.RO_FOR]
+
+    if kv.SUBVOLUME_LIST in vol_meta:
+       vinfo[kv.SUBVOLUME_LIST] = sorted(vol_meta[kv.SUBVOLUME_LIST].keys())
+
+    return vinfo
 
+# Return sub-volume info, from the metadata of its parent
+def subvol_info(sub_name, parent, vol_meta, datastore):
+    subvol = vol_meta[kv.SUBVOLUME_LIST][sub_name]
+    vinfo = {CREATED_BY_VM : subvol[kv.CREATED_BY],
+             kv.CREATED : subvol[kv.CREATED],
+             LOCATION : datastore,
+             kv.PARENT : get_full_vol_name(parent, datastore),
+             kv.FILESYSTEM_TYPE : vol_meta.get(kv.VOL_OPTS, {}).get(kv.FILESYSTEM_TYPE,
+                                                                      kv.DEFAULT_FILESYSTEM_TYPE),
+             kv.ACCESS : kv.ACCESS_READWRITE,
+             kv.SUBVOLUMES : kv.SUBVOLUMES_OFF}
+    if kv.SIZE in subvol:
+        vinfo[CAPACITY] = {SIZE : subvol[kv.SIZE]}
     return vinfo
 
+def find_parent(path, sub_name):
+    """
+    Returns the vmdk file name of the parent of sub-volume sub_name among
+    the volumes in path and the parent metadata, or (None, None)
+    """
+    for vmdk in vmdk_utils.list_vmdks(path):
+        vol_meta = kv.getAll(os.path.join(path, vmdk))
+        if vol_meta and sub_name in vol_meta.get(kv.SUBVOLUME_LIST, {}):
+            return vmdk, vol_meta
+    return None, None
+
 
 def cleanVMDK(vmdk_path, vol_name=None):
     """
@@ -609,6 +740,11 @@ def removeVMDK(vmdk_path, vol_name=None, vm_name=None, tenant_uuid=None, datasto
                 vmdk_path, vol_name, attached_vm_name, kv_uuid, ret)
             return err("Failed to remove volume {0}, in use by VM = {1}.".format(vol_name, attached_vm_name))
 
+    subvols = kv.get_kv(vmdk_path, kv.SUBVOLUME_LIST)
+    if subvols:
+        return err("Failed to remove volume {0}, it has sub-volumes: {1}."
+                   .format(vol_name, ", ".join(sorted(subvols.keys()))))
+
     # Cleaning .vmdk file
     clean_err = cleanVMDK(vmdk_path, vol_name)
 
@@ -633,6 +769,9 @@ def getVMDK(vmdk_path, vol_name, datastore):
     file_exist = os.path.isfile(vmdk_path)
     logging.debug("getVMDK: file_exist=%d", file_exist)
     if not os.path.isfile(vmdk_path):
+        parent, vol_meta = find_parent(os.path.dirname(vmdk_path), vol_name)
+        if parent:
+            return subvol_info(vol_name, parent, vol_meta, datastore)
         return err("Volume {0} not found (file: {1})".format(vol_name, vmdk_path))
     # Return volume info - volume policy, size, allocated capacity, allocation
     # type, creat-by, create time.
@@ -654,10 +793,82 @@ def listVMDK(tenant):
     """
     vmdk_utils.init_datastoreCache(force=True)
     vmdks = vmdk_utils.get_volumes(tenant)
-    # build  fully qualified vol name for each volume found
-    return [{u'Name': get_full_vol_name(x['filename'], x['datastore']),
-             u'Attributes': {}} \
-            for x in vmdks]
+    # build  fully qualified vol name for each volume found, followed by
+    # its sub-volumes
+    volumes = []
+    for x in vmdks:
+        vol_meta = kv.getAll(os.path.join(x['path'], x['filename'])) or {}
+        name = get_full_vol_name(x['filename'], x['datastore'])
+        volumes.append({u'Name': name,
+                        u'Attributes': list_attributes(x, vol_meta)})
+        for sub_name in sorted(vol_meta.get(kv.SUBVOLUME_LIST, {})):
+            volumes.append({u'Name': "{0}@{1}".format(sub_name, x['datastore']),
+                            u'Attributes': {kv.PARENT: name}})
+    return volumes
+
+def list_attributes(vmdk, vol_meta):
+    """
+    Returns the attributes of a listed volume: the Docker name of an alias,
+    so the volume-plugin doesn't ask for each aliased volume
+    """
+    if not vmdk['filename'].startswith(kv.ALIAS_PREFIX):
+        return {}
+    if kv.DOCKER_NAME not in vol_meta.get(kv.VOL_OPTS, {}):
+        return {}
+    return {kv.DOCKER_NAME: vol_meta[kv.VOL_OPTS][kv.DOCKER_NAME]}
+
+def addSubvolume(vmdk_path, vol_name, vm_name, opts):
+    """
+    Records the sub-volume named in opts, with its size, in the metadata of
+    the parent volume. Return error, or None for OK
+    """
+    logging.info("*** addSubvolume: %s opts = %s vm_name=%s", vmdk_path, opts, vm_name)
+    sub_name = opts.get(SUBVOLUME_NAME, "")
+    try:
+        sub_name, sub_datastore = parse_vol_name(sub_name)
+    except ValidationError as ex:
+        return err(str(ex))
+    if not sub_name or sub_datastore:
+        return err("Invalid sub-volume name '{0}'".format(opts.get(SUBVOLUME_NAME, "")))
+    if not os.path.isfile(vmdk_path):
+        return err("Volume {0} not found (file: {1})".format(vol_name, vmdk_path))
+    vol_meta = kv.getAll(vmdk_path)
+    if not vol_meta:
+        return err("Failed to get the metadata of volume {0}".format(vol_name))
+    if vol_meta.get(kv.VOL_OPTS, {}).get(kv.SUBVOLUMES) != kv.SUBVOLUMES_ON:
+        return err("Volume {0} can't have sub-volumes, it wasn't created with {1}={2}"
+                   .format(vol_name, kv.SUBVOLUMES, kv.SUBVOLUMES_ON))
+
+    path = os.path.dirname(vmdk_path)
+    if os.path.isfile(vmdk_utils.get_vmdk_path(path, sub_name)) or find_parent(path, sub_name)[0]:
+        return err("Volume {0} already exists".format(sub_name))
+
+    subvol = {kv.CREATED: time.asctime(time.gmtime()),
+              kv.CREATED_BY: vm_name}
+    if kv.SIZE in opts:
+        subvol[kv.SIZE] = opts[kv.SIZE]
+    vol_meta.setdefault(kv.SUBVOLUME_LIST, {})[sub_name] = subvol
+    if not kv.setAll(vmdk_path, vol_meta):
+        return err("Failed to record sub-volume {0} of volume {1}".format(sub_name, vol_name))
+    return None
+
+def removeSubvolume(vmdk_path, vol_name, opts):
+    """
+    Drops the sub-volume named in opts from the metadata of the parent
+    volume. Return error, or None for OK
+    """
+    logging.info("*** removeSubvolume: %s opts = %s", vmdk_path, opts)
+    sub_name = opts.get(SUBVOLUME_NAME, "")
+    vol_meta = kv.getAll(vmdk_path)
+    if not vol_meta or sub_name not in vol_meta.get(kv.SUBVOLUME_LIST, {}):
+        logging.warning("Sub-volume %s of volume %s is already gone", sub_name, vol_name)
+        return None
+    del vol_meta[kv.SUBVOLUME_LIST][sub_name]
+    if not vol_meta[kv.SUBVOLUME_LIST]:
+        del vol_meta[kv.SUBVOLUME_LIST]
+    if not kv.setAll(vmdk_path, vol_meta):
+        return err("Failed to remove sub-volume {0} of volume {1}".format(sub_name, vol_name))
+    return None
 
 
 # Return VM managed object, reconnect if needed. Throws if fails twice.
@@ -941,6 +1152,10 @@ def executeRequest(vm_uuid, vm_name, config_path, cmd, full_vol_name, opts):
                                   vm_name=vm_name,
                                   tenant_uuid=tenant_uuid,
                                   datastore_url=datastore_url)
+        elif cmd == "addsubvolume":
+            response = addSubvolume(vmdk_path, vol_name, vm_name, opts)
+        elif cmd == "removesubvolume":
+            response = removeSubvolume(vmdk_path, vol_name, opts)
 
         # For attach/detach reconfigure tasks, hold a per vm lock.
         elif cmd == "attach":
@@ -1039,21 +1254,41 @@ def findDeviceByPath(vmdk_path, vm):
             return d
     return None
 
+def controller_type(controller):
+    '''
+    Return the type of a controller volumes can be attached to
+    (CONTROLLER_PVSCSI, CONTROLLER_LSISAS or CONTROLLER_NVME), or None
+    '''
+    if type(controller) == vim.ParaVirtualSCSIController:
+        return CONTROLLER_PVSCSI
+    if type(controller) == vim.VirtualLsiLogicSASController:
+        return CONTROLLER_LSISAS
+    # NVMe controllers are only known to newer pyVmomi versions
+    nvme = getattr(vim.vm.device, 'VirtualNVMEController', None)
+    if nvme and type(controller) == nvme:
+        return CONTROLLER_NVME
+    return None
+
 # Find the PCI slot number
 def get_controller_pci_slot(vm, pvscsi, key_offset):
-    ''' Return PCI slot number of the given PVSCSI controller
+    ''' Return PCI slot number of the given controller
     Input parameters:
     vm: VM configuration
-    pvscsi: given PVSCSI controller
+    pvscsi: given PVSCSI, LSI Logic SAS or NVMe controller
     key_offset: offset from the bus number, controller_key - key_offset
-    is equal to the slot number of this given PVSCSI controller
+    is equal to the slot number of this given SCSI controller. NVMe
+    controllers use NVME_KEY_OFFSET.
     '''
     if pvscsi.slotInfo:
        return str(pvscsi.slotInfo.pciSlotNumber)
     else:
        # Slot number is got from from the VM config
-       key = 'scsi{0}.pciSlotNumber'.format(pvscsi.key -
-                                            key_offset)
+       if controller_type(pvscsi) == CONTROLLER_NVME:
+           key = 'nvme{0}.pciSlotNumber'.format(pvscsi.key -
+                                                NVME_KEY_OFFSET)
+       else:
+           key = 'scsi{0}.pciSlotNumber'.format(pvscsi.key -
+                                                key_offset)
        slot = [cfg for cfg in vm.config.extraConfig \
                if cfg.key == key]
        # If the given controller exists
@@ -1062,10 +1297,24 @@ def get_controller_pci_slot(vm, pvscsi, key_offset):
        else:
           return None
 
-def dev_info(unit_number, pci_slot_number):
-    '''Return a dictionary with Unit/Bus for the vmdk (or error)'''
-    return {'Unit': str(unit_number),
+def dev_info(unit_number, pci_slot_number, disk_uuid=None,
+             ctrl_type=CONTROLLER_PVSCSI):
+    '''
+    Return a dictionary with Unit/Bus for the vmdk (or error), the type of
+    the controller, so the guest rescans only that target, and the
+    VMDK UUID the guest can find the disk with (/dev/disk/by-id)
+    '''
+    info = {'Unit': str(unit_number),
             'ControllerPciSlotNumber': pci_slot_number}
+    if ctrl_type:
+        info['ControllerType'] = ctrl_type
+    if disk_uuid:
+        info['DiskUUID'] = disk_uuid
+    return info
+
+def get_disk_uuid(device):
+    '''Return the VMDK UUID of an attached disk device, or None'''
+    return getattr(device.backing, 'uuid', None)
 
 def reset_vol_meta(vmdk_path):
     '''Clears metadata for vmdk_path'''
@@ -1228,8 +1477,11 @@ def find_disk_slot_in_controller(vm, devices, pvsci, idx, offset_from_bus_number
              for dev in devices
              if type(dev) == vim.VirtualDisk and dev.controllerKey ==
              controller_key])
-    # search in 15 slots, with unit_number 7 reserved for scsi controller
-    avail_slots = (set(range(0, 7)) | set(range(8, PVSCSI_MAX_TARGETS))) - taken
+    if controller_type(pvsci[idx]) == CONTROLLER_NVME:
+        avail_slots = set(range(0, NVME_MAX_TARGETS)) - taken
+    else:
+        # search in 15 slots, with unit_number 7 reserved for scsi controller
+        avail_slots = (set(range(0, 7)) | set(range(8, PVSCSI_MAX_TARGETS))) - taken
     logging.debug("idx=%d controller_key=%d avail_slots=%d", idx, controller_key, len(avail_slots))
 
     if len(avail_slots) != 0:
@@ -1244,7 +1496,7 @@ def find_disk_slot_in_controller(vm, devices, pvsci, idx, offset_from_bus_number
 
 def find_available_disk_slot(vm, devices, pvsci, offset_from_bus_number):
     '''
-    Iterate through all the existing PVSCSI controllers attached to a VM to find an empty
+    Iterate through all the existing controllers attached to a VM to find an empty
     disk slot. Return disk_slot is an empty slot can be found, otherwise, return None
     '''
     idx = 0
@@ -1257,8 +1509,9 @@ def find_available_disk_slot(vm, devices, pvsci, offset_from_bus_number):
 
 def disk_attach(vmdk_path, vm):
     '''
-    Attaches *existing* disk to a vm on a PVSCI controller
-    (we need PVSCSI to avoid SCSI rescans in the guest)
+    Attaches *existing* disk to a vm on a PVSCSI, LSI Logic SAS or NVMe
+    controller, adding a PVSCSI controller if none has a free slot. The
+    guest rescans only the target reported back.
     return error or unit:bus numbers of newly attached disk.
     '''
 
@@ -1288,6 +1541,10 @@ def disk_attach(vmdk_path, vm):
     controllers = [d for d in devices
                    if isinstance(d, vim.VirtualSCSIController)]
 
+    # controllers volumes can be attached to, in order of preference
+    supported = sorted([d for d in devices if controller_type(d)],
+                       key=lambda d: CONTROLLER_TYPES.index(controller_type(d)))
+
     # Check if this disk is already attached, and if it is - skip the disk
     # attach and the checks on attaching a controller if needed.
     device = findDeviceByPath(vmdk_path, vm)
@@ -1297,28 +1554,34 @@ def disk_attach(vmdk_path, vm):
                         vmdk_path, vm.config.uuid)
         setStatusAttached(vmdk_path, vm)
         # Get that controller to which the device is configured for
-        pvsci = [d for d in controllers
-                   if type(d) == vim.ParaVirtualSCSIController and
-                      d.key == device.controllerKey]
+        ctrl = [d for d in supported if d.key == device.controllerKey]
+        if not ctrl:
+            # on a controller of another type, the guest can only find
+            # the disk by its UUID
+            logging.warning("Disk %s is attached to an unsupported controller, "
+                            "controller_key=%d", vmdk_path, device.controllerKey)
+            return dev_info(device.unitNumber, None, get_disk_uuid(device), None)
 
         return dev_info(device.unitNumber,
-                        get_controller_pci_slot(vm, pvsci[0],
-                                                offset_from_bus_number))
+                        get_controller_pci_slot(vm, ctrl[0],
+                                                offset_from_bus_number),
+                        get_disk_uuid(device),
+                        controller_type(ctrl[0]))
 
 
-    # Disk isn't attached, make sure we have a PVSCI and add it if we don't
-    # check if we already have a pvsci one
-    pvsci = [d for d in controllers
-             if type(d) == vim.ParaVirtualSCSIController]
+    # Disk isn't attached, look for a free slot on a PVSCSI, LSI Logic SAS
+    # or NVMe controller, and add a PVSCSI controller if there is none
     disk_slot = None
-    if len(pvsci) > 0:
-        idx, disk_slot = find_available_disk_slot(vm, devices, pvsci, offset_from_bus_number);
+    ctrl_type = CONTROLLER_PVSCSI
+    if len(supported) > 0:
+        idx, disk_slot = find_available_disk_slot(vm, devices, supported, offset_from_bus_number);
         if (disk_slot is not None):
-            controller_key = pvsci[idx].key
-            pci_slot_number = get_controller_pci_slot(vm, pvsci[idx],
+            controller_key = supported[idx].key
+            ctrl_type = controller_type(supported[idx])
+            pci_slot_number = get_controller_pci_slot(vm, supported[idx],
                                                       offset_from_bus_number)
-            logging.debug("Find an available disk slot, controller_key=%d, slot_id=%d",
-                          controller_key, disk_slot)
+            logging.debug("Find an available disk slot, controller_key=%d, type=%s, slot_id=%d",
+                          controller_key, ctrl_type, disk_slot)
 
     if (disk_slot is None):
         disk_slot = 0  # starting on a fresh controller
@@ -1378,11 +1641,16 @@ def disk_attach(vmdk_path, vm):
                 msg += "(Current VM)"
         return err(msg)
 
-    vm_dev_info = dev_info(disk_slot, pci_slot_number)
+    # the UUID is set by the reconfigure, look the new disk up
+    disk_uuid = None
+    device = findDeviceByPath(vmdk_path, vm)
+    if device:
+        disk_uuid = get_disk_uuid(device)
+    vm_dev_info = dev_info(disk_slot, pci_slot_number, disk_uuid, ctrl_type)
 
     setStatusAttached(vmdk_path, vm, vm_dev_info)
-    logging.info("Disk %s successfully attached. controller pci_slot_number=%s, disk_slot=%d",
-                 vmdk_path, pci_slot_number, disk_slot)
+    logging.info("Disk %s successfully attached. controller type=%s pci_slot_number=%s, disk_slot=%d",
+                 vmdk_path, ctrl_type, pci_slot_number, disk_slot)
 
     return vm_dev_info
 
@@ -1481,10 +1749,11 @@ def set_vol_opts(name, tenant_name, options):
        logging.warning(msg)
        return False
 
-    # For now only allow resetting the access and attach-as options.
+    # For now only allow resetting the access, attach-as and trim options.
     valid_opts = {
         kv.ACCESS : kv.ACCESS_TYPES,
-        kv.ATTACH_AS : kv.ATTACH_AS_TYPES
+        kv.ATTACH_AS : kv.ATTACH_AS_TYPES,
+        kv.TRIM : kv.TRIM_TYPES
     }
 
     invalid = frozenset(opts.keys()).difference(valid_opts.keys())
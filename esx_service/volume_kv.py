@@ -92,6 +92,49 @@ DEFAULT_FILESYSTEM_TYPE = 'ext4'
 CLONE_FROM = 'clone-from' # clone volume parent
 DEFAULT_CLONE_FROM = 'None'
 
+# Docker name of a volume created under an alias by the volume-plugin
+# (VolumeAliases), when the Docker name isn't a valid volume name.
+DOCKER_NAME = 'docker-name'
+DEFAULT_DOCKER_NAME = 'None'
+# Aliases start with this prefix, only they can have a Docker name
+ALIAS_PREFIX = 'dvs-'
+
+# Scheduled trim of the filesystem by the volume-plugin, so thin disks
+# shrink back on the datastore. Volumes can opt out with trim=off.
+TRIM = 'trim'
+TRIM_ON = 'on'
+TRIM_OFF = 'off'
+DEFAULT_TRIM = TRIM_ON
+TRIM_TYPES = [TRIM_ON, TRIM_OFF]
+
+# Owner and permissions (octal) of the volume root, set by the volume-plugin
+# right after the filesystem is created.
+UID = 'uid'
+GID = 'gid'
+MODE = 'mode'
+DEFAULT_UID = 'None'
+DEFAULT_GID = 'None'
+DEFAULT_MODE = 'None'
+
+# A volume made with subvolumes=on has project quotas, the volume-plugin
+# keeps sub-volumes in it, each a directory with its own quota.
+SUBVOLUMES = 'subvolumes'
+SUBVOLUMES_ON = 'on'
+SUBVOLUMES_OFF = 'off'
+DEFAULT_SUBVOLUMES = SUBVOLUMES_OFF
+SUBVOLUMES_TYPES = [SUBVOLUMES_ON, SUBVOLUMES_OFF]
+
+# Containers which get the volume read-only from the volume-plugin, name
+# patterns or label rules separated by commas. Checked by the plugin.
+RO_FOR = 'ro-for'
+DEFAULT_RO_FOR = 'None'
+
+# Sub-volumes of a parent volume (subvolumes=on), kept at the top of its
+# metadata by name, each with its size, creation time and creating VM. They
+# are found and listed through their parent, a sub-volume has no disk.
+SUBVOLUME_LIST = 'sub-volumes'
+PARENT = 'parent'
+
 # Create a kv store object for this volume identified by vol_path
 # Create the side car or open if it exists.
 def init():
@@ -0,0 +1,172 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package main
+
+// Support bundle: a tar.gz with the plugin state from the admin socket,
+// the volumes seen from ESX, the configuration and the logs. Whatever
+// can't be collected is listed in errors.txt, a partial bundle is better
+// than none when the plugin is in trouble.
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/admin"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/config"
+)
+
+const procMounts = "/proc/mounts"
+
+// bundle - a tar.gz being written
+type bundle struct {
+	tw     *tar.Writer
+	dir    string // top directory in the archive
+	errors []string
+}
+
+// adds a file with the given content
+func (b *bundle) add(name string, content []byte) {
+	hdr := &tar.Header{
+		Name:    filepath.Join(b.dir, name),
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: time.Now(),
+	}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		b.fail(name, err)
+		return
+	}
+	if _, err := b.tw.Write(content); err != nil {
+		b.fail(name, err)
+	}
+}
+
+// adds a copy of a local file
+func (b *bundle) addFile(name string, path string) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		b.fail(name, err)
+		return
+	}
+	b.add(name, content)
+}
+
+// records what couldn't be collected
+func (b *bundle) fail(name string, err error) {
+	b.errors = append(b.errors, fmt.Sprintf("%s: %v", name, err))
+}
+
+func cmdSupportBundle(ctx *cmdContext, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("expected at most 1 argument, got %d", len(args))
+	}
+	name := fmt.Sprintf("vdvs-support-%s", time.Now().Format("20060102-150405"))
+	path := name + ".tar.gz"
+	if len(args) == 1 {
+		path = args[0]
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	b := &bundle{tw: tar.NewWriter(gz), dir: name}
+
+	// plugin state
+	for file, apiPath := range map[string]string{
+		"status.json":         admin.StatusPath,
+		"refcounts.json":      admin.RefCountsPath,
+		"mountids.json":       admin.MountIDsPath,
+		"mountroot.json":      admin.MountRootPath,
+		"reconciliation.json": admin.ReconciliationPath,
+		"config.json":         admin.ConfigPath,
+		"esx-inflight.json":   admin.InFlightPath,
+		"audit.json":          admin.AuditPath,
+	} {
+		content, err := ctx.client.GetRaw(apiPath)
+		if err != nil {
+			b.fail(file, err)
+			continue
+		}
+		b.add(file, content)
+	}
+
+	// ESX side
+	volumes, latency, err := esxCheck(ctx.ops)
+	if err != nil {
+		b.fail("esx-check.txt", err)
+	} else {
+		b.add("esx-check.txt", []byte(fmt.Sprintf("%d volumes, replied in %v\n", volumes, latency)))
+		if vols, err := listVolumes(ctx.ops); err != nil {
+			b.fail("volumes.json", err)
+		} else if content, err := json.MarshalIndent(vols, "", "  "); err != nil {
+			b.fail("volumes.json", err)
+		} else {
+			b.add("volumes.json", content)
+		}
+	}
+
+	// local state, configuration and logs
+	b.addFile("proc-mounts.txt", procMounts)
+	b.addFile(filepath.Base(ctx.configFile), ctx.configFile)
+	logPath := config.DefaultLogPath
+	if c, err := config.Load(ctx.configFile); err == nil {
+		logPath = c.LogPath
+	}
+	for _, logFile := range logFiles(logPath) {
+		b.addFile(filepath.Join("logs", filepath.Base(logFile)), logFile)
+	}
+
+	if len(b.errors) > 0 {
+		b.add("errors.txt", []byte(strings.Join(b.errors, "\n")+"\n"))
+	}
+	if err = b.tw.Close(); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Support bundle written to %s\n", path)
+	if len(b.errors) > 0 {
+		fmt.Printf("%d items couldn't be collected, see errors.txt in the bundle\n", len(b.errors))
+	}
+	return nil
+}
+
+// returns the log file and its rotated backups, named <name>-<timestamp><ext>
+func logFiles(logPath string) []string {
+	ext := filepath.Ext(logPath)
+	prefix := strings.TrimSuffix(logPath, ext) + "-"
+	backups, _ := filepath.Glob(prefix + "*")
+
+	files := []string{logPath}
+	for _, backup := range backups {
+		if strings.HasSuffix(backup, ext) || strings.HasSuffix(backup, ext+".gz") {
+			files = append(files, backup)
+		}
+	}
+	return files
+}
@@ -0,0 +1,403 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package main
+
+// vdvsctl subcommands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers/vmdk/vmdkops"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/admin"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/refcount"
+)
+
+const esxCheckTimeout = 10 * time.Second
+
+// prints v as indented JSON
+func printJSON(v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+}
+
+// returns the metadata value for key as a string, "" if missing
+func metaString(meta map[string]interface{}, key string) string {
+	value, exists := meta[key]
+	if !exists || value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+func checkArgs(args []string, n int) error {
+	if len(args) != n {
+		return fmt.Errorf("expected %d arguments, got %d", n, len(args))
+	}
+	return nil
+}
+
+func cmdStatus(ctx *cmdContext, args []string) error {
+	if err := checkArgs(args, 0); err != nil {
+		return err
+	}
+	var status admin.StatusResponse
+	if err := ctx.client.Get(admin.StatusPath, &status); err != nil {
+		return err
+	}
+	if ctx.jsonOutput {
+		return printJSON(status)
+	}
+	fmt.Printf("State:        %s\n", status.State)
+	if status.Reason != "" {
+		fmt.Printf("Reason:       %s\n", status.Reason)
+	}
+	fmt.Printf("Initialized:  %t\n", status.Initialized)
+	fmt.Printf("Dirty:        %t\n", status.Dirty)
+	return nil
+}
+
+// volumeMeta - a volume and its metadata from ESX
+type volumeMeta struct {
+	Name     string                 `json:"name"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+}
+
+// lists volumes on ESX with their metadata
+func listVolumes(ops vmdkops.VmdkOps) ([]volumeMeta, error) {
+	volumes, err := ops.List()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]volumeMeta, 0, len(volumes))
+	for _, vol := range volumes {
+		vm := volumeMeta{Name: vol.Name}
+		meta, err := ops.Get(vol.Name)
+		if err != nil {
+			vm.Error = err.Error()
+		} else {
+			vm.Metadata = meta
+		}
+		result = append(result, vm)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+func cmdVolumes(ctx *cmdContext, args []string) error {
+	if err := checkArgs(args, 0); err != nil {
+		return err
+	}
+	volumes, err := listVolumes(ctx.ops)
+	if err != nil {
+		return err
+	}
+	if ctx.jsonOutput {
+		return printJSON(volumes)
+	}
+
+	w := newTable()
+	fmt.Fprintln(w, "NAME\tCAPACITY\tALLOCATED\tSTATUS\tATTACHED TO\tACCESS\tFSTYPE")
+	for _, vol := range volumes {
+		if vol.Error != "" {
+			fmt.Fprintf(w, "%s\t\t\t%s\t\t\t\n", vol.Name, vol.Error)
+			continue
+		}
+		var size, allocated string
+		if capacity, ok := vol.Metadata["capacity"].(map[string]interface{}); ok {
+			size = metaString(capacity, "size")
+			allocated = metaString(capacity, "allocated")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", vol.Name, size, allocated,
+			metaString(vol.Metadata, "status"), metaString(vol.Metadata, "attached to VM"),
+			metaString(vol.Metadata, "access"), metaString(vol.Metadata, "fstype"))
+	}
+	return w.Flush()
+}
+
+func cmdInspect(ctx *cmdContext, args []string) error {
+	if err := checkArgs(args, 1); err != nil {
+		return err
+	}
+	meta, err := ctx.ops.Get(args[0])
+	if err != nil {
+		return err
+	}
+	return printJSON(meta)
+}
+
+func cmdRefCounts(ctx *cmdContext, args []string) error {
+	if err := checkArgs(args, 0); err != nil {
+		return err
+	}
+	var refCounts map[string]refcount.RefCountInfo
+	if err := ctx.client.Get(admin.RefCountsPath, &refCounts); err != nil {
+		return err
+	}
+	if ctx.jsonOutput {
+		return printJSON(refCounts)
+	}
+
+	var names []string
+	for name := range refCounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := newTable()
+	fmt.Fprintln(w, "VOLUME\tREFCOUNT\tMOUNTED\tDEVICE")
+	for _, name := range names {
+		rc := refCounts[name]
+		fmt.Fprintf(w, "%s\t%d\t%t\t%s\n", name, rc.Count, rc.Mounted, rc.Dev)
+	}
+	return w.Flush()
+}
+
+func cmdMounts(ctx *cmdContext, args []string) error {
+	if err := checkArgs(args, 0); err != nil {
+		return err
+	}
+	var entries []admin.MountRootEntry
+	if err := ctx.client.Get(admin.MountRootPath, &entries); err != nil {
+		return err
+	}
+	var mountIDs map[string]string
+	if err := ctx.client.Get(admin.MountIDsPath, &mountIDs); err != nil {
+		return err
+	}
+	if ctx.jsonOutput {
+		return printJSON(map[string]interface{}{"mountroot": entries, "mountids": mountIDs})
+	}
+
+	w := newTable()
+	fmt.Fprintln(w, "DIRECTORY\tMOUNTED\tDEVICE")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%t\t%s\n", entry.Name, entry.Mounted, entry.Device)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	w = newTable()
+	fmt.Fprintln(w, "MOUNT ID\tVOLUME")
+	for id, name := range mountIDs {
+		fmt.Fprintf(w, "%s\t%s\n", id, name)
+	}
+	return w.Flush()
+}
+
+func cmdReconciliation(ctx *cmdContext, args []string) error {
+	if err := checkArgs(args, 0); err != nil {
+		return err
+	}
+	var rec refcount.Reconciliation
+	if err := ctx.client.Get(admin.ReconciliationPath, &rec); err != nil {
+		return err
+	}
+	return printJSON(rec)
+}
+
+func cmdAudit(ctx *cmdContext, args []string) error {
+	if err := checkArgs(args, 0); err != nil {
+		return err
+	}
+	var entries []admin.AuditEntry
+	if err := ctx.client.Get(admin.AuditPath, &entries); err != nil {
+		return err
+	}
+	if ctx.jsonOutput {
+		return printJSON(entries)
+	}
+
+	w := newTable()
+	fmt.Fprintln(w, "TIME\tACTION\tVOLUME\tRESULT")
+	for _, entry := range entries {
+		result := "ok"
+		if entry.Error != "" {
+			result = entry.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", entry.Time.Format(time.RFC3339),
+			entry.Action, entry.Request.Volume, result)
+	}
+	return w.Flush()
+}
+
+// checks ESX connectivity with a list request. vmci calls can't be
+// interrupted, so on timeout the request is left behind.
+func esxCheck(ops vmdkops.VmdkOps) (int, time.Duration, error) {
+	type result struct {
+		volumes int
+		err     error
+	}
+	done := make(chan result, 1)
+	start := time.Now()
+	go func() {
+		volumes, err := ops.List()
+		done <- result{len(volumes), err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.volumes, time.Since(start), res.err
+	case <-time.After(esxCheckTimeout):
+		return 0, esxCheckTimeout, fmt.Errorf("no reply from ESX after %v", esxCheckTimeout)
+	}
+}
+
+func cmdEsxCheck(ctx *cmdContext, args []string) error {
+	if err := checkArgs(args, 0); err != nil {
+		return err
+	}
+	volumes, latency, err := esxCheck(ctx.ops)
+	if err != nil {
+		return fmt.Errorf("ESX service unreachable on port %d: %v", vmdkops.EsxPort, err)
+	}
+	fmt.Printf("ESX service reachable on port %d, %d volumes visible, replied in %v\n",
+		vmdkops.EsxPort, volumes, latency)
+	return nil
+}
+
+func cmdRepair(ctx *cmdContext, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing repair action")
+	}
+
+	var path string
+	req := admin.RepairRequest{}
+	switch args[0] {
+	case "unmount", "detach":
+		if err := checkArgs(args[1:], 1); err != nil {
+			return err
+		}
+		path = admin.RepairUnmountPath
+		if args[0] == "detach" {
+			path = admin.RepairDetachPath
+		}
+		req.Volume = args[1]
+	case "refcount":
+		if err := checkArgs(args[1:], 2); err != nil {
+			return err
+		}
+		path = admin.RepairRefCountPath
+		req.Volume = args[1]
+		count, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("invalid refcount %s", args[2])
+		}
+		// +N and -N adjust the refcount, N sets it
+		if strings.HasPrefix(args[2], "+") || strings.HasPrefix(args[2], "-") {
+			req.Delta = &count
+		} else {
+			req.Count = &count
+		}
+	case "resync":
+		if err := checkArgs(args[1:], 0); err != nil {
+			return err
+		}
+		path = admin.RepairResyncPath
+	default:
+		return fmt.Errorf("unknown repair action %s", args[0])
+	}
+
+	resp, err := ctx.client.Repair(path, req)
+	if err != nil {
+		return err
+	}
+	if ctx.jsonOutput {
+		return printJSON(resp)
+	}
+	switch {
+	case resp.RefCount != nil:
+		fmt.Printf("%s: done, %s refcount is now %d\n", resp.Action, resp.Volume, *resp.RefCount)
+	case resp.Volume != "":
+		fmt.Printf("%s: done for %s\n", resp.Action, resp.Volume)
+	default:
+		fmt.Printf("%s: done\n", resp.Action)
+	}
+	return nil
+}
+
+func cmdExport(ctx *cmdContext, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("expected 1 or 2 arguments, got %d", len(args))
+	}
+	if len(args) == 1 || args[1] == "-" {
+		return ctx.client.Export(args[0], os.Stdout)
+	}
+
+	f, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = ctx.client.Export(args[0], f)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		// don't leave a truncated archive behind
+		os.Remove(args[1])
+	}
+	return err
+}
+
+func cmdImport(ctx *cmdContext, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("expected at least 2 arguments, got %d", len(args))
+	}
+	opts := make(map[string]string)
+	for _, opt := range args[2:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("invalid option %s, expected OPTION=VALUE", opt)
+		}
+		opts[kv[0]] = kv[1]
+	}
+
+	in := os.Stdin
+	if args[1] != "-" {
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	resp, err := ctx.client.Import(args[0], opts, in)
+	if err != nil {
+		return err
+	}
+	if ctx.jsonOutput {
+		return printJSON(resp)
+	}
+	fmt.Printf("%s: done, created %s\n", resp.Action, resp.Volume)
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package main
+
+// vdvsctl - command line client for the docker-volume-vsphere plugin.
+//
+// Talks to the running plugin over its admin socket, and to ESX directly
+// with the vmdkops library for the commands which don't need the plugin
+// (volume listing, ESX connectivity).
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers/vmdk/vmdkops"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/admin"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/config"
+)
+
+const (
+	defaultPort   = 1019
+	defaultSocket = "/run/docker/plugins/vsphere-admin.sock"
+)
+
+// command - a vdvsctl subcommand
+type command struct {
+	usage string // arguments
+	help  string
+	run   func(ctx *cmdContext, args []string) error
+}
+
+// cmdContext - what the commands need, from the global flags
+type cmdContext struct {
+	client     *admin.Client
+	ops        vmdkops.VmdkOps
+	configFile string
+	jsonOutput bool
+}
+
+var commands = map[string]command{
+	"status": {
+		help: "Show plugin health",
+		run:  cmdStatus,
+	},
+	"volumes": {
+		help: "List volumes on ESX with their metadata (talks to ESX directly)",
+		run:  cmdVolumes,
+	},
+	"inspect": {
+		usage: "VOLUME",
+		help:  "Show all the metadata of a volume (talks to ESX directly)",
+		run:   cmdInspect,
+	},
+	"refcounts": {
+		help: "Show refcounts and mount state of the volumes in use",
+		run:  cmdRefCounts,
+	},
+	"mounts": {
+		help: "Show the mount root content and Docker mount IDs",
+		run:  cmdMounts,
+	},
+	"reconciliation": {
+		help: "Show the outcome of the last volume usage discovery",
+		run:  cmdReconciliation,
+	},
+	"esx-check": {
+		help: "Check ESX connectivity (talks to ESX directly)",
+		run:  cmdEsxCheck,
+	},
+	"audit": {
+		help: "Show the last repair actions",
+		run:  cmdAudit,
+	},
+	"repair": {
+		usage: "unmount|detach VOLUME | refcount VOLUME [+|-]COUNT | resync",
+		help:  "Repair a volume whose refcount went wrong",
+		run:   cmdRepair,
+	},
+	"export": {
+		usage: "VOLUME [FILE|-]",
+		help:  "Write the contents of a volume as a tar archive, to stdout by default",
+		run:   cmdExport,
+	},
+	"import": {
+		usage: "VOLUME FILE|- [OPTION=VALUE ...]",
+		help:  "Create a volume from a tar or tar.gz archive, with create options",
+		run:   cmdImport,
+	},
+	"support-bundle": {
+		usage: "[FILE]",
+		help:  "Collect plugin state, configuration and logs into a tar.gz",
+		run:   cmdSupportBundle,
+	},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] COMMAND [ARGS]\n\nCommands:\n", os.Args[0])
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := commands[name]
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, cmd.help)
+		if cmd.usage != "" {
+			fmt.Fprintf(os.Stderr, "  %-16s   %s %s\n", "", name, cmd.usage)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	socket := flag.String("socket", defaultSocket, "Admin socket of the plugin")
+	port := flag.Int("port", defaultPort, "Port to connect to ESX service")
+	configFile := flag.String("config", config.DefaultConfigPath, "Configuration file of the plugin")
+	jsonOutput := flag.Bool("json", false, "Print JSON instead of tables")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, exists := commands[flag.Arg(0)]
+	if !exists {
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	// vmdkops logs through logrus, keep it for errors
+	log.SetLevel(log.ErrorLevel)
+	vmdkops.EsxPort = *port
+
+	ctx := &cmdContext{
+		client:     admin.NewClient(*socket),
+		ops:        vmdkops.VmdkOps{Cmd: vmdkops.EsxVmdkCmd{Mtx: &sync.Mutex{}}},
+		configFile: *configFile,
+		jsonOutput: *jsonOutput,
+	}
+	if err := cmd.run(ctx, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -31,15 +31,17 @@ package photon
 import (
 	"fmt"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/config"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/metrics"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/refcount"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/volopts"
 	"github.com/vmware/photon-controller-go-sdk/photon"
 )
 
@@ -50,9 +52,7 @@ const (
 	version              = "Photon volume driver 0.1"
 	driverName           = "photon"
 	photonPersistentDisk = "persistent-disk"
-	capacityKB           = 1024
 	capacityGB           = 1
-	fsTypeTag            = "Fs_Type"
 )
 
 // VolumeDriver - Photon volume driver struct
@@ -79,7 +79,7 @@ func (d *VolumeDriver) verifyTarget() error {
 }
 
 // NewVolumeDriver - creates Driver, creates client for given target
-func NewVolumeDriver(targetURL string, projectID string, hostID string, mountDir string) *VolumeDriver {
+func NewVolumeDriver(targetURL string, projectID string, hostID string, mountDir string, c config.Config) *VolumeDriver {
 
 	d := &VolumeDriver{
 		target:  targetURL,
@@ -94,21 +94,38 @@ func NewVolumeDriver(targetURL string, projectID string, hostID string, mountDir
 		log.WithFields(log.Fields{"target": targetURL, "project-id": projectID}).Warning("Invalid target and or project ID, exiting.")
 		return nil
 	}
+	runtime, err := refcount.NewRuntime(c.Runtime, c.RuntimeEndpoint)
+	if err != nil {
+		log.WithFields(log.Fields{"runtime": c.Runtime, "error": err}).Warning("Invalid container runtime, exiting.")
+		return nil
+	}
 	d.mountRoot = mountDir
-	d.refCounts = refcount.NewRefCountsMap()
+	d.refCounts = refcount.NewRefCountsMap(runtime)
+	d.Reconfigure(c)
 	d.refCounts.Init(d, mountDir, driverName)
 	d.mountIDtoName = make(map[string]string)
+	d.refCounts.RegisterMetrics()
+	plugin_utils.RegisterUsageMetrics(mountDir)
 
 	log.WithFields(log.Fields{
 		"version": version,
 		"target":  targetURL,
 		"project": projectID,
 		"hostID":  hostID,
+		"runtime": runtime.Name(),
 	}).Info("Docker Photon plugin started ")
 
 	return d
 }
 
+// Reconfigure - apply the retry and timeout policy of the config, on start
+// and when the config is reloaded
+func (d *VolumeDriver) Reconfigure(c config.Config) {
+	fs.SetDevWaitTimeout(time.Duration(c.DeviceWaitTimeoutSec) * time.Second)
+	fs.SetPolling(c.DeviceDiscovery == config.DeviceDiscoveryPoll)
+	d.refCounts.SetPolicy(refcount.NewPolicy(c))
+}
+
 // In following three operations on refcount, if refcount
 // map hasn't been initialized, return 1 prevent detach and remove.
 
@@ -140,26 +157,22 @@ func (d *VolumeDriver) getMountPoint(volName string) string {
 	return filepath.Join(d.mountRoot, volName)
 }
 
-func validateCreateOptions(r volume.Request, fsMap map[string]string) error {
-	// Clone isn't supported
-	if _, result := r.Options["clone-from"]; result == true {
-		return fmt.Errorf("Unrecognized option - clone-from")
-	}
-
-	// Flavor must be specified
-	if _, result := r.Options["flavor"]; result == false {
-		return fmt.Errorf("Missing option - flavor")
+// returns the create options checked and normalized, with the default fstype
+func validateCreateOptions(r volume.Request, fsMap map[string]string) (map[string]string, error) {
+	opts, err := volopts.Photon.Validate(r.Options)
+	if err != nil {
+		return nil, err
 	}
 
 	// Use default fstype if not specified
-	if _, result := r.Options[fsTypeTag]; result == false {
-		r.Options[fsTypeTag] = fs.FstypeDefault
+	if _, result := opts[volopts.Fstype]; result == false {
+		opts[volopts.Fstype] = fs.FstypeDefault
 	}
 
 	// Verify the existence of fstype mkfs
-	_, result := fsMap[r.Options[fsTypeTag]]
+	_, result := fsMap[opts[volopts.Fstype]]
 	if result == false {
-		msg := "Not found mkfs for " + r.Options[fsTypeTag]
+		msg := "Not found mkfs for " + opts[volopts.Fstype]
 		msg += "\nSupported filesystems found: "
 		validfs := ""
 		for fs := range fsMap {
@@ -170,10 +183,10 @@ func validateCreateOptions(r volume.Request, fsMap map[string]string) error {
 			}
 		}
 		log.WithFields(log.Fields{"name": r.Name,
-			"fstype": r.Options[fsTypeTag]}).Error("Not found ")
-		return fmt.Errorf(msg + validfs)
+			"fstype": opts[volopts.Fstype]}).Error("Not found ")
+		return nil, fmt.Errorf(msg + validfs)
 	}
-	return nil
+	return opts, nil
 }
 
 func (d *VolumeDriver) taskWait(id string) error {
@@ -187,38 +200,17 @@ func (d *VolumeDriver) taskWait(id string) error {
 	return nil
 }
 
-func getDiskSize(r volume.Request) (int, error) {
-	// Convert given size to GB and default to min
-	// 1GB.
-	capacity, err := r.Options["size"]
-	if err == false {
+// returns the size in GB of checked create options, default to min 1GB
+func getDiskSize(opts map[string]string) (int, error) {
+	size, exists := opts[volopts.Size]
+	if !exists {
 		return capacityGB, nil
 	}
-	capacity = strings.ToLower(capacity)
-
-	if strings.HasSuffix(capacity, "mb") {
-		val := strings.Split(capacity, "mb")
-		bytes, err := strconv.Atoi(val[0])
-		if err != nil {
-			return 0, err
-		}
-		log.Debugf("Got bytes=%d", bytes)
-		if bytes < capacityKB || (bytes/capacityKB) < capacityGB {
-			return 0, fmt.Errorf("Invalid size %s specified for volume %s",
-				r.Options["size"], r.Name)
-		}
-		return bytes / capacityKB, nil
-	} else if strings.HasSuffix(capacity, "gb") {
-		val := strings.Split(capacity, "gb")
-		bytes, err := strconv.Atoi(val[0])
-		if err != nil {
-			return 0, err
-		}
-		log.Debugf("Got bytes=%d", bytes)
-		return bytes, nil
+	sizeKB, err := volopts.ParseSize(size)
+	if err != nil {
+		return 0, err
 	}
-	return 0, fmt.Errorf("Invalid size %s specified for volume %s, size is specified as <size>mb/gb",
-		r.Options["size"], r.Name)
+	return int(volopts.SizeGB(sizeKB)), nil
 }
 
 func convertDiskTags2Map(tags []string, status map[string]interface{}) {
@@ -233,7 +225,7 @@ func convertDiskTags2Map(tags []string, status map[string]interface{}) {
 	}
 }
 
-// Get info about a single volume
+// Get info about a single volume, with its usage if it is mounted here
 func (d *VolumeDriver) Get(r volume.Request) volume.Response {
 	mountpoint := d.getMountPoint(r.Name)
 	status, err := d.GetVolume(r.Name)
@@ -243,6 +235,7 @@ func (d *VolumeDriver) Get(r volume.Request) volume.Response {
 		).Error("Failed to get data for volume ")
 		return volume.Response{Err: err.Error()}
 	}
+	plugin_utils.AddVolumeUsage(status, r.Name, d.mountRoot)
 	log.WithFields(log.Fields{"name": r.Name, "status": status}).Info("Volume meta-data ")
 	return volume.Response{Volume: &volume.Volume{
 		Name:       r.Name,
@@ -404,7 +397,7 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 		}
 	}
 
-	fstype, exists := volumeMeta[fsTypeTag]
+	fstype, exists := volumeMeta[volopts.Fstype]
 	if !exists {
 		fstype = fs.FstypeDefault
 	}
@@ -467,19 +460,21 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 	// Get existent filesystem tools, for now only ext4
 	supportedFs := fs.MkfsLookup()
 
-	err := validateCreateOptions(r, supportedFs)
+	opts, err := validateCreateOptions(r, supportedFs)
 	if err != nil {
+		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Invalid volume options ")
 		return volume.Response{Err: err.Error()}
 	}
+	r.Options = opts
 
-	size, errSize := getDiskSize(r)
+	size, errSize := getDiskSize(r.Options)
 	if errSize != nil {
 		log.WithFields(log.Fields{"name": r.Name, "error": errSize}).Error("Create volume failed, invalid size ")
 		return volume.Response{Err: errSize.Error()}
 	}
 
 	// For now only the fstype is added as a tag to the disk
-	tags := []string{"fstype:" + r.Options[fsTypeTag]}
+	tags := []string{"fstype:" + r.Options[volopts.Fstype]}
 
 	// Create disk
 	dSpec := photon.DiskCreateSpec{Flavor: r.Options["flavor"],
@@ -506,7 +501,7 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 	}
 
 	// Handle filesystem creation
-	log.WithFields(log.Fields{"name": r.Name, "fstype": r.Options[fsTypeTag]}).Info("Attaching volume and creating filesystem ")
+	log.WithFields(log.Fields{"name": r.Name, "fstype": r.Options[volopts.Fstype]}).Info("Attaching volume and creating filesystem ")
 
 	errAttach := d.attachVolume(r.Name, createTask.Entity.ID)
 	if errAttach != nil {
@@ -532,7 +527,7 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 		return volume.Response{Err: errGetDevicePath.Error()}
 	}
 
-	errMkfs := fs.Mkfs(supportedFs[r.Options[fsTypeTag]], r.Name, device)
+	errMkfs := fs.Mkfs(supportedFs[r.Options[volopts.Fstype]], r.Name, device)
 	if errMkfs != nil {
 		log.WithFields(log.Fields{"name": r.Name, "error": errMkfs}).Error("Create filesystem failed, removing the volume ")
 		err = d.detachVolume(r.Name, createTask.Entity.ID)
@@ -552,7 +547,7 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 		return volume.Response{Err: err.Error()}
 	}
 
-	log.WithFields(log.Fields{"name": r.Name, "fstype": r.Options[fsTypeTag]}).Info("Volume and filesystem created ")
+	log.WithFields(log.Fields{"name": r.Name, "fstype": r.Options[volopts.Fstype]}).Info("Volume and filesystem created ")
 	return volume.Response{Err: ""}
 }
 
@@ -563,7 +558,7 @@ func (d *VolumeDriver) Remove(r volume.Request) volume.Response {
 	// Cannot remove volumes till plugin completely initializes (refcounting is complete)
 	// because we don't know if it is being used or not
 	if d.refCounts.IsInitialized() != true {
-		msg := fmt.Sprintf(plugin_utils.PluginInitError+" Cannot remove volume=%s", r.Name)
+		msg := fmt.Sprintf("%s Cannot remove volume=%s", d.refCounts.NotReadyReason(), r.Name)
 		log.Error(msg)
 		return volume.Response{Err: msg}
 	}
@@ -604,6 +599,50 @@ func (d *VolumeDriver) Remove(r volume.Request) volume.Response {
 	return volume.Response{Err: ""}
 }
 
+// RefCounts - return the refcounts map of the driver
+func (d *VolumeDriver) RefCounts() *refcount.RefCountsMap {
+	return d.refCounts
+}
+
+// MountIDs - return a copy of the mount ID -> full volume name map
+func (d *VolumeDriver) MountIDs() map[string]string {
+	d.refCounts.StateMtx.Lock()
+	defer d.refCounts.StateMtx.Unlock()
+
+	mountIDs := make(map[string]string)
+	for id, name := range d.mountIDtoName {
+		mountIDs[id] = name
+	}
+	return mountIDs
+}
+
+// Detach - detach the volume from the VM, without unmounting it
+func (d *VolumeDriver) Detach(name string) error {
+	status, err := d.GetVolume(name)
+	if err != nil {
+		return err
+	}
+	id, ok := status["ID"].(string)
+	if !ok {
+		return fmt.Errorf("Volume %s has no disk ID", name)
+	}
+	return d.detachVolume(name, id)
+}
+
+// ForgetMountIDs - drop the mount IDs referring to the volume, caller holds StateMtx
+func (d *VolumeDriver) ForgetMountIDs(name string) {
+	for id, vol := range d.mountIDtoName {
+		if vol == name {
+			delete(d.mountIDtoName, id)
+		}
+	}
+}
+
+// Status - Report plugin health
+func (d *VolumeDriver) Status() refcount.Status {
+	return d.refCounts.GetStatus()
+}
+
 // Capabilities - Report plugin scope to Docker
 func (d *VolumeDriver) Capabilities(r volume.Request) volume.Response {
 	return volume.Response{Capabilities: volume.Capability{Scope: "global"}}
@@ -620,32 +659,49 @@ func (d *VolumeDriver) Path(r volume.Request) volume.Response {
 // Mount - mount a volume
 func (d *VolumeDriver) Mount(r volume.MountRequest) volume.Response {
 	log.WithFields(log.Fields{"name": r.Name}).Info("Mounting volume ")
+	start := time.Now()
 
 	// lock the state
 	d.refCounts.StateMtx.Lock()
 	defer d.refCounts.StateMtx.Unlock()
 
-	// checked by refcounting thread until refmap initialized
-	// useless after that
+	// checked by refcounting thread, which may also run on operator
+	// request after the refmap is initialized
 	d.refCounts.MarkDirty()
 
-	return d.processMount(r)
+	resp := d.processMount(r)
+	metrics.ObserveRequest("mount", start, resp.Err)
+	return resp
 }
 
 // Unmount request from Docker. If mount refcount is drop to 0,
 // Unmount and detach from VM
-func (d *VolumeDriver) Unmount(r volume.UnmountRequest) volume.Response {
+func (d *VolumeDriver) Unmount(r volume.UnmountRequest) (resp volume.Response) {
 	log.WithFields(log.Fields{"name": r.Name}).Info("Unmounting Volume ")
+	defer func(start time.Time) {
+		metrics.ObserveRequest("unmount", start, resp.Err)
+	}(time.Now())
 
 	// lock the state
 	d.refCounts.StateMtx.Lock()
 	defer d.refCounts.StateMtx.Unlock()
 
+	// checked by refcounting thread, which may also run on operator
+	// request after the refmap is initialized
+	d.refCounts.MarkDirty()
+
 	if d.refCounts.IsInitialized() != true {
 		// if refcounting hasn't been succesful,
 		// no refcounting, no unmount. All unmounts are delayed
 		// until we succesfully populate the refcount map
-		d.refCounts.MarkDirty()
+		// In degraded mode we don't know when that will be, so tell
+		// the user the volume is left attached.
+		if d.refCounts.GetState() == refcount.StateDegraded {
+			msg := fmt.Sprintf("%s Volume stays attached until refcounting recovers, volume=%s",
+				d.refCounts.NotReadyReason(), r.Name)
+			log.Error(msg)
+			return volume.Response{Err: msg}
+		}
 		return volume.Response{Err: ""}
 	}
 
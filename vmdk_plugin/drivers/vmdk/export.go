@@ -0,0 +1,242 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Export and import of volume contents as tar streams, for the admin API.
+//
+// A volume mounted for containers is archived where it is mounted, its
+// refcount isn't touched. If the last container unmounts it during the
+// export, the unmount is done once the export is over. A volume which
+// isn't mounted is attached and mounted read-only on a temporary directory
+// outside of the mount root, Docker can't mount it until the export is
+// over. A sub-volume which isn't mounted is archived from its parent,
+// held mounted for the export.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/metrics"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/volname"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/volopts"
+)
+
+// exportState - the exports in progress of a volume, guarded by StateMtx
+type exportState struct {
+	count          int    // exports in progress
+	dir            string // directory archived
+	device         string // device of a private mount
+	private        bool   // dir is a temporary read-only mount
+	parent         string // parent held for the export of a sub-volume
+	unmountPending bool   // the volume was unmounted by Docker during the export
+}
+
+// Export - writes the contents of the volume as a tar stream to w
+func (d *VolumeDriver) Export(name string, w io.Writer) error {
+	start := time.Now()
+	name = d.BackendName(name)
+
+	d.refCounts.StateMtx.Lock()
+	name, exp, err := d.startExport(name)
+	d.refCounts.StateMtx.Unlock()
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Error("Failed to export volume ")
+		metrics.ObserveRequest("export", start, err.Error())
+		return err
+	}
+
+	log.WithFields(log.Fields{"name": name, "dir": exp.dir}).Info("Exporting volume ")
+	err = fs.Archive(exp.dir, w)
+
+	d.refCounts.StateMtx.Lock()
+	errFinish := d.finishExport(name, exp)
+	d.refCounts.StateMtx.Unlock()
+
+	if err == nil {
+		err = errFinish
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Error("Failed to export volume ")
+		metrics.ObserveRequest("export", start, err.Error())
+		return err
+	}
+	log.WithFields(log.Fields{"name": name}).Info("Volume exported ")
+	metrics.ObserveRequest("export", start, "")
+	return nil
+}
+
+// finds the directory to archive, mounting the volume if needed. Returns
+// the full volume name. Caller holds StateMtx.
+func (d *VolumeDriver) startExport(name string) (string, *exportState, error) {
+	volumeInfo, err := plugin_utils.GetVolumeInfo(name, "", d)
+	if err != nil {
+		return name, nil, err
+	}
+	name = volumeInfo.VolumeName
+
+	if exp, exists := d.exports[name]; exists {
+		exp.count++
+		return name, exp, nil
+	}
+
+	exp := &exportState{count: 1}
+	if plugin_utils.AlreadyMounted(name, mountRoot) {
+		exp.dir = getMountPoint(name)
+		if stat, err := os.Stat(exp.dir); err != nil || !stat.IsDir() {
+			return name, nil, fmt.Errorf("Volume %s has no filesystem, raw volumes can't be exported", name)
+		}
+		d.exports[name] = exp
+		return name, exp, nil
+	}
+	if p, held := d.parents[name]; held {
+		// mounted for its sub-volumes
+		exp.dir = p.dir
+		d.exports[name] = exp
+		return name, exp, nil
+	}
+
+	volumeMeta := volumeInfo.VolumeMeta
+	if volumeMeta == nil {
+		if volumeMeta, err = d.GetVolume(name); err != nil {
+			return name, nil, err
+		}
+	}
+	if parent, child := volumeMeta[volopts.Parent].(string); child {
+		p, err := d.holdParent(parent)
+		if err != nil {
+			return name, nil, err
+		}
+		exp.dir = subvolumeDir(p, name)
+		exp.parent = parent
+		d.exports[name] = exp
+		return name, exp, nil
+	}
+	fstype, exists := volumeMeta["fstype"].(string)
+	if !exists {
+		fstype = fs.FstypeDefault
+	}
+	if fstype == volopts.FstypeRaw {
+		return name, nil, fmt.Errorf("Volume %s has no filesystem, raw volumes can't be exported", name)
+	}
+
+	device, err := d.attachDevice(name, fstype, volumeMeta)
+	if err != nil {
+		d.detachVolume(name, "", false)
+		return name, nil, err
+	}
+	exp.dir, err = fs.MountTemp(device, fstype, true)
+	if err != nil {
+		d.detachVolume(name, device, false)
+		return name, nil, err
+	}
+	exp.device = device
+	exp.private = true
+	d.exports[name] = exp
+	return name, exp, nil
+}
+
+// ends an export, the last one unmounts and detaches a private mount, or
+// does the unmount Docker asked for meanwhile. Caller holds StateMtx.
+func (d *VolumeDriver) finishExport(name string, exp *exportState) error {
+	exp.count--
+	if exp.count > 0 {
+		return nil
+	}
+	delete(d.exports, name)
+
+	if exp.private {
+		if err := fs.UnmountTemp(exp.dir); err != nil {
+			return err
+		}
+		return d.detachVolume(name, exp.device, false)
+	}
+	if exp.parent != "" {
+		d.releaseParent(exp.parent)
+	}
+	if exp.unmountPending && d.getRefCount(name) == 0 {
+		log.WithFields(log.Fields{"name": name}).Info("Export done, unmounting volume ")
+		return d.UnmountVolume(name)
+	}
+	// a parent may no longer be needed by its sub-volumes
+	d.tidyParent(name)
+	return nil
+}
+
+// has ESX attach the disk and returns its device, checked to be the disk of
+// the volume with the fstype and metadata
+func (d *VolumeDriver) attachDevice(name string, fstype string, meta map[string]interface{}) (string, error) {
+	if d.useMockEsx {
+		dev, err := d.ops.Attach(name, nil)
+		return string(dev[:]), err
+	}
+
+	waiter := fs.NewDeviceWaiter(name)
+	dev, err := d.ops.Attach(name, nil)
+	if err != nil {
+		waiter.Close()
+		return "", err
+	}
+	return fs.GetAttachedDevice(name, d.volumeLabels(name, fstype, meta), dev, waiter)
+}
+
+// returns the labels the filesystem of the volume may have, none for a raw
+// volume. A clone has the filesystem of its source, made by a clone of
+// another volume maybe, the labels of all of them are accepted.
+func (d *VolumeDriver) volumeLabels(name string, fstype string, meta map[string]interface{}) []string {
+	if fstype == volopts.FstypeRaw {
+		return nil
+	}
+	labels := fs.VolumeLabels(fstype, name)
+	_, datastore := volname.Split(name)
+	for depth := 0; depth < maxCloneDepth; depth++ {
+		source, _ := meta[volopts.CloneFrom].(string)
+		if source == "" || source == defaultCloneFrom {
+			break
+		}
+		if !strings.Contains(source, "@") {
+			source = volname.Join(source, datastore)
+		}
+		labels = append(labels, fs.VolumeLabels(fstype, source)...)
+		var err error
+		if meta, err = d.ops.Get(source); err != nil {
+			// the source was removed, its own source is unknown
+			break
+		}
+	}
+	return labels
+}
+
+// Import - creates the volume with opts and fills it from a tar or tar.gz
+// stream, as written by Export
+func (d *VolumeDriver) Import(name string, opts map[string]string, r io.Reader) error {
+	start := time.Now()
+	log.WithFields(log.Fields{"name": name}).Info("Importing volume ")
+	resp := d.createVolume(volume.Request{Name: name, Options: opts}, func(dir string) error {
+		return fs.Extract(r, dir)
+	})
+	metrics.ObserveRequest("import", start, resp.Err)
+	if resp.Err != "" {
+		return errors.New(resp.Err)
+	}
+	return nil
+}
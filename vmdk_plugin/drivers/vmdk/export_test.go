@@ -0,0 +1,168 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers/vmdk/vmdkops"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/refcount"
+	"golang.org/x/net/context"
+)
+
+const testVolume = "vol1@datastore1"
+
+// noContainers - a container runtime without containers
+type noContainers struct{}
+
+func (noContainers) Name() string { return "none" }
+
+func (noContainers) Ping(ctx context.Context) error { return nil }
+
+func (noContainers) ListContainers(ctx context.Context) ([]refcount.Container, error) {
+	return nil, nil
+}
+
+func (noContainers) ContainerMounts(ctx context.Context, id string) ([]refcount.Mount, error) {
+	return nil, &refcount.ContainerNotFoundError{ID: id}
+}
+
+func (noContainers) StartingContainers(ctx context.Context, volume string) ([]refcount.Container, error) {
+	return nil, nil
+}
+
+// recordingCmd - the mock ESX, recording the commands it runs
+type recordingCmd struct {
+	vmdkops.MockVmdkCmd
+	cmds *[]string
+}
+
+func (c recordingCmd) Run(cmd string, name string, opts map[string]string) ([]byte, error) {
+	*c.cmds = append(*c.cmds, cmd+" "+name)
+	return c.MockVmdkCmd.Run(cmd, name, opts)
+}
+
+// returns a driver on the mock ESX with its refcounts discovered, and the
+// commands sent to ESX
+func newTestDriver(t *testing.T) (*VolumeDriver, *[]string) {
+	dir, err := ioutil.TempDir("", "export_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountRoot = dir
+
+	cmds := &[]string{}
+	d := &VolumeDriver{
+		useMockEsx:    true,
+		ops:           vmdkops.VmdkOps{Cmd: recordingCmd{cmds: cmds}},
+		refCounts:     refcount.NewRefCountsMap(noContainers{}),
+		mountIDtoName: make(map[string]string),
+		exports:       make(map[string]*exportState),
+		parents:       make(map[string]*parentState),
+		subvols:       newSubvolumeCache(),
+	}
+	if err = d.refCounts.Resync(d); err != nil {
+		t.Fatal(err)
+	}
+	return d, cmds
+}
+
+// Docker unmounts a volume mounted for containers while it is exported, the
+// unmount and detach are done by the end of the export
+func TestExportUnmountPending(t *testing.T) {
+	d, cmds := newTestDriver(t)
+	defer os.RemoveAll(mountRoot)
+
+	exp := &exportState{count: 1, dir: getMountPoint(testVolume)}
+	d.exports[testVolume] = exp
+
+	assert.Nil(t, d.UnmountVolume(testVolume))
+	assert.True(t, exp.unmountPending)
+	assert.Empty(t, *cmds)
+
+	assert.Nil(t, d.finishExport(testVolume, exp))
+	assert.NotContains(t, d.exports, testVolume)
+	assert.Equal(t, []string{"detach " + testVolume}, *cmds)
+}
+
+// a container mounting the volume again during the export cancels the
+// pending unmount
+func TestExportUnmountPendingRemounted(t *testing.T) {
+	d, cmds := newTestDriver(t)
+	defer os.RemoveAll(mountRoot)
+
+	exp := &exportState{count: 1, dir: getMountPoint(testVolume)}
+	d.exports[testVolume] = exp
+
+	assert.Nil(t, d.UnmountVolume(testVolume))
+	d.incrRefCount(testVolume)
+
+	assert.Nil(t, d.finishExport(testVolume, exp))
+	assert.NotContains(t, d.exports, testVolume)
+	assert.Empty(t, *cmds)
+}
+
+// exports of a volume in progress share its state, the last one ends it
+func TestExportNested(t *testing.T) {
+	d, cmds := newTestDriver(t)
+	defer os.RemoveAll(mountRoot)
+
+	// mounted for its sub-volumes
+	p := &parentState{busy: 1, dir: mountRoot, device: "/dev/sdb"}
+	d.parents[testVolume] = p
+
+	name, exp, err := d.startExport(testVolume)
+	assert.Nil(t, err)
+	assert.Equal(t, testVolume, name)
+	assert.Equal(t, p.dir, exp.dir)
+	assert.False(t, exp.private)
+
+	_, nested, err := d.startExport(testVolume)
+	assert.Nil(t, err)
+	assert.True(t, exp == nested)
+	assert.Equal(t, 2, exp.count)
+
+	assert.Nil(t, d.finishExport(testVolume, exp))
+	assert.Equal(t, 1, exp.count)
+	assert.Contains(t, d.exports, testVolume)
+
+	assert.Nil(t, d.finishExport(testVolume, exp))
+	assert.NotContains(t, d.exports, testVolume)
+	assert.Contains(t, d.parents, testVolume)
+	assert.Empty(t, *cmds)
+}
+
+// a volume mounted privately for an export can't be mounted for containers
+// or sub-volumes until the export is over
+func TestPrivateExportBlocksMounts(t *testing.T) {
+	d, cmds := newTestDriver(t)
+	defer os.RemoveAll(mountRoot)
+
+	d.exports[testVolume] = &exportState{count: 1, dir: mountRoot, device: "/dev/sdb", private: true}
+
+	resp := d.processMount(volume.MountRequest{Name: testVolume, ID: "id1"})
+	assert.Contains(t, resp.Err, "being exported")
+	assert.Equal(t, uint(0), d.getRefCount(testVolume))
+	assert.NotContains(t, d.mountIDtoName, "id1")
+
+	_, err := d.holdParent(testVolume)
+	assert.NotNil(t, err)
+	assert.NotContains(t, d.parents, testVolume)
+	assert.Empty(t, *cmds)
+}
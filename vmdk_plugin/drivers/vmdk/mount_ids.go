@@ -0,0 +1,163 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package vmdk
+
+// The device of a volume is mounted once at <mount root>/<volume>, each
+// Docker mount ID gets its own bind mount of it, at
+// <mount root>/.mounts/<volume>/<mount ID>. The bind mount is read-only
+// for the containers selected by the ro-for rules of the volume, so
+// sidecars can get a volume read-only while another container writes to
+// it. Raw volumes are given as mounted, the container gets the device.
+//
+// Docker doesn't say which container a mount request is for, the
+// candidates are the containers using the volume which aren't running. The
+// runtime is asked before StateMtx is taken, as it may be slow to answer.
+// If the candidates don't all agree on the rules, or the runtime can't
+// tell, the mount fails rather than guess.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/volopts"
+)
+
+// bindMountID - bind mounts the volume mounted at mountpoint for the
+// Docker mount ID, read-only if isReadOnly, returns the mount point for
+// the container. Caller holds StateMtx.
+func (d *VolumeDriver) bindMountID(name string, id string, mountpoint string, isReadOnly bool) (string, error) {
+	if id == "" {
+		return mountpoint, nil
+	}
+	if stat, err := os.Stat(mountpoint); err != nil || !stat.IsDir() {
+		// raw volume
+		return mountpoint, nil
+	}
+	path := plugin_utils.MountIDPath(mountRoot, name, id)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return "", fmt.Errorf("Failed to create the mount point of %s for mount %s: %v", name, id, err)
+	}
+	if err := fs.MountBind(path, mountpoint, isReadOnly); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	log.WithFields(log.Fields{
+		"name": name, "id": id, "read-only": isReadOnly,
+	}).Info("Mounted volume for mount ID ")
+	return path, nil
+}
+
+// unbindMountID - unmounts and removes the bind mount of the mount ID, if
+// there is one. Caller holds StateMtx.
+func (d *VolumeDriver) unbindMountID(name string, id string) error {
+	if id == "" {
+		return nil
+	}
+	path := plugin_utils.MountIDPath(mountRoot, name, id)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if err := fs.Unmount(path); err != nil && plugin_utils.AlreadyMounted(id, filepath.Dir(path)) {
+		return err
+	}
+	os.Remove(path)
+	// the directory of the volume goes with its last mount ID
+	os.Remove(filepath.Dir(path))
+	return nil
+}
+
+// unbindMountIDs - unmounts the bind mounts of all the mount IDs of the
+// volume, those left by lost unmount requests. Caller holds StateMtx.
+func (d *VolumeDriver) unbindMountIDs(name string) {
+	entries, err := ioutil.ReadDir(filepath.Join(mountRoot, plugin_utils.MountIDsDir, name))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if err = d.unbindMountID(name, entry.Name()); err != nil {
+			log.WithFields(log.Fields{
+				"name": name, "id": entry.Name(), "error": err,
+			}).Warning("Failed to unmount volume for mount ID ")
+		}
+	}
+}
+
+// readOnlyFor - whether the container starting with the volume gets it
+// read-only by the ro-for rules. dockerName is the volume name Docker
+// knows. Called without StateMtx, the runtime is asked.
+func (d *VolumeDriver) readOnlyFor(dockerName string, name string) (bool, error) {
+	meta, err := d.GetVolume(name)
+	if err != nil {
+		return false, err
+	}
+	value, _ := meta[volopts.RoFor].(string)
+	rules, err := volopts.ParseReadOnlyRules(value)
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s of volume %s: %v", volopts.RoFor, name, err)
+	}
+	if len(rules) == 0 {
+		return false, nil
+	}
+	containers, err := d.refCounts.StartingContainers(dockerName)
+	if err != nil {
+		return false, fmt.Errorf("Failed to find the container starting with volume %s, "+
+			"its %s rules can't be applied: %v", name, volopts.RoFor, err)
+	}
+	if len(containers) == 0 {
+		return false, fmt.Errorf("No container starting with volume %s found, its %s rules can't be applied",
+			name, volopts.RoFor)
+	}
+	var readOnly, readWrite []string
+	for _, ct := range containers {
+		ctName := ct.ID
+		if len(ct.Names) > 0 {
+			ctName = strings.TrimPrefix(ct.Names[0], "/")
+		}
+		if matchReadOnlyRules(rules, ct.Names, ct.Labels) {
+			readOnly = append(readOnly, ctName)
+		} else {
+			readWrite = append(readWrite, ctName)
+		}
+	}
+	if len(readOnly) > 0 && len(readWrite) > 0 {
+		return false, fmt.Errorf("Can't tell which container is starting with volume %s, it is read-only for %s "+
+			"and read-write for %s, start them one at a time", name,
+			strings.Join(readOnly, ", "), strings.Join(readWrite, ", "))
+	}
+	return len(readOnly) > 0, nil
+}
+
+// whether a rule selects the container with any of the names
+func matchReadOnlyRules(rules []volopts.ReadOnlyRule, names []string, labels map[string]string) bool {
+	for _, rule := range rules {
+		for _, name := range names {
+			if rule.Match(name, labels) {
+				return true
+			}
+		}
+		if len(names) == 0 && rule.Match("", labels) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,449 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Sub-volumes share the disk of a parent volume, so many small volumes
+// don't each take a disk slot of the VM. The parent is created with
+// subvolumes=on, its filesystem has project quotas. A sub-volume is a
+// directory of the parent with its own project, limited to the size of the
+// sub-volume, and is bind mounted at its mount point for containers.
+//
+// The parent is attached and mounted once, in a directory of the mount
+// root Docker doesn't see, while sub-volumes are mounted, created or
+// removed. It is unmounted and detached once none is. Sub-volumes are
+// named like volumes of the parent's datastore and have their own
+// refcounts. ESX records them, with their size, in the metadata of the
+// parent, so all hosts find them there. This host caches the parent of the
+// sub-volumes it has seen, to unmount them without asking ESX.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/volname"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/volopts"
+)
+
+const (
+	// parents are mounted in this directory of the mount root
+	parentsDir = ".parents"
+	// sub-volumes are the directories of this directory of the parent
+	subvolumesDir = "subvolumes"
+)
+
+// project ID accessors of the sub-volume directories, tests replace them as
+// only filesystems with project quotas keep project IDs
+var (
+	projectID    = fs.ProjectID
+	setProjectID = fs.SetProjectID
+)
+
+// subvolumeCache - the full name of the parent of the sub-volumes seen by
+// this host, by full name
+type subvolumeCache struct {
+	mtx     sync.Mutex
+	parents map[string]string
+}
+
+func newSubvolumeCache() *subvolumeCache {
+	return &subvolumeCache{parents: make(map[string]string)}
+}
+
+// get - the parent of the sub-volume with the full name
+func (c *subvolumeCache) get(name string) (string, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	parent, found := c.parents[name]
+	return parent, found
+}
+
+func (c *subvolumeCache) add(name string, parent string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.parents[name] = parent
+}
+
+func (c *subvolumeCache) remove(name string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.parents, name)
+}
+
+// note - caches or forgets the parent of the volume name, from its metadata
+func (c *subvolumeCache) note(name string, meta map[string]interface{}) {
+	short, _ := volname.Split(name)
+	datastore, _ := meta["datastore"].(string)
+	name = volname.Join(short, datastore)
+	if parent, child := meta[volopts.Parent].(string); child {
+		c.add(name, parent)
+	} else {
+		c.remove(name)
+	}
+}
+
+// parentState - a parent mounted for its sub-volumes, guarded by StateMtx
+type parentState struct {
+	busy   int    // creates, mounts and removes of sub-volumes in progress
+	dir    string // mount point of the parent
+	device string
+}
+
+// the directory of a sub-volume in its mounted parent
+func subvolumeDir(p *parentState, name string) string {
+	short, _ := volname.Split(name)
+	return filepath.Join(p.dir, subvolumesDir, short)
+}
+
+// recoverParents - picks up the parents left mounted by a previous run of
+// the plugin, and the sub-volumes mounted from them, before refcounting
+// starts. Parents without mounted sub-volumes are unmounted and detached.
+func (d *VolumeDriver) recoverParents() {
+	dir := filepath.Join(mountRoot, parentsDir)
+	mounts, err := plugin_utils.GetMountInfo(dir)
+	if err != nil {
+		return
+	}
+	for name, device := range mounts {
+		log.WithFields(log.Fields{"name": name, "device": device}).Info("Found mounted parent volume ")
+		d.parents[name] = &parentState{dir: filepath.Join(dir, name), device: device}
+	}
+	if volumes, err := plugin_utils.GetMountInfo(mountRoot); err == nil {
+		for name, parent := range d.parents {
+			for _, child := range mountedChildren(name, parent, volumes) {
+				log.WithFields(log.Fields{"name": child, "parent": name}).Info("Found mounted sub-volume ")
+				d.subvols.add(child, name)
+			}
+		}
+	}
+	for name := range mounts {
+		d.tidyParent(name)
+	}
+}
+
+// holdParent - mounts the parent for its sub-volumes if it isn't, and
+// keeps it mounted until releaseParent. Caller holds StateMtx.
+func (d *VolumeDriver) holdParent(name string) (*parentState, error) {
+	if p, mounted := d.parents[name]; mounted {
+		p.busy++
+		return p, nil
+	}
+	if exp, exporting := d.exports[name]; exporting && exp.private {
+		return nil, fmt.Errorf("Volume %s is being exported, try again once the export is done", name)
+	}
+	meta, err := d.ops.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if subvolumes, _ := meta[volopts.Subvolumes].(string); subvolumes != volopts.SubvolumesOn {
+		return nil, fmt.Errorf("Volume %s can't have sub-volumes, it wasn't created with %s=%s",
+			name, volopts.Subvolumes, volopts.SubvolumesOn)
+	}
+	if access, _ := meta[volopts.Access].(string); access == volopts.AccessReadOnly {
+		return nil, fmt.Errorf("Volume %s is read-only, it can't have sub-volumes", name)
+	}
+	fstype, _ := meta[volopts.Fstype].(string)
+
+	dir := filepath.Join(mountRoot, parentsDir, name)
+	if err = fs.Mkdir(dir); err != nil {
+		return nil, err
+	}
+	device, err := d.attachDevice(name, fstype, meta)
+	if err == nil {
+		err = fs.MountWithOptions(dir, fstype, device, false, fs.ProjectQuotaOption)
+		if err == nil {
+			if err = fs.Mkdir(filepath.Join(dir, subvolumesDir)); err != nil {
+				fs.Unmount(dir)
+			}
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Error("Failed to mount parent volume ")
+		if !plugin_utils.AlreadyMounted(name, mountRoot) {
+			d.detachVolume(name, device, false)
+		}
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{"name": name, "dir": dir}).Info("Parent volume mounted for its sub-volumes ")
+	p := &parentState{busy: 1, dir: dir, device: device}
+	d.parents[name] = p
+	return p, nil
+}
+
+// releaseParent - ends a hold of the parent. Caller holds StateMtx.
+func (d *VolumeDriver) releaseParent(name string) {
+	if p, mounted := d.parents[name]; mounted {
+		p.busy--
+	}
+	d.tidyParent(name)
+}
+
+// unmounts the parent once nothing holds it and none of its sub-volumes is
+// mounted. The disk is detached unless the parent is mounted for containers
+// or exported. Caller holds StateMtx.
+func (d *VolumeDriver) tidyParent(name string) {
+	p, mounted := d.parents[name]
+	if !mounted || p.busy > 0 {
+		return
+	}
+	if _, exporting := d.exports[name]; exporting {
+		return
+	}
+	mounts, err := plugin_utils.GetMountInfo(mountRoot)
+	if err != nil || len(mountedChildren(name, p, mounts)) > 0 {
+		return
+	}
+
+	if err = fs.Unmount(p.dir); err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to unmount parent volume ")
+		return
+	}
+	os.Remove(p.dir)
+	delete(d.parents, name)
+	log.WithFields(log.Fields{"name": name}).Info("No sub-volume is used, parent volume unmounted ")
+	if _, used := mounts[name]; used {
+		return
+	}
+	if err = d.detachVolume(name, p.device, false); err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to detach parent volume ")
+	}
+}
+
+// the full names of the volumes mounted at the mount root from the device
+// of the parent, its sub-volumes
+func mountedChildren(name string, p *parentState, mounts map[string]string) []string {
+	var children []string
+	for volume, device := range mounts {
+		if volume != name && device == p.device {
+			children = append(children, volume)
+		}
+	}
+	return children
+}
+
+// createSubvolume - creates the sub-volume name in the parent volume of the
+// options. ESX records it with the parent first, then its directory gets a
+// new project, limited to the size option if set, and is filled by fill if
+// not nil. A directory left by a sub-volume whose record is gone is taken
+// over.
+func (d *VolumeDriver) createSubvolume(name string, opts map[string]string, fill func(dir string) error,
+	uid int, gid int, mode int) error {
+	parent := d.BackendName(opts[volopts.Parent])
+	meta, err := d.GetVolume(parent)
+	if err != nil {
+		return fmt.Errorf("Failed to get parent volume %s: %v", parent, err)
+	}
+	if _, child := meta[volopts.Parent]; child {
+		return fmt.Errorf("Volume %s is a sub-volume, it can't be a parent", parent)
+	}
+	datastore, _ := meta["datastore"].(string)
+	parentName, _ := volname.Split(parent)
+	parent = volname.Join(parentName, datastore)
+	short, nameDatastore := volname.Split(name)
+	if nameDatastore != "" && nameDatastore != datastore {
+		return fmt.Errorf("Sub-volume %s must be on the datastore of its parent, %s", name, datastore)
+	}
+	name = volname.Join(short, datastore)
+	var limit uint64
+	subvolOpts := map[string]string{}
+	if size := opts[volopts.Size]; size != "" {
+		sizeKB, err := volopts.ParseSize(size)
+		if err != nil {
+			return err
+		}
+		limit = sizeKB * 1024
+		subvolOpts[volopts.Size] = size
+	}
+	// ESX refuses names of volumes and sub-volumes which exist
+	if err = d.ops.AddSubvolume(parent, short, subvolOpts); err != nil {
+		return err
+	}
+
+	// the project of the directory is picked under StateMtx, creates may
+	// run in parallel
+	d.refCounts.StateMtx.Lock()
+	p, err := d.holdParent(parent)
+	var dir string
+	var project uint32
+	adopted := false
+	if err == nil {
+		dir = subvolumeDir(p, name)
+		dir, project, adopted, err = makeSubvolumeDir(dir)
+		if err != nil {
+			d.releaseParent(parent)
+		}
+	}
+	d.refCounts.StateMtx.Unlock()
+	if err != nil {
+		d.forgetSubvolume(name, parent)
+		return err
+	}
+	defer func() {
+		d.refCounts.StateMtx.Lock()
+		d.releaseParent(parent)
+		d.refCounts.StateMtx.Unlock()
+	}()
+
+	if adopted {
+		log.WithFields(log.Fields{"name": name, "parent": parent}).Info("Sub-volume directory exists, taking it over ")
+		if fill != nil {
+			err = fmt.Errorf("Sub-volume %s already has data in %s, it can't be filled", name, parent)
+		}
+	}
+	if err == nil {
+		err = fs.SetProjectQuota(p.device, project, limit)
+	}
+	if err == nil && fill != nil {
+		err = fill(dir)
+	}
+	if err == nil {
+		err = fs.SetRoot(dir, uid, gid, mode)
+	}
+	if err != nil {
+		if !adopted {
+			os.RemoveAll(dir)
+			fs.SetProjectQuota(p.device, project, 0)
+		}
+		d.forgetSubvolume(name, parent)
+		return err
+	}
+	d.subvols.add(name, parent)
+	log.WithFields(log.Fields{"name": name, "parent": parent, "project": project,
+		"size": opts[volopts.Size]}).Info("Sub-volume created ")
+	return nil
+}
+
+// makes the directory of a new sub-volume with a project unused in the
+// parent, or returns the one of an existing directory. Returns whether the
+// directory existed.
+func makeSubvolumeDir(dir string) (string, uint32, bool, error) {
+	if stat, err := os.Stat(dir); err == nil {
+		if !stat.IsDir() {
+			return "", 0, false, fmt.Errorf("%s already exists and isn't a directory", dir)
+		}
+		project, err := projectID(dir)
+		if err == nil && project == 0 {
+			err = fmt.Errorf("%s has no project, it isn't a sub-volume", dir)
+		}
+		return dir, project, true, err
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Dir(dir))
+	if err != nil {
+		return "", 0, false, err
+	}
+	project := uint32(1)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		id, err := projectID(filepath.Join(filepath.Dir(dir), entry.Name()))
+		if err == nil && id >= project {
+			project = id + 1
+		}
+	}
+	if err = os.Mkdir(dir, 0755); err != nil {
+		return "", 0, false, err
+	}
+	if err = setProjectID(dir, project); err != nil {
+		os.Remove(dir)
+		return "", 0, false, err
+	}
+	return dir, project, false, nil
+}
+
+// drops the record of a sub-volume from its parent on ESX
+func (d *VolumeDriver) forgetSubvolume(name string, parent string) error {
+	short, _ := volname.Split(name)
+	err := d.ops.RemoveSubvolume(parent, short)
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "parent": parent, "error": err}).Error("Failed to remove the sub-volume record ")
+	}
+	return err
+}
+
+// bind mounts the directory of a sub-volume at its mount point, the parent
+// is mounted if needed. Caller holds StateMtx.
+func (d *VolumeDriver) mountSubvolume(name string, parent string, isReadOnly bool) (string, error) {
+	mountpoint := getMountPoint(name)
+	p, err := d.holdParent(parent)
+	if err != nil {
+		return mountpoint, err
+	}
+	defer d.releaseParent(parent)
+
+	dir := subvolumeDir(p, name)
+	if stat, err := os.Stat(dir); err != nil || !stat.IsDir() {
+		return mountpoint, fmt.Errorf("Sub-volume %s is missing from its parent %s", name, parent)
+	}
+	if err = fs.Mkdir(mountpoint); err != nil {
+		return mountpoint, err
+	}
+	return mountpoint, fs.MountBind(mountpoint, dir, isReadOnly)
+}
+
+// unmounts a sub-volume, and its parent if no other sub-volume is mounted.
+// Caller holds StateMtx.
+func (d *VolumeDriver) unmountSubvolume(name string, parent string) error {
+	if err := fs.Unmount(getMountPoint(name)); err != nil {
+		return err
+	}
+	d.tidyParent(parent)
+	return nil
+}
+
+// removes the directory and the quota of a sub-volume, then its record
+func (d *VolumeDriver) removeSubvolume(name string, parent string) volume.Response {
+	if d.getRefCount(name) != 0 {
+		msg := fmt.Sprintf("Remove failure - volume is still mounted. "+
+			" volume=%s, refcount=%d", name, d.getRefCount(name))
+		log.Error(msg)
+		return volume.Response{Err: msg}
+	}
+
+	d.refCounts.StateMtx.Lock()
+	p, err := d.holdParent(parent)
+	d.refCounts.StateMtx.Unlock()
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Error("Failed to remove volume ")
+		return volume.Response{Err: err.Error()}
+	}
+	dir := subvolumeDir(p, name)
+	project, errProject := projectID(dir)
+	err = os.RemoveAll(dir)
+	if err == nil && errProject == nil && project != 0 {
+		err = fs.SetProjectQuota(p.device, project, 0)
+	}
+	d.refCounts.StateMtx.Lock()
+	d.releaseParent(parent)
+	d.refCounts.StateMtx.Unlock()
+	if err == nil {
+		err = d.forgetSubvolume(name, parent)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Error("Failed to remove volume ")
+		return volume.Response{Err: err.Error()}
+	}
+	d.subvols.remove(name)
+	log.WithFields(log.Fields{"name": name, "parent": parent}).Info("Sub-volume removed ")
+	return volume.Response{Err: ""}
+}
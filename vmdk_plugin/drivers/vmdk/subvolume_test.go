@@ -0,0 +1,141 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+)
+
+// fakeProjects keeps the project IDs of directories in memory, the test
+// filesystem may have no project quotas
+type fakeProjects struct {
+	ids     map[string]uint32
+	failSet bool
+}
+
+func useFakeProjects() (*fakeProjects, func()) {
+	fake := &fakeProjects{ids: make(map[string]uint32)}
+	projectID = func(dir string) (uint32, error) {
+		if _, err := os.Stat(dir); err != nil {
+			return 0, err
+		}
+		return fake.ids[dir], nil
+	}
+	setProjectID = func(dir string, id uint32) error {
+		if fake.failSet {
+			return fmt.Errorf("Failed to set the project of %s", dir)
+		}
+		fake.ids[dir] = id
+		return nil
+	}
+	return fake, func() {
+		projectID = fs.ProjectID
+		setProjectID = fs.SetProjectID
+	}
+}
+
+func TestMakeSubvolumeDir(t *testing.T) {
+	tests := []struct {
+		name     string
+		siblings map[string]uint32 // existing directories and their project
+		files    []string          // existing plain files
+		failSet  bool
+		project  uint32
+		existed  bool
+		err      bool
+	}{
+		{name: "first sub-volume", project: 1},
+		{name: "next free ID",
+			siblings: map[string]uint32{"a": 3, "b": 7, "plain": 0},
+			files:    []string{"file"},
+			project:  8},
+		{name: "adopt existing directory",
+			siblings: map[string]uint32{"a": 3, "new": 5},
+			project:  5, existed: true},
+		{name: "existing directory without project",
+			siblings: map[string]uint32{"new": 0},
+			existed:  true, err: true},
+		{name: "existing file", files: []string{"new"}, err: true},
+		{name: "setting project fails", siblings: map[string]uint32{"a": 3}, failSet: true, err: true},
+	}
+
+	for _, test := range tests {
+		fake, restore := useFakeProjects()
+		fake.failSet = test.failSet
+		parent, err := ioutil.TempDir("", "subvolume_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for dir, id := range test.siblings {
+			assert.Nil(t, os.Mkdir(filepath.Join(parent, dir), 0755))
+			fake.ids[filepath.Join(parent, dir)] = id
+		}
+		for _, file := range test.files {
+			assert.Nil(t, ioutil.WriteFile(filepath.Join(parent, file), nil, 0644))
+		}
+
+		dir := filepath.Join(parent, "new")
+		_, project, existed, err := makeSubvolumeDir(dir)
+		if test.err {
+			assert.NotNil(t, err, test.name)
+			if !test.existed {
+				// a directory which failed to get its project is removed
+				stat, statErr := os.Stat(dir)
+				assert.False(t, statErr == nil && stat.IsDir(), test.name)
+			}
+		} else {
+			assert.Nil(t, err, test.name)
+			assert.Equal(t, test.project, project, test.name)
+			assert.Equal(t, test.existed, existed, test.name)
+			assert.Equal(t, test.project, fake.ids[dir], test.name)
+		}
+
+		os.RemoveAll(parent)
+		restore()
+	}
+}
+
+func TestMountedChildren(t *testing.T) {
+	mounts := map[string]string{
+		"parent@ds1": "/dev/sdb",
+		"child1@ds1": "/dev/sdb",
+		"child2@ds1": "/dev/sdb",
+		"other@ds1":  "/dev/sdc",
+		"single@ds1": "/dev/sdd",
+	}
+	tests := []struct {
+		name     string
+		device   string
+		children []string
+	}{
+		{"parent@ds1", "/dev/sdb", []string{"child1@ds1", "child2@ds1"}},
+		{"single@ds1", "/dev/sdd", nil},
+		{"unmounted@ds1", "/dev/sde", nil},
+	}
+
+	for _, test := range tests {
+		children := mountedChildren(test.name, &parentState{device: test.device}, mounts)
+		sort.Strings(children)
+		assert.Equal(t, test.children, children, test.name)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Scheduled trim of mounted volumes. Thin VMDKs only grow unless the guest
+// discards the blocks of deleted files, so every TrimIntervalMin each
+// mounted volume has its free space trimmed, one volume at a time. Each
+// second at most TrimRateMbPerSec of the filesystem is trimmed, holding
+// StateMtx for that range only, so mounts and unmounts wait for a range at
+// most. Read-only and raw volumes, and volumes created with trim=off, are
+// skipped. Sub-volumes are too, a parent is trimmed when it is mounted for
+// containers.
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/metrics"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/volopts"
+)
+
+const (
+	// how often the scheduler looks for volumes due for a trim
+	trimCheckInterval = time.Minute
+	// each range of the rate limit takes this long at least
+	trimRangePeriod = time.Second
+)
+
+// the volume was unmounted during the trim
+var errTrimInterrupted = errors.New("volume unmounted during the trim")
+
+// returns the trim interval, 0 if trims are disabled, and the bytes
+// trimmed per range
+func (d *VolumeDriver) trimPolicy() (time.Duration, uint64) {
+	d.configMtx.RLock()
+	defer d.configMtx.RUnlock()
+	return time.Duration(d.config.TrimIntervalMin) * time.Minute,
+		uint64(d.config.TrimRateMbPerSec) * 1024 * 1024
+}
+
+// trimLoop - trims mounted volumes once they were mounted for the trim
+// interval since their last trim. Runs for the life of the plugin, the
+// interval can be changed by a config reload.
+func (d *VolumeDriver) trimLoop() {
+	lastTrim := make(map[string]time.Time) // volume -> last trim, or first seen mounted
+	for {
+		time.Sleep(trimCheckInterval)
+		interval, rangeSize := d.trimPolicy()
+		if interval == 0 {
+			lastTrim = make(map[string]time.Time)
+			continue
+		}
+		mounts, err := plugin_utils.GetMountInfo(mountRoot)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Warning("Failed to list mounted volumes to trim ")
+			continue
+		}
+
+		now := time.Now()
+		for name := range lastTrim {
+			if _, mounted := mounts[name]; !mounted {
+				delete(lastTrim, name)
+			}
+		}
+		for name := range mounts {
+			last, seen := lastTrim[name]
+			if !seen {
+				lastTrim[name] = now
+				continue
+			}
+			if now.Sub(last) < interval {
+				continue
+			}
+			d.trimVolume(name, rangeSize)
+			lastTrim[name] = time.Now()
+		}
+	}
+}
+
+// trims a mounted volume unless it is skipped, and reports the outcome
+func (d *VolumeDriver) trimVolume(name string, rangeSize uint64) {
+	if _, child := d.subvols.get(name); child {
+		// the filesystem is the one of the parent
+		return
+	}
+	mountpoint := getMountPoint(name)
+	if stat, err := os.Stat(mountpoint); err != nil || !stat.IsDir() {
+		// raw volume, nothing to trim
+		return
+	}
+	meta, err := d.ops.Get(name)
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to get volume metadata, not trimming ")
+		return
+	}
+	if reason := trimSkipReason(meta); reason != "" {
+		log.WithFields(log.Fields{"name": name, "reason": reason}).Debug("Not trimming volume ")
+		return
+	}
+
+	log.WithFields(log.Fields{"name": name}).Info("Trimming volume ")
+	start := time.Now()
+	trimmed, err := d.trimRanges(name, mountpoint, rangeSize)
+	outcome := metrics.Outcome(err)
+	switch err {
+	case nil:
+		log.WithFields(log.Fields{
+			"name": name, "trimmed": trimmed, "duration": time.Since(start),
+		}).Info("Volume trimmed ")
+	case fs.ErrTrimNotSupported:
+		outcome = "unsupported"
+		log.WithFields(log.Fields{"name": name}).Info("Trim isn't supported by the volume, the disk may not be thin ")
+	case errTrimInterrupted:
+		outcome = "interrupted"
+		log.WithFields(log.Fields{"name": name, "trimmed": trimmed}).Info("Volume unmounted, trim stopped ")
+	default:
+		log.WithFields(log.Fields{"name": name, "trimmed": trimmed, "error": err}).Warning("Failed to trim volume ")
+	}
+	metrics.TrimRuns.Inc(outcome)
+	metrics.TrimmedBytes.Add(float64(trimmed), name)
+	metrics.TrimDuration.ObserveSince(start, outcome)
+}
+
+// trims the filesystem range by range, each range under StateMtx while the
+// volume is still mounted. Returns the bytes trimmed.
+func (d *VolumeDriver) trimRanges(name string, mountpoint string, rangeSize uint64) (uint64, error) {
+	size, err := fs.FilesystemSize(mountpoint)
+	if err != nil {
+		return 0, err
+	}
+	var trimmed uint64
+	for _, r := range trimRangesOf(size, rangeSize) {
+		rangeStart := time.Now()
+		d.refCounts.StateMtx.Lock()
+		if !plugin_utils.AlreadyMounted(name, mountRoot) {
+			d.refCounts.StateMtx.Unlock()
+			return trimmed, errTrimInterrupted
+		}
+		n, err := fs.TrimRange(mountpoint, r.start, r.length)
+		d.refCounts.StateMtx.Unlock()
+		if err != nil {
+			return trimmed, err
+		}
+		trimmed += n
+		time.Sleep(trimDelay(time.Since(rangeStart)))
+	}
+	return trimmed, nil
+}
+
+// trimRange - a range of the filesystem trimmed at once
+type trimRange struct {
+	start  uint64
+	length uint64
+}
+
+// trimRangesOf - splits a filesystem of size bytes in ranges of rangeSize
+// bytes, the last one ends at the end of the filesystem. A rangeSize of 0
+// trims the filesystem at once.
+func trimRangesOf(size uint64, rangeSize uint64) []trimRange {
+	if rangeSize == 0 {
+		rangeSize = size
+	}
+	var ranges []trimRange
+	for start := uint64(0); start < size; start += rangeSize {
+		length := rangeSize
+		if size-start < length {
+			length = size - start
+		}
+		ranges = append(ranges, trimRange{start: start, length: length})
+	}
+	return ranges
+}
+
+// trimDelay - how long to wait after a range which took elapsed, so each
+// range takes trimRangePeriod at least
+func trimDelay(elapsed time.Duration) time.Duration {
+	if elapsed >= trimRangePeriod {
+		return 0
+	}
+	return trimRangePeriod - elapsed
+}
+
+// trimSkipReason - why the volume with the metadata isn't trimmed, empty
+// if it is
+func trimSkipReason(meta map[string]interface{}) string {
+	if trim, _ := meta[volopts.Trim].(string); trim == volopts.TrimOff {
+		return "opted out of trim"
+	}
+	if access, _ := meta[volopts.Access].(string); access == volopts.AccessReadOnly {
+		return "read-only"
+	}
+	return ""
+}
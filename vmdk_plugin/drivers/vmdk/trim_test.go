@@ -0,0 +1,73 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/volopts"
+)
+
+func TestTrimRangesOf(t *testing.T) {
+	tests := []struct {
+		size      uint64
+		rangeSize uint64
+		ranges    []trimRange
+	}{
+		{0, 10, nil},
+		{10, 10, []trimRange{{0, 10}}},
+		{30, 10, []trimRange{{0, 10}, {10, 10}, {20, 10}}},
+		{25, 10, []trimRange{{0, 10}, {10, 10}, {20, 5}}},
+		{5, 10, []trimRange{{0, 5}}},
+		{25, 0, []trimRange{{0, 25}}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.ranges, trimRangesOf(test.size, test.rangeSize),
+			"size %d, range size %d", test.size, test.rangeSize)
+	}
+}
+
+func TestTrimDelay(t *testing.T) {
+	tests := []struct {
+		elapsed time.Duration
+		delay   time.Duration
+	}{
+		{0, trimRangePeriod},
+		{trimRangePeriod / 4, trimRangePeriod * 3 / 4},
+		{trimRangePeriod, 0},
+		{2 * trimRangePeriod, 0},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.delay, trimDelay(test.elapsed), "elapsed %v", test.elapsed)
+	}
+}
+
+func TestTrimSkipReason(t *testing.T) {
+	tests := []struct {
+		meta map[string]interface{}
+		skip bool
+	}{
+		{map[string]interface{}{}, false},
+		{map[string]interface{}{volopts.Trim: volopts.TrimOn}, false},
+		{map[string]interface{}{volopts.Trim: volopts.TrimOff}, true},
+		{map[string]interface{}{volopts.Access: volopts.AccessReadWrite}, false},
+		{map[string]interface{}{volopts.Access: volopts.AccessReadOnly}, true},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.skip, trimSkipReason(test.meta) != "", "metadata %v", test.meta)
+	}
+}
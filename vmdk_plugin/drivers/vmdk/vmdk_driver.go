@@ -26,23 +26,37 @@ package vmdk
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers/vmdk/vmdkops"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/config"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/metrics"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/refcount"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/userns"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/volname"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/volopts"
 )
 
 const (
-	devWaitTimeout   = 1 * time.Second
-	sleepBeforeMount = 1 * time.Second
-	watchPath        = "/dev/disk/by-path"
-	version          = "vSphere Volume Driver v0.4"
+	devWaitTimeout = 1 * time.Second
+	version        = "vSphere Volume Driver v0.4"
+
+	// volume metadata of an attached disk, from the ESX service
+	attachedDeviceKey = "attachedVMDevice"
+	diskUUIDKey       = "DiskUUID"
+	// clone-from of a volume which isn't a clone
+	defaultCloneFrom = "None"
+	// clone sources followed to find the filesystem label of a clone
+	maxCloneDepth = 8
 )
 
 // VolumeDriver - VMDK driver struct
@@ -50,23 +64,36 @@ type VolumeDriver struct {
 	useMockEsx    bool
 	ops           vmdkops.VmdkOps
 	refCounts     *refcount.RefCountsMap
-	mountIDtoName map[string]string // map of mountID -> full volume name
+	mountIDtoName map[string]string       // map of mountID -> full volume name
+	exports       map[string]*exportState // full volume name -> exports in progress
+	parents       map[string]*parentState // full volume name -> parent mounted for sub-volumes
+	subvols       *subvolumeCache
+
+	// reloadable config, for default volume options and profiles
+	configMtx sync.RWMutex
+	config    config.Config
 }
 
 var mountRoot string
 
 // NewVolumeDriver creates Driver which to real ESX (useMockEsx=False) or a mock
-func NewVolumeDriver(port int, useMockEsx bool, mountDir string, driverName string) *VolumeDriver {
+func NewVolumeDriver(port int, useMockEsx bool, mountDir string, driverName string, c config.Config) *VolumeDriver {
 	var d *VolumeDriver
 
 	vmdkops.EsxPort = port
 	mountRoot = mountDir
 
+	runtime, err := refcount.NewRuntime(c.Runtime, c.RuntimeEndpoint)
+	if err != nil {
+		log.WithFields(log.Fields{"runtime": c.Runtime, "error": err}).Warning("Invalid container runtime, exiting.")
+		return nil
+	}
+
 	if useMockEsx {
 		d = &VolumeDriver{
 			useMockEsx: true,
 			ops:        vmdkops.VmdkOps{Cmd: vmdkops.MockVmdkCmd{}},
-			refCounts:  refcount.NewRefCountsMap(),
+			refCounts:  refcount.NewRefCountsMap(runtime),
 		}
 	} else {
 		d = &VolumeDriver{
@@ -76,22 +103,84 @@ func NewVolumeDriver(port int, useMockEsx bool, mountDir string, driverName stri
 					Mtx: &sync.Mutex{},
 				},
 			},
-			refCounts: refcount.NewRefCountsMap(),
+			refCounts: refcount.NewRefCountsMap(runtime),
 		}
 	}
 
 	d.mountIDtoName = make(map[string]string)
+	d.exports = make(map[string]*exportState)
+	d.parents = make(map[string]*parentState)
+	d.subvols = newSubvolumeCache()
+	d.Reconfigure(c)
+	d.recoverParents()
+	d.refCounts.RegisterMetrics()
+	plugin_utils.RegisterUsageMetrics(mountDir)
 	d.refCounts.Init(d, mountDir, driverName)
+	go d.trimLoop()
 
 	log.WithFields(log.Fields{
 		"version":  version,
 		"port":     vmdkops.EsxPort,
 		"mock_esx": useMockEsx,
+		"runtime":  runtime.Name(),
 	}).Info("Docker VMDK plugin started ")
 
 	return d
 }
 
+// Reconfigure - apply the retry and timeout policy and the volume options of
+// the config, on start and when the config is reloaded
+func (d *VolumeDriver) Reconfigure(c config.Config) {
+	d.configMtx.Lock()
+	d.config = c
+	d.configMtx.Unlock()
+
+	vmdkops.SetMaxRetryCount(c.EsxMaxRetries)
+	fs.SetDevWaitTimeout(time.Duration(c.DeviceWaitTimeoutSec) * time.Second)
+	fs.SetPolling(c.DeviceDiscovery == config.DeviceDiscoveryPoll)
+	d.refCounts.SetPolicy(refcount.NewPolicy(c))
+}
+
+// BackendName - returns the name of the volume on ESX for a Docker volume
+// name, an alias if aliases are enabled and the name isn't valid on ESX
+func (d *VolumeDriver) BackendName(name string) string {
+	d.configMtx.RLock()
+	aliases := d.config.VolumeAliases
+	d.configMtx.RUnlock()
+	if !aliases {
+		return name
+	}
+	backend := volname.Alias(name)
+	if backend != name {
+		log.WithFields(log.Fields{"name": name, "alias": backend}).Debug("Using volume alias ")
+	}
+	return backend
+}
+
+// returns the Docker name of a volume listed by ESX. ESX lists it with the
+// volume for an alias, it is taken from the volume metadata if an older
+// ESX service doesn't.
+func (d *VolumeDriver) dockerName(vol vmdkops.VolumeData) string {
+	name := vol.Name
+	if !volname.IsAlias(name) {
+		return name
+	}
+	dockerName, listed := vol.Attributes[volname.DockerNameKey]
+	if !listed {
+		status, err := d.ops.Get(name)
+		if err != nil {
+			log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to get the Docker name of the volume ")
+			return name
+		}
+		dockerName, _ = status[volname.DockerNameKey].(string)
+	}
+	if dockerName == "" {
+		return name
+	}
+	_, datastore := volname.Split(name)
+	return volname.Join(dockerName, datastore)
+}
+
 // VolumesInRefMap - get list of volumes names from refmap
 // names are in format volume@datastore
 func (d *VolumeDriver) VolumesInRefMap() []string {
@@ -130,13 +219,15 @@ func getMountPoint(volName string) string {
 	return filepath.Join(mountRoot, volName)
 }
 
-// Get info about a single volume
+// Get info about a single volume, with its usage if it is mounted here
 func (d *VolumeDriver) Get(r volume.Request) volume.Response {
-	status, err := d.GetVolume(r.Name)
+	name := d.BackendName(r.Name)
+	status, err := d.GetVolume(name)
 	if err != nil {
 		return volume.Response{Err: err.Error()}
 	}
-	mountpoint := getMountPoint(r.Name)
+	plugin_utils.AddVolumeUsage(status, name, mountRoot)
+	mountpoint := getMountPoint(name)
 	return volume.Response{Volume: &volume.Volume{Name: r.Name,
 		Mountpoint: mountpoint,
 		Status:     status}}
@@ -151,74 +242,160 @@ func (d *VolumeDriver) List(r volume.Request) volume.Response {
 	responseVolumes := make([]*volume.Volume, 0, len(volumes))
 	for _, vol := range volumes {
 		mountpoint := getMountPoint(vol.Name)
-		responseVol := volume.Volume{Name: vol.Name, Mountpoint: mountpoint}
+		responseVol := volume.Volume{Name: d.dockerName(vol), Mountpoint: mountpoint}
 		responseVolumes = append(responseVolumes, &responseVol)
+		if parent, child := vol.Attributes[volopts.Parent]; child {
+			d.subvols.add(vol.Name, parent)
+		}
 	}
 	return volume.Response{Volumes: responseVolumes}
 }
 
-// GetVolume - return volume meta-data.
+// GetVolume - return volume meta-data. ESX gives the parent of a
+// sub-volume, which is cached.
 func (d *VolumeDriver) GetVolume(name string) (map[string]interface{}, error) {
-	return d.ops.Get(name)
+	meta, err := d.ops.Get(name)
+	if err == nil {
+		d.subvols.note(name, meta)
+	}
+	return meta, err
 }
 
 // MountVolume - Request attach and them mounts the volume.
 // Actual mount - send attach to ESX and do the in-guest magic
 // Returns mount point and  error (or nil)
 func (d *VolumeDriver) MountVolume(name string, fstype string, id string, isReadOnly bool, skipAttach bool) (string, error) {
-	mountpoint := getMountPoint(name)
-
-	// First, make sure  that mountpoint exists.
-	err := fs.Mkdir(mountpoint)
+	meta, err := d.GetVolume(name)
 	if err != nil {
-		log.WithFields(
-			log.Fields{"name": name, "dir": mountpoint},
-		).Error("Failed to make directory for volume mount ")
-		return mountpoint, err
+		return getMountPoint(name), err
 	}
+	return d.mountVolume(name, fstype, isReadOnly, meta)
+}
 
-	watcher, skipInotify := fs.DevAttachWaitPrep(name, watchPath)
-
-	// Have ESX attach the disk
-	dev, err := d.ops.Attach(name, nil)
-	if err != nil {
-		return mountpoint, err
+// mounts the volume described by its metadata, a sub-volume is bind
+// mounted from its parent
+func (d *VolumeDriver) mountVolume(name string, fstype string, isReadOnly bool, meta map[string]interface{}) (string, error) {
+	if parent, child := meta[volopts.Parent].(string); child {
+		return d.mountSubvolume(name, parent, isReadOnly)
 	}
+	mountpoint := getMountPoint(name)
 
-	if d.useMockEsx {
-		return mountpoint, fs.Mount(mountpoint, fstype, string(dev[:]), false)
+	// First, make sure  that mountpoint exists. The device of a raw
+	// volume is bind mounted on a file, made when it is mounted.
+	if fstype != volopts.FstypeRaw {
+		err := fs.Mkdir(mountpoint)
+		if err != nil {
+			log.WithFields(
+				log.Fields{"name": name, "dir": mountpoint},
+			).Error("Failed to make directory for volume mount ")
+			return mountpoint, err
+		}
 	}
 
-	device, err := fs.GetDevicePath(dev)
+	device, err := d.attachDevice(name, fstype, meta)
 	if err != nil {
 		return mountpoint, err
 	}
-
-	if skipInotify {
-		time.Sleep(sleepBeforeMount)
-		return mountpoint, fs.Mount(mountpoint, fstype, device, false)
+	// a parent always has its quotas enforced, it may be mounted for its
+	// sub-volumes too
+	options := ""
+	if subvolumes, _ := meta[volopts.Subvolumes].(string); subvolumes == volopts.SubvolumesOn {
+		options = fs.ProjectQuotaOption
 	}
+	// the mock mounts read-write, its devices are files
+	return mountpoint, mountDevice(mountpoint, fstype, device, isReadOnly && !d.useMockEsx, options)
+}
 
-	fs.DevAttachWait(watcher, name, device)
-
-	// May have timed out waiting for the attach to complete,
-	// attempt the mount anyway.
-	return mountpoint, fs.Mount(mountpoint, fstype, device, isReadOnly)
+// mounts the filesystem on device at mountpoint, or bind mounts the device
+// of a raw volume
+func mountDevice(mountpoint string, fstype string, device string, isReadOnly bool, options string) error {
+	if fstype == volopts.FstypeRaw {
+		return fs.MountRaw(mountpoint, device, isReadOnly)
+	}
+	return fs.MountWithOptions(mountpoint, fstype, device, isReadOnly, options)
 }
 
 // UnmountVolume - Unmounts the volume and then requests detach
 func (d *VolumeDriver) UnmountVolume(name string) error {
+	if exp, exporting := d.exports[name]; exporting && !exp.private {
+		log.WithFields(log.Fields{"name": name}).Info("Volume is being exported, unmounting once the export is done ")
+		exp.unmountPending = true
+		return nil
+	}
+	d.unbindMountIDs(name)
+	if parent, child := d.subvols.get(name); child {
+		return d.unmountSubvolume(name, parent)
+	}
 	mountpoint := getMountPoint(name)
+	device := ""
+	if mounts, err := plugin_utils.GetMountInfo(mountRoot); err == nil {
+		device = mounts[filepath.Base(mountpoint)]
+	}
 	err := fs.Unmount(mountpoint)
+	if _, held := d.parents[name]; held {
+		// the disk stays attached for the sub-volumes
+		return err
+	}
 	if err != nil {
 		log.WithFields(
 			log.Fields{"mountpoint": mountpoint, "error": err},
 		).Error("Failed to unmount volume. Now trying to detach... ")
-		// Do not return error. Continue with detach.
+		// Do not return error. Continue with detach, the device of a
+		// volume which may still be mounted is kept.
+		return d.detachVolume(name, "", true)
+	}
+	return d.detachVolume(name, device, false)
+}
+
+// detachVolume - removes the device of the disk from the guest, then has
+// ESX detach the disk. The device is looked up by the disk UUID in the
+// volume metadata if not given. Detach goes on if the device can't be
+// removed, it is kept if keepDevice is set, for a volume which may still
+// be mounted. A sub-volume has no disk, its parent is detached once it
+// isn't used, caller holds StateMtx for a sub-volume.
+func (d *VolumeDriver) detachVolume(name string, device string, keepDevice bool) error {
+	if parent, child := d.subvols.get(name); child {
+		d.tidyParent(parent)
+		return nil
+	}
+	if !d.useMockEsx && !keepDevice {
+		if device == "" {
+			device = d.attachedDevice(name)
+		}
+		if device != "" {
+			err := fs.RemoveDevice(device)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"name": name, "device": device, "error": err,
+				}).Warning("Failed to remove the device before detach ")
+			}
+		}
 	}
 	return d.ops.Detach(name, nil)
 }
 
+// returns the device of an attached disk from the UUID in the volume
+// metadata, empty if it isn't attached to this VM or has no UUID
+func (d *VolumeDriver) attachedDevice(name string) string {
+	status, err := d.ops.Get(name)
+	if err != nil {
+		return ""
+	}
+	devInfo, ok := status[attachedDeviceKey].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	uuid, ok := devInfo[diskUUIDKey].(string)
+	if !ok || uuid == "" {
+		return ""
+	}
+	device := fs.DevicePathByUUID(uuid)
+	if _, err = os.Stat(device); err != nil {
+		return ""
+	}
+	return device
+}
+
 // private function that does the job of mounting volume in conjunction with refcounting
 func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 	volumeInfo, err := plugin_utils.GetVolumeInfo(r.Name, "", d)
@@ -227,6 +404,11 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 		return volume.Response{Err: err.Error()}
 	}
 	r.Name = volumeInfo.VolumeName
+	if exp, exporting := d.exports[r.Name]; exporting && exp.private {
+		msg := fmt.Sprintf("Volume %s is being exported, try again once the export is done", r.Name)
+		log.WithFields(log.Fields{"name": r.Name}).Error("Volume is being exported, refusing to mount ")
+		return volume.Response{Err: msg}
+	}
 	d.mountIDtoName[r.ID] = r.Name
 
 	// If the volume is already mounted , just increase the refcount.
@@ -248,7 +430,7 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 	// get volume metadata if required
 	volumeMeta := volumeInfo.VolumeMeta
 	if volumeMeta == nil {
-		if volumeMeta, err = d.ops.Get(r.Name); err != nil {
+		if volumeMeta, err = d.GetVolume(r.Name); err != nil {
 			d.decrRefCount(r.Name)
 			return volume.Response{Err: err.Error()}
 		}
@@ -281,7 +463,7 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 	}
 	fstype = value
 
-	mountpoint, err := d.MountVolume(r.Name, fstype, "", isReadOnly, false)
+	mountpoint, err := d.mountVolume(r.Name, fstype, isReadOnly, volumeMeta)
 	if err != nil {
 		log.WithFields(
 			log.Fields{"name": r.Name, "error": err.Error()},
@@ -290,7 +472,7 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 		refcnt, _ := d.decrRefCount(r.Name)
 		if refcnt == 0 {
 			log.Infof("Detaching %s - it is not used anymore", r.Name)
-			d.ops.Detach(r.Name, nil) // try to detach before failing the request for volume
+			d.detachVolume(r.Name, "", false) // try to detach before failing the request for volume
 		}
 		return volume.Response{Err: err.Error()}
 	}
@@ -302,12 +484,118 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 // (until Mount is called).
 // Name and driver specific options passed through to the ESX host
 
+// returns the create options for the options given with docker volume
+// create, merged with the default options and the profile from the config,
+// checked and normalized. The ESX service records them in the volume
+// metadata. A clone gets its options from the source volume, defaults and
+// profiles don't apply, nor to a sub-volume.
+func (d *VolumeDriver) createOptions(opts map[string]string) (map[string]string, error) {
+	for _, name := range []string{volopts.CloneFrom, volopts.Parent} {
+		if _, set := opts[name]; set {
+			if _, profile := opts[config.ProfileOption]; profile {
+				return nil, fmt.Errorf("Option %s can't be used with %s", config.ProfileOption, name)
+			}
+			return volopts.Vsphere.Validate(opts)
+		}
+	}
+
+	d.configMtx.RLock()
+	merged, err := d.config.MergeVolumeOptions(opts)
+	d.configMtx.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	merged, err = volopts.Vsphere.Validate(merged)
+	if err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{"options": opts, "merged": merged}).Debug("Volume create options ")
+	return merged, nil
+}
+
+// returns the name on ESX of a new volume, an alias if enabled, or an error
+// if the name isn't valid on ESX
+func (d *VolumeDriver) createName(name string) (string, error) {
+	backend := d.BackendName(name)
+	if err := volname.Validate(backend); err != nil {
+		return "", fmt.Errorf("%v. Enable VolumeAliases in the plugin config to use such names", err)
+	}
+	return backend, nil
+}
+
 // Create - create a volume.
 func (d *VolumeDriver) Create(r volume.Request) volume.Response {
+	return d.createVolume(r, nil)
+}
 
+// creates a volume, fill (if not nil) fills the new filesystem mounted on
+// a temporary directory, like populate-from does
+func (d *VolumeDriver) createVolume(r volume.Request, fill func(dir string) error) volume.Response {
 	if r.Options == nil {
 		r.Options = make(map[string]string)
 	}
+	opts, err := d.createOptions(r.Options)
+	if err != nil {
+		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Invalid volume options ")
+		return volume.Response{Err: err.Error()}
+	}
+	name, err := d.createName(r.Name)
+	if err != nil {
+		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Invalid volume name ")
+		return volume.Response{Err: err.Error()}
+	}
+	if name != r.Name {
+		// recorded by ESX for List to show the Docker name
+		dockerName := r.Name
+		if _, datastore := volname.Split(name); datastore != "" {
+			dockerName = strings.TrimSuffix(dockerName, "@"+datastore)
+		}
+		opts[volname.DockerNameKey] = dockerName
+	}
+	if source, clone := opts[volopts.CloneFrom]; clone {
+		opts[volopts.CloneFrom] = d.BackendName(source)
+	}
+	r.Name = name
+	r.Options = opts
+
+	// populate-from is a path in the guest, ESX doesn't get it
+	populateFrom := r.Options[volopts.PopulateFrom]
+	delete(r.Options, volopts.PopulateFrom)
+	if populateFrom != "" {
+		if _, err = os.Stat(populateFrom); err != nil {
+			log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Invalid volume options ")
+			return volume.Response{Err: fmt.Sprintf("Invalid %s: %v", volopts.PopulateFrom, err)}
+		}
+		if fill != nil {
+			return volume.Response{Err: fmt.Sprintf("%s can't be used here, the volume is filled from a stream",
+				volopts.PopulateFrom)}
+		}
+		fill = func(dir string) error {
+			return fs.PopulateDir(populateFrom, dir)
+		}
+	}
+
+	// a clone has its source's data, a raw volume has no filesystem to fill
+	if _, clone := r.Options[volopts.CloneFrom]; fill != nil && (clone || r.Options["fstype"] == volopts.FstypeRaw) {
+		log.WithFields(log.Fields{"name": r.Name}).Error("Invalid volume options ")
+		return volume.Response{Err: "A cloned or raw volume can't be filled with data"}
+	}
+
+	uid, gid, mode, err := d.rootOwnership(r.Options)
+	if err != nil {
+		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Invalid volume options ")
+		return volume.Response{Err: err.Error()}
+	}
+
+	// a sub-volume is a directory of its parent, ESX doesn't get it
+	if _, child := r.Options[volopts.Parent]; child {
+		if err = d.createSubvolume(r.Name, r.Options, fill, uid, gid, mode); err != nil {
+			log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Create sub-volume failed ")
+			return volume.Response{Err: err.Error()}
+		}
+		return volume.Response{Err: ""}
+	}
+
 	// If cloning a existent volume, create and return
 	if _, result := r.Options["clone-from"]; result == true {
 		errClone := d.ops.Create(r.Name, r.Options)
@@ -323,12 +611,20 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 		r.Options["fstype"] = fs.FstypeDefault
 	}
 
+	// A raw volume has no filesystem, the new disk is used as is
+	raw := r.Options["fstype"] == volopts.FstypeRaw
+
 	// Get existent filesystem tools
 	supportedFs := fs.MkfsLookup()
 
 	// Verify the existence of fstype mkfs
 	mkfscmd, result := supportedFs[r.Options["fstype"]]
-	if result == false {
+	// a parent needs project quotas, the fstype is checked with the options
+	var mkfsArgs []string
+	if r.Options[volopts.Subvolumes] == volopts.SubvolumesOn {
+		mkfsArgs = fs.ProjectQuotaMkfsArgs[r.Options["fstype"]]
+	}
+	if result == false && !raw {
 		msg := "Not found mkfs for " + r.Options["fstype"]
 		msg += "\nSupported filesystems found: "
 		validfs := ""
@@ -349,20 +645,25 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 		log.WithFields(log.Fields{"name": r.Name, "error": errCreate}).Error("Create volume failed ")
 		return volume.Response{Err: errCreate.Error()}
 	}
+	if raw {
+		log.WithFields(log.Fields{"name": r.Name}).Info("Raw volume created ")
+		return volume.Response{Err: ""}
+	}
 
 	// Handle filesystem creation
 	log.WithFields(log.Fields{"name": r.Name,
 		"fstype": r.Options["fstype"]}).Info("Attaching volume and creating filesystem ")
 
-	watcher, skipInotify := fs.DevAttachWaitPrep(r.Name, watchPath)
+	waiter := fs.NewDeviceWaiter(r.Name)
 
 	dev, errAttach := d.ops.Attach(r.Name, nil)
 	if errAttach != nil {
+		waiter.Close()
 		log.WithFields(log.Fields{"name": r.Name,
 			"error": errAttach}).Error("Attach volume failed, removing the volume ")
 		// An internal error for the attach may have the volume attached to this client,
 		// detach before removing below.
-		d.ops.Detach(r.Name, nil)
+		d.detachVolume(r.Name, "", false)
 		errRemove := d.ops.Remove(r.Name, nil)
 		if errRemove != nil {
 			log.WithFields(log.Fields{"name": r.Name, "error": errRemove}).Warning("Remove volume failed ")
@@ -370,11 +671,15 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 		return volume.Response{Err: errAttach.Error()}
 	}
 
-	device, errGetDevicePath := fs.GetDevicePath(dev)
+	device, errGetDevicePath := fs.GetAttachedDevice(r.Name, nil, dev, waiter)
+	if errGetDevicePath == nil {
+		// a new disk is blank, anything else isn't the disk just created
+		errGetDevicePath = fs.CheckBlank(device)
+	}
 	if errGetDevicePath != nil {
 		log.WithFields(log.Fields{"name": r.Name,
 			"error": errGetDevicePath}).Error("Could not find attached device, removing the volume ")
-		errDetach := d.ops.Detach(r.Name, nil)
+		errDetach := d.detachVolume(r.Name, "", false)
 		if errDetach != nil {
 			log.WithFields(log.Fields{"name": r.Name, "error": errDetach}).Warning("Detach volume failed ")
 		}
@@ -385,18 +690,11 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 		return volume.Response{Err: errGetDevicePath.Error()}
 	}
 
-	if skipInotify {
-		time.Sleep(sleepBeforeMount)
-	} else {
-		// Wait for the attach to complete, may timeout
-		// in which case we continue creating the file system.
-		fs.DevAttachWait(watcher, r.Name, device)
-	}
-	errMkfs := fs.Mkfs(mkfscmd, r.Name, device)
+	errMkfs := fs.Mkfs(mkfscmd, r.Name, device, mkfsArgs...)
 	if errMkfs != nil {
 		log.WithFields(log.Fields{"name": r.Name,
 			"error": errMkfs}).Error("Create filesystem failed, removing the volume ")
-		errDetach := d.ops.Detach(r.Name, nil)
+		errDetach := d.detachVolume(r.Name, device, false)
 		if errDetach != nil {
 			log.WithFields(log.Fields{"name": r.Name, "error": errDetach}).Warning("Detach volume failed ")
 		}
@@ -407,7 +705,32 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 		return volume.Response{Err: errMkfs.Error()}
 	}
 
-	errDetach := d.ops.Detach(r.Name, nil)
+	if fill != nil || uid >= 0 || gid >= 0 || mode >= 0 {
+		errPopulate := fs.Populate(device, r.Options["fstype"], func(dir string) error {
+			if fill != nil {
+				if err := fill(dir); err != nil {
+					return err
+				}
+			}
+			// the root options win over the root of an archive
+			return fs.SetRoot(dir, uid, gid, mode)
+		})
+		if errPopulate != nil {
+			log.WithFields(log.Fields{"name": r.Name, "source": populateFrom,
+				"error": errPopulate}).Error("Populating the volume failed, removing the volume ")
+			errDetach := d.detachVolume(r.Name, device, false)
+			if errDetach != nil {
+				log.WithFields(log.Fields{"name": r.Name, "error": errDetach}).Warning("Detach volume failed ")
+			}
+			errRemove := d.ops.Remove(r.Name, nil)
+			if errRemove != nil {
+				log.WithFields(log.Fields{"name": r.Name, "error": errRemove}).Warning("Remove volume failed ")
+			}
+			return volume.Response{Err: errPopulate.Error()}
+		}
+	}
+
+	errDetach := d.detachVolume(r.Name, device, false)
 	if errDetach != nil {
 		log.WithFields(log.Fields{"name": r.Name, "error": errDetach}).Error("Detach volume failed ")
 		return volume.Response{Err: errDetach.Error()}
@@ -418,18 +741,80 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 	return volume.Response{Err: ""}
 }
 
+// returns the owner and permissions of the root of a new volume from the
+// uid, gid and mode options, -1 for those not set. IDs are container IDs
+// mapped to host IDs if Docker remaps user namespaces.
+func (d *VolumeDriver) rootOwnership(opts map[string]string) (int, int, int, error) {
+	uid, gid, mode := -1, -1, -1
+	var err error
+	if value, set := opts[volopts.UID]; set {
+		if uid, err = strconv.Atoi(value); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	if value, set := opts[volopts.GID]; set {
+		if gid, err = strconv.Atoi(value); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	if value, set := opts[volopts.Mode]; set {
+		m, err := strconv.ParseUint(value, 8, 32)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		mode = int(m)
+	}
+
+	d.configMtx.RLock()
+	remap := d.config.UsernsRemap
+	d.configMtx.RUnlock()
+	if remap == "" || (uid < 0 && gid < 0) {
+		return uid, gid, mode, nil
+	}
+	mapping, err := userns.Load(remap)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if uid >= 0 {
+		hostID, err := mapping.UID(uint64(uid))
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		uid = int(hostID)
+	}
+	if gid >= 0 {
+		hostID, err := mapping.GID(uint64(gid))
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		gid = int(hostID)
+	}
+	log.WithFields(log.Fields{"uid": uid, "gid": gid, "remap": remap}).Debug("Volume root owner mapped to the host ")
+	return uid, gid, mode, nil
+}
+
 // Remove - removes individual volume. Docker would call it only if is not using it anymore
 func (d *VolumeDriver) Remove(r volume.Request) volume.Response {
 	log.WithFields(log.Fields{"name": r.Name}).Info("Removing volume ")
+	r.Name = d.BackendName(r.Name)
 
 	// Cannot remove volumes till plugin completely initializes (refcounting is complete)
 	// because we don't know if it is being used or not
 	if d.refCounts.IsInitialized() != true {
-		msg := fmt.Sprintf(plugin_utils.PluginInitError+" Cannot remove volume=%s", r.Name)
+		msg := fmt.Sprintf("%s Cannot remove volume=%s", d.refCounts.NotReadyReason(), r.Name)
 		log.Error(msg)
 		return volume.Response{Err: msg}
 	}
 
+	// ESX refuses to remove a parent with sub-volumes
+	if meta, err := d.GetVolume(r.Name); err == nil {
+		if parent, child := meta[volopts.Parent].(string); child {
+			short, _ := volname.Split(r.Name)
+			datastore, _ := meta["datastore"].(string)
+			return d.removeSubvolume(volname.Join(short, datastore), parent)
+		}
+	}
+
 	// Docker is supposed to block 'remove' command if the volume is used.
 	if d.getRefCount(r.Name) != 0 {
 		msg := fmt.Sprintf("Remove failure - volume is still mounted. "+
@@ -451,7 +836,7 @@ func (d *VolumeDriver) Remove(r volume.Request) volume.Response {
 
 // Path - give docker a reminder of the volume mount path
 func (d *VolumeDriver) Path(r volume.Request) volume.Response {
-	return volume.Response{Mountpoint: getMountPoint(r.Name)}
+	return volume.Response{Mountpoint: getMountPoint(d.BackendName(r.Name))}
 }
 
 // Mount - Provide a volume to docker container - called once per container start.
@@ -461,35 +846,90 @@ func (d *VolumeDriver) Path(r volume.Request) volume.Response {
 // of the docker daemon.
 // As long as the refCountsMap is protected is unnecessary to do any locking
 // at this level during create/mount/umount/remove.
-//
 func (d *VolumeDriver) Mount(r volume.MountRequest) volume.Response {
 	log.WithFields(log.Fields{"name": r.Name}).Info("Mounting volume ")
+	start := time.Now()
+	dockerName := r.Name
+	r.Name = d.BackendName(r.Name)
+
+	// the ro-for rules are applied before taking the lock, the runtime is
+	// asked for the container
+	isReadOnly := false
+	if r.ID != "" {
+		var err error
+		if isReadOnly, err = d.readOnlyFor(dockerName, r.Name); err != nil {
+			log.WithFields(log.Fields{"name": r.Name, "id": r.ID, "error": err}).Error("Failed to mount volume ")
+			metrics.ObserveRequest("mount", start, err.Error())
+			return volume.Response{Err: err.Error()}
+		}
+	}
 
 	// lock the state
 	d.refCounts.StateMtx.Lock()
 	defer d.refCounts.StateMtx.Unlock()
 
-	// checked by refcounting thread until refmap initialized
-	// useless after that
+	// checked by refcounting thread, which may also run on operator
+	// request after the refmap is initialized
 	d.refCounts.MarkDirty()
 
-	return d.processMount(r)
+	resp := d.processMount(r)
+	if resp.Err == "" {
+		resp = d.mountForID(r, resp.Mountpoint, isReadOnly)
+	}
+	metrics.ObserveRequest("mount", start, resp.Err)
+	return resp
+}
+
+// gives the mount ID its own mount point of the volume mounted by
+// processMount, the mount is undone if that fails
+func (d *VolumeDriver) mountForID(r volume.MountRequest, mountpoint string, isReadOnly bool) volume.Response {
+	name, known := d.mountIDtoName[r.ID]
+	if !known {
+		return volume.Response{Mountpoint: mountpoint}
+	}
+	path, err := d.bindMountID(name, r.ID, mountpoint, isReadOnly)
+	if err == nil {
+		return volume.Response{Mountpoint: path}
+	}
+	log.WithFields(
+		log.Fields{"name": name, "id": r.ID, "error": err.Error()},
+	).Error("Failed to mount for mount ID ")
+	delete(d.mountIDtoName, r.ID)
+	if refcnt, _ := d.decrRefCount(name); refcnt == 0 {
+		d.UnmountVolume(name)
+	}
+	return volume.Response{Err: err.Error()}
 }
 
 // Unmount request from Docker. If mount refcount is drop to 0.
 // Unmount and detach from VM
-func (d *VolumeDriver) Unmount(r volume.UnmountRequest) volume.Response {
+func (d *VolumeDriver) Unmount(r volume.UnmountRequest) (resp volume.Response) {
 	log.WithFields(log.Fields{"name": r.Name}).Info("Unmounting Volume ")
+	defer func(start time.Time) {
+		metrics.ObserveRequest("unmount", start, resp.Err)
+	}(time.Now())
+	r.Name = d.BackendName(r.Name)
 
 	// lock the state
 	d.refCounts.StateMtx.Lock()
 	defer d.refCounts.StateMtx.Unlock()
 
+	// checked by refcounting thread, which may also run on operator
+	// request after the refmap is initialized
+	d.refCounts.MarkDirty()
+
 	if d.refCounts.IsInitialized() != true {
 		// if refcounting hasn't been succesful,
 		// no refcounting, no unmount. All unmounts are delayed
 		// until we succesfully populate the refcount map
-		d.refCounts.MarkDirty()
+		// In degraded mode we don't know when that will be, so tell
+		// the user the volume is left attached.
+		if d.refCounts.GetState() == refcount.StateDegraded {
+			msg := fmt.Sprintf("%s Volume stays attached until refcounting recovers, volume=%s",
+				d.refCounts.NotReadyReason(), r.Name)
+			log.Error(msg)
+			return volume.Response{Err: msg}
+		}
 		return volume.Response{Err: ""}
 	}
 
@@ -504,6 +944,12 @@ func (d *VolumeDriver) Unmount(r volume.UnmountRequest) volume.Response {
 		}
 		r.Name = volumeInfo.VolumeName
 	}
+	if err := d.unbindMountID(r.Name, r.ID); err != nil {
+		log.WithFields(
+			log.Fields{"name": r.Name, "id": r.ID, "error": err.Error()},
+		).Error("Failed to unmount for mount ID ")
+		return volume.Response{Err: err.Error()}
+	}
 
 	// if refcount has been succcessful, Normal flow
 	// if the volume is still used by other containers, just return OK
@@ -533,6 +979,44 @@ func (d *VolumeDriver) Unmount(r volume.UnmountRequest) volume.Response {
 	return volume.Response{Err: ""}
 }
 
+// RefCounts - return the refcounts map of the driver
+func (d *VolumeDriver) RefCounts() *refcount.RefCountsMap {
+	return d.refCounts
+}
+
+// MountIDs - return a copy of the mount ID -> full volume name map
+func (d *VolumeDriver) MountIDs() map[string]string {
+	d.refCounts.StateMtx.Lock()
+	defer d.refCounts.StateMtx.Unlock()
+
+	mountIDs := make(map[string]string)
+	for id, name := range d.mountIDtoName {
+		mountIDs[id] = name
+	}
+	return mountIDs
+}
+
+// Detach - detach the volume from the VM, without unmounting it
+func (d *VolumeDriver) Detach(name string) error {
+	return d.detachVolume(name, "", false)
+}
+
+// ForgetMountIDs - drop the mount IDs referring to the volume and unmount
+// their bind mounts, caller holds StateMtx
+func (d *VolumeDriver) ForgetMountIDs(name string) {
+	d.unbindMountIDs(name)
+	for id, vol := range d.mountIDtoName {
+		if vol == name {
+			delete(d.mountIDtoName, id)
+		}
+	}
+}
+
+// Status - Report plugin health
+func (d *VolumeDriver) Status() refcount.Status {
+	return d.refCounts.GetStatus()
+}
+
 // Capabilities - Report plugin scope to Docker
 func (d *VolumeDriver) Capabilities(r volume.Request) volume.Response {
 	return volume.Response{Capabilities: volume.Capability{Scope: "global"}}
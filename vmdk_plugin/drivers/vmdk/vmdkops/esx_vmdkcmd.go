@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
@@ -49,8 +50,8 @@ type EsxVmdkCmd struct {
 }
 
 const (
-	commBackendName string = "vsocket"
-	maxRetryCount          = 5
+	commBackendName      string = "vsocket"
+	defaultMaxRetryCount        = 5
 	// Server side understand protocol version. If you are changing client/server protocol we use
 	// over VMCI, PLEASE DO NOT FORGET TO CHANGE IT FOR SERVER in file <vmdk_ops.py> !
 	clientProtocolVersion = "2"
@@ -76,6 +77,15 @@ type vmciError struct {
 // EsxPort used to connect to ESX, passed in as command line param
 var EsxPort int
 
+// retries of a command the ESX service didn't get, accessed atomically
+var maxRetryCount int32 = defaultMaxRetryCount
+
+// SetMaxRetryCount - set the retries of a command the ESX service didn't
+// get, used from the next command on
+func SetMaxRetryCount(count int) {
+	atomic.StoreInt32(&maxRetryCount, int32(count))
+}
+
 // Run command Guest VM requests on ESX via vmdkops_serv.py listening on vSocket
 // *
 // * For each request:
@@ -109,7 +119,8 @@ func (vmdkCmd EsxVmdkCmd) Run(cmd string, name string, opts map[string]string) (
 	defer C.free(unsafe.Pointer(ans))
 
 	var ret C.be_sock_status
-	for i := 0; i <= maxRetryCount; i++ {
+	retries := int(atomic.LoadInt32(&maxRetryCount))
+	for i := 0; i <= retries; i++ {
 		ret, err = C.Vmci_GetReply(C.int(EsxPort), cmdS, beS, ans)
 		if ret == 0 {
 			// Received no error, exit loop.
@@ -126,7 +137,7 @@ func (vmdkCmd EsxVmdkCmd) Run(cmd string, name string, opts map[string]string) (
 			var errno syscall.Errno
 			errno = err.(syscall.Errno)
 			msg = fmt.Sprintf("Run '%s' failed: %v (errno=%d) - %s", cmd, err, int(errno), C.GoString(&ans.errBuf[0]))
-			if i < maxRetryCount {
+			if i < retries {
 				log.Warnf(msg + " Retrying...")
 				time.Sleep(time.Second * 1)
 				continue
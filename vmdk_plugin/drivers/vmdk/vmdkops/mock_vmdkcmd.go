@@ -30,6 +30,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/volopts"
 )
 
 // MockVmdkCmd struct
@@ -101,13 +102,12 @@ func get(name string) error {
 
 func remove(name string) error {
 	backing := getBackingFileName(name)
-	out, err := exec.Command("blkid", []string{"-L", name}...).CombinedOutput()
+	device, err := getLoopbackDevice(backing)
 	if err != nil {
-		return fmt.Errorf("Failed to find device for backing file %s via blkid", backing)
+		return err
 	}
-	device := strings.TrimRight(string(out), " \n")
 	fmt.Printf("Detaching loopback device %s\n", device)
-	out, err = exec.Command("losetup", "-d", device).CombinedOutput()
+	out, err := exec.Command("losetup", "-d", device).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("Failed to detach loopback device node %s with error: %s. Output = %s",
 			device, err, out)
@@ -119,8 +119,8 @@ func remove(name string) error {
 	return os.Remove(device)
 }
 
-func createBlockDevice(label string, opts map[string]string) error {
-	backing := getBackingFileName(label)
+func createBlockDevice(name string, opts map[string]string) error {
+	backing := getBackingFileName(name)
 	err := createBackingFile(backing)
 	if err != nil {
 		return err
@@ -142,23 +142,36 @@ func createBlockDevice(label string, opts map[string]string) error {
 	if _, result := opts["fstype"]; result == false {
 		opts["fstype"] = fs.FstypeDefault
 	}
+	if opts["fstype"] == volopts.FstypeRaw {
+		return nil
+	}
 	mkfscmd, result := fs.MkfsLookup()[opts["fstype"]]
 	if result == false {
 		return fmt.Errorf("Not found mkfs for %s", opts["fstype"])
 	}
-	return fs.Mkfs(mkfscmd, label, device)
+	return fs.Mkfs(mkfscmd, name, device)
 }
 
 func getBlockDeviceForName(name string) ([]byte, error) {
-	backing := getBackingFileName(name)
-	out, err := exec.Command("blkid", []string{"-L", name}...).CombinedOutput()
+	device, err := getLoopbackDevice(getBackingFileName(name))
 	if err != nil {
-		return nil, fmt.Errorf("Failed to find device for backing file %s via blkid", backing)
+		return nil, err
 	}
-	device := strings.TrimRight(string(out), " \n")
 	return []byte(device), nil
 }
 
+// finds the loopback device of a backing file. The filesystem label can't
+// be used, it is only a prefix of long volume names.
+func getLoopbackDevice(backing string) (string, error) {
+	// output format: "/dev/loop1000: [2049]:1234 (/tmp/docker-volumes/...)"
+	out, err := exec.Command("losetup", "-j", backing).CombinedOutput()
+	device := strings.SplitN(string(out), ":", 2)[0]
+	if err != nil || !strings.HasPrefix(device, "/dev/") {
+		return "", fmt.Errorf("Failed to find device for backing file %s via losetup", backing)
+	}
+	return device, nil
+}
+
 func getMaxLoopbackCount() int {
 	// always start at 1000
 	count := 1000
@@ -18,7 +18,11 @@ package vmdkops
 
 import (
 	"encoding/json"
+	"sync"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/metrics"
 )
 
 //
@@ -45,24 +49,93 @@ type VolumeData struct {
 	Attributes map[string]string
 }
 
+// Request - a command sent to ESX which hasn't completed yet
+type Request struct {
+	Cmd     string    `json:"cmd"`
+	Name    string    `json:"name"`
+	Started time.Time `json:"started"`
+}
+
+var (
+	inFlightMtx   sync.Mutex
+	inFlight      = make(map[uint64]Request)
+	nextRequestID uint64
+)
+
+// InFlight returns the commands sent to ESX which haven't completed yet,
+// including the ones waiting for their turn.
+func InFlight() []Request {
+	inFlightMtx.Lock()
+	defer inFlightMtx.Unlock()
+	requests := make([]Request, 0, len(inFlight))
+	for _, req := range inFlight {
+		requests = append(requests, req)
+	}
+	return requests
+}
+
+// run a command, keeping track of it while in flight
+func (v VmdkOps) run(cmd string, name string, opts map[string]string) ([]byte, error) {
+	start := time.Now()
+	inFlightMtx.Lock()
+	id := nextRequestID
+	nextRequestID++
+	inFlight[id] = Request{Cmd: cmd, Name: name, Started: start}
+	inFlightMtx.Unlock()
+
+	defer func() {
+		inFlightMtx.Lock()
+		delete(inFlight, id)
+		inFlightMtx.Unlock()
+	}()
+
+	out, err := v.Cmd.Run(cmd, name, opts)
+	metrics.EsxRequests.Inc(cmd)
+	if err != nil {
+		metrics.EsxRequestErrors.Inc(cmd)
+	}
+	metrics.EsxRequestDuration.ObserveSince(start, cmd)
+	return out, err
+}
+
 // Create a volume
 func (v VmdkOps) Create(name string, opts map[string]string) error {
 	log.Debugf("vmdkOp.Create name=%s", name)
-	_, err := v.Cmd.Run("create", name, opts)
+	_, err := v.run("create", name, opts)
 	return err
 }
 
 // Remove a volume
 func (v VmdkOps) Remove(name string, opts map[string]string) error {
 	log.Debugf("vmdkOps.Remove name=%s", name)
-	_, err := v.Cmd.Run("remove", name, opts)
+	_, err := v.run("remove", name, opts)
+	return err
+}
+
+// AddSubvolume - records the sub-volume name, with the options of its
+// quota, in the metadata of the parent volume
+func (v VmdkOps) AddSubvolume(parent string, name string, opts map[string]string) error {
+	log.Debugf("vmdkOps.AddSubvolume parent=%s name=%s", parent, name)
+	args := map[string]string{"name": name}
+	for key, value := range opts {
+		args[key] = value
+	}
+	_, err := v.run("addsubvolume", parent, args)
+	return err
+}
+
+// RemoveSubvolume - drops the sub-volume name from the metadata of the
+// parent volume
+func (v VmdkOps) RemoveSubvolume(parent string, name string) error {
+	log.Debugf("vmdkOps.RemoveSubvolume parent=%s name=%s", parent, name)
+	_, err := v.run("removesubvolume", parent, map[string]string{"name": name})
 	return err
 }
 
 // Attach a volume
 func (v VmdkOps) Attach(name string, opts map[string]string) ([]byte, error) {
 	log.Debugf("vmdkOps.Attach name=%s", name)
-	str, err := v.Cmd.Run("attach", name, opts)
+	str, err := v.run("attach", name, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -72,14 +145,14 @@ func (v VmdkOps) Attach(name string, opts map[string]string) ([]byte, error) {
 // Detach a volume
 func (v VmdkOps) Detach(name string, opts map[string]string) error {
 	log.Debugf("vmdkOps.Detach name=%s", name)
-	_, err := v.Cmd.Run("detach", name, opts)
+	_, err := v.run("detach", name, opts)
 	return err
 }
 
 // List all volumes
 func (v VmdkOps) List() ([]VolumeData, error) {
 	log.Debugf("vmdkOps.List")
-	str, err := v.Cmd.Run("list", "", make(map[string]string))
+	str, err := v.run("list", "", make(map[string]string))
 	if err != nil {
 		return nil, err
 	}
@@ -95,7 +168,7 @@ func (v VmdkOps) List() ([]VolumeData, error) {
 // Get for volume
 func (v VmdkOps) Get(name string) (map[string]interface{}, error) {
 	log.Debugf("vmdkOps.Get name=%s", name)
-	str, err := v.Cmd.Run("get", name, make(map[string]string))
+	str, err := v.run("get", name, make(map[string]string))
 	if err != nil {
 		return nil, err
 	}
@@ -23,6 +23,7 @@ import (
 	"bytes"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"sort"
 	"strings"
 )
 
@@ -39,8 +40,14 @@ func (f *VmwareFormatter) Format(entry *log.Entry) ([]byte, error) {
 	b.WriteByte(']')
 	b.WriteByte(' ')
 	b.WriteString(entry.Message)
-	for key, value := range entry.Data {
-		f.appendKeyValue(b, key, value)
+	// sorted so that entries with the same fields look the same
+	keys := make([]string, 0, len(entry.Data))
+	for key := range entry.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		f.appendKeyValue(b, key, entry.Data[key])
 	}
 	b.WriteByte('\n')
 	return b.Bytes(), nil
@@ -0,0 +1,154 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Log outputs on Linux: rotated file, syslog or the systemd journal.
+// Syslog and journald get entries through logrus hooks, the formatter
+// is used for syslog messages and ignored by journald which gets the
+// fields as journal fields.
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	logrus_syslog "github.com/Sirupsen/logrus/hooks/syslog"
+	"github.com/coreos/go-systemd/journal"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/config"
+)
+
+const logTag = "docker-volume-vsphere" // syslog tag and journal identifier
+
+// outputHook - forwards entries to the syslog or journald hook, if any.
+// logrus hooks can't be removed, this one is added once and the hook it
+// forwards to is switched when the config is reloaded.
+type outputHook struct {
+	mtx  sync.RWMutex
+	hook log.Hook
+}
+
+var (
+	logHook      = &outputHook{}
+	logHookAdded sync.Once
+)
+
+func (h *outputHook) set(hook log.Hook) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.hook = hook
+}
+
+func (h *outputHook) Levels() []log.Level {
+	return allLevels
+}
+
+func (h *outputHook) Fire(entry *log.Entry) error {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	if h.hook == nil {
+		return nil
+	}
+	return h.hook.Fire(entry)
+}
+
+// sets the log output configured in c, logging to file at path. Returns
+// what to close when the output is replaced, nil if nothing. The current
+// output is kept on error.
+func setLogOutput(c config.Config, path string) (io.Closer, error) {
+	logHookAdded.Do(func() { log.AddHook(logHook) })
+
+	switch c.LogOutput {
+	case config.LogOutputFile:
+		logFile := newLogFile(c, path)
+		logHook.set(nil)
+		log.SetOutput(logFile)
+		return logFile, nil
+	case config.LogOutputSyslog:
+		network, address, err := config.ParseSyslogAddress(c.SyslogAddress)
+		if err != nil {
+			return nil, err
+		}
+		hook, err := logrus_syslog.NewSyslogHook(network, address, syslog.LOG_DAEMON|syslog.LOG_INFO, logTag)
+		if err != nil {
+			return nil, err
+		}
+		log.SetOutput(ioutil.Discard)
+		logHook.set(hook)
+		return hook.Writer, nil
+	case config.LogOutputJournald:
+		if !journal.Enabled() {
+			return nil, fmt.Errorf("systemd journal is not available")
+		}
+		log.SetOutput(ioutil.Discard)
+		logHook.set(&journalHook{})
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown log output %s", c.LogOutput)
+}
+
+// all the logrus levels, the vendored logrus doesn't have AllLevels
+var allLevels = []log.Level{
+	log.PanicLevel,
+	log.FatalLevel,
+	log.ErrorLevel,
+	log.WarnLevel,
+	log.InfoLevel,
+	log.DebugLevel,
+}
+
+// journald field names are uppercase letters, digits and underscores
+var journalFieldInvalid = regexp.MustCompile("[^A-Z0-9_]")
+
+// journalHook - sends entries to the systemd journal
+type journalHook struct{}
+
+func (h *journalHook) Levels() []log.Level {
+	return allLevels
+}
+
+func (h *journalHook) Fire(entry *log.Entry) error {
+	vars := map[string]string{"SYSLOG_IDENTIFIER": logTag}
+	for key, value := range entry.Data {
+		name := journalFieldInvalid.ReplaceAllString(strings.ToUpper(key), "_")
+		// can't start with an underscore, those are trusted fields
+		name = strings.TrimLeft(name, "_")
+		if name == "" {
+			continue
+		}
+		vars[name] = fmt.Sprint(value)
+	}
+	return journal.Send(entry.Message, journalPriority(entry.Level), vars)
+}
+
+func journalPriority(level log.Level) journal.Priority {
+	switch level {
+	case log.PanicLevel:
+		return journal.PriEmerg
+	case log.FatalLevel:
+		return journal.PriCrit
+	case log.ErrorLevel:
+		return journal.PriErr
+	case log.WarnLevel:
+		return journal.PriWarning
+	case log.InfoLevel:
+		return journal.PriInfo
+	}
+	return journal.PriDebug
+}
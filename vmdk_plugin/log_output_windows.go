@@ -0,0 +1,37 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Log outputs on Windows: rotated file only.
+
+import (
+	"fmt"
+	"io"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/config"
+)
+
+// sets the log output configured in c, logging to file at path. Returns
+// what to close when the output is replaced. The current output is kept
+// on error.
+func setLogOutput(c config.Config, path string) (io.Closer, error) {
+	if c.LogOutput != config.LogOutputFile {
+		return nil, fmt.Errorf("log output %s is not supported on Windows", c.LogOutput)
+	}
+	logFile := newLogFile(c, path)
+	log.SetOutput(logFile)
+	return logFile, nil
+}
@@ -20,11 +20,13 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"reflect"
 	"runtime"
 	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
@@ -32,6 +34,7 @@ import (
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers/photon"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers/vmdk"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/config"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/metrics"
 )
 
 const (
@@ -41,48 +44,134 @@ const (
 	defaultPort   = 1019
 )
 
-// init log with passed logLevel (and get config from configFile if it's present)
-// returns True if using defaults,  False if using config file
-func logInit(logLevel *string, logFile *string, configFile *string) bool {
-	usingConfigDefaults := false
-	c, err := config.Load(*configFile)
+// current log output, closed when replaced on config reload
+var logOutput io.Closer
+
+// init log with the level, format and output of the validated config c,
+// logging to logFile instead of the config log path if it isn't empty
+func logInit(c config.Config, logFile string) error {
+	path := c.LogPath
+	if logFile != "" {
+		path = logFile
+	}
+	output, err := setupLogging(c, c.LogLevel, path)
 	if err != nil {
-		if os.IsNotExist(err) {
-			usingConfigDefaults = true // no .conf file, so using defaults
-			c = config.Config{}
-			config.SetDefaults(&c)
-		} else {
-			panic(fmt.Sprintf("Failed to load config file %s: %v",
-				*configFile, err))
-		}
+		return err
 	}
+	logOutput = output
+	return nil
+}
 
-	path := c.LogPath
-	if logFile != nil {
-		path = *logFile
+// sets the log output and format of c, and the given log level. Returns
+// the new log output, the current one is kept on error.
+func setupLogging(c config.Config, logLevel string, path string) (io.Closer, error) {
+	level, err := log.ParseLevel(logLevel)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse log level: %v", err)
 	}
-	log.SetOutput(&lumberjack.Logger{
-		Filename: path,
-		MaxSize:  c.MaxLogSizeMb,  // megabytes
-		MaxAge:   c.MaxLogAgeDays, // days
-	})
 
-	if *logLevel == "" {
-		*logLevel = c.LogLevel
+	var formatter log.Formatter
+	switch c.LogFormat {
+	case config.LogFormatText:
+		formatter = new(VmwareFormatter)
+	case config.LogFormatJSON:
+		formatter = &log.JSONFormatter{TimestampFormat: time.RFC3339Nano}
+	default:
+		return nil, fmt.Errorf("Unknown log format %s", c.LogFormat)
 	}
 
-	level, err := log.ParseLevel(*logLevel)
+	output, err := setLogOutput(c, path)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to parse log level: %v", err))
+		return nil, fmt.Errorf("Failed to set log output: %v", err)
 	}
-
-	log.SetFormatter(new(VmwareFormatter))
+	log.SetFormatter(formatter)
 	log.SetLevel(level)
+	return output, nil
+}
 
-	if usingConfigDefaults {
-		log.Info("No config file found. Using defaults.")
+// returns the rotated log file at path
+func newLogFile(c config.Config, path string) *lumberjack.Logger {
+	return &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    c.MaxLogSizeMb,  // megabytes
+		MaxAge:     c.MaxLogAgeDays, // days
+		MaxBackups: c.MaxLogBackups,
+		Compress:   c.CompressLogs,
+	}
+}
+
+// configOverrides - options from ENV and command line, they win over the
+// config file on start and on reload
+type configOverrides struct {
+	logLevel string
+	driver   string
+	target   string
+	project  string
+	host     string
+}
+
+func (o configOverrides) apply(c *config.Config) {
+	overrideString(&c.LogLevel, o.logLevel)
+	overrideString(&c.Driver, o.driver)
+	if c.Driver == "" {
+		c.Driver = vsphereDriver
+	}
+	// On windows, if a driver other than vsphere is specified, switch
+	// to the vsphere driver and print a warning message.
+	if runtime.GOOS == "windows" && c.Driver != vsphereDriver {
+		fmt.Printf("Plugin only supports the %s driver on Windows, ignoring parameter driver = %s.\n",
+			vsphereDriver, c.Driver)
+		c.Driver = vsphereDriver
 	}
-	return usingConfigDefaults
+	overrideString(&c.Target, o.target)
+	overrideString(&c.Project, o.project)
+	overrideString(&c.Host, o.host)
+}
+
+// sets value if override isn't empty
+func overrideString(value *string, override string) {
+	if override != "" {
+		*value = override
+	}
+}
+
+// loads the config file (defaults if there is none), applies the overrides
+// and validates the result. Tells if defaults were used.
+func loadConfig(configFile string, o configOverrides) (config.Config, bool, error) {
+	c, usingDefaults, err := config.LoadOrDefault(configFile)
+	problems, ok := err.(config.Problems)
+	if err != nil && !ok {
+		return c, usingDefaults, err
+	}
+	// check what could be read too, to report all the problems at once
+	o.apply(&c)
+	if err = config.Validate(c); err != nil {
+		problems = append(problems, err.(config.Problems)...)
+	}
+	if len(problems) > 0 {
+		return c, usingDefaults, problems
+	}
+	return c, usingDefaults, nil
+}
+
+// prints the outcome of --check-config, returns the exit code
+func printConfigCheck(configFile string, usingDefaults bool, err error) int {
+	if usingDefaults {
+		fmt.Printf("No config file %s, checking defaults and environment overrides\n", configFile)
+	}
+	if err == nil {
+		fmt.Printf("Configuration %s is valid\n", configFile)
+		return 0
+	}
+	problems, ok := err.(config.Problems)
+	if !ok {
+		problems = config.Problems{err.Error()}
+	}
+	fmt.Printf("Configuration %s has %d problem(s):\n", configFile, len(problems))
+	for _, problem := range problems {
+		fmt.Printf("  %s\n", problem)
+	}
+	return 1
 }
 
 // main for docker-volume-vsphere
@@ -109,77 +198,57 @@ func main() {
 	port := flag.Int("port", defaultPort, "Default port to connect to ESX service")
 	useMockEsx := flag.Bool("mock_esx", false, "Mock the ESX service")
 
-	flag.Parse()
+	checkConfig := flag.Bool("check-config", false, "Check the configuration, print all problems and exit")
 
-	logInit(logLevel, nil, configFile)
+	flag.Parse()
 
-	// Load the configuration if one was provided.
-	c, err := config.Load(*configFile)
+	// Options from ENV and command line override the config file, so they
+	// are part of the checks.
+	overrides := configOverrides{
+		logLevel: *logLevel,
+		driver:   *driverName,
+		target:   *targetURL,
+		project:  *projectID,
+		host:     *vmID,
+	}
+	c, usingConfigDefaults, err := loadConfig(*configFile, overrides)
+	if *checkConfig {
+		os.Exit(printConfigCheck(*configFile, usingConfigDefaults, err))
+	}
 	if err != nil {
-		log.Warningf("Failed to load config file %s: %v", *configFile, err)
+		fmt.Fprintf(os.Stderr, "Invalid configuration, run with --check-config for details: %v\n", err)
+		os.Exit(1)
 	}
+	*driverName = c.Driver
 
-	// If no driver provided on the command line, use the one in the
-	// config file or the default.
-	if *driverName == "" {
-		if err == nil && c.Driver != "" {
-			*driverName = c.Driver
-		} else {
-			*driverName = vsphereDriver
-		}
+	if err = logInit(c, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up logging: %v\n", err)
+		os.Exit(1)
 	}
-
-	// On windows, if a driver other than vsphere is specified, switch
-	// to the vsphere driver and print a warning message.
-	if runtime.GOOS == "windows" && *driverName != vsphereDriver {
-		msg := fmt.Sprintf("Plugin only supports the %s driver on Windows, ignoring parameter driver = %s.",
-			vsphereDriver, c.Driver)
-		log.Warning(msg)
-		fmt.Println(msg)
-		*driverName = vsphereDriver
+	if usingConfigDefaults {
+		log.Info("No config file found. Using defaults.")
 	}
 
 	log.WithFields(log.Fields{
 		"driver":    *driverName,
-		"log_level": *logLevel,
+		"log_level": c.LogLevel,
 		"config":    *configFile,
 	}).Info("Starting plugin ")
 
-	// The vSphere driver doesn't depend on the config file for options
-	if *driverName == photonDriver && err == nil {
-		if *targetURL == "" {
-			*targetURL = c.Target
-		}
-		if *projectID == "" {
-			*projectID = c.Project
-		}
-		if *vmID == "" {
-			*vmID = c.Host
-		}
-
+	if *driverName == photonDriver {
 		log.WithFields(log.Fields{
-			"target":  *targetURL,
-			"project": *projectID,
-			"host":    *vmID}).Info("Plugin options - ")
-
-		if *targetURL == "" || *projectID == "" || *vmID == "" {
-			log.Warning("Invalid options specified for target/project/host")
-			fmt.Printf("Invalid options specified for target - %s project - %s host - %s. Exiting.\n",
-				*targetURL, *projectID, *vmID)
-			os.Exit(1)
-		}
-		driver = photon.NewVolumeDriver(*targetURL, *projectID,
-			*vmID, mountRoot)
-	} else if *driverName == vsphereDriver || *driverName == vmdkDriver {
+			"target":  c.Target,
+			"project": c.Project,
+			"host":    c.Host}).Info("Plugin options - ")
+
+		driver = photon.NewVolumeDriver(c.Target, c.Project, c.Host, mountRoot, c)
+	} else {
 		if *driverName == vmdkDriver {
 			log.Warning("Using deprecated \"vmdk\" driver, use \"vsphere\" driver instead - continuing...")
 		}
 		log.WithFields(log.Fields{"port": *port}).Info("Plugin options - ")
 
-		driver = vmdk.NewVolumeDriver(*port, *useMockEsx, mountRoot, *driverName)
-	} else {
-		log.Warning("Unknown driver or invalid/missing driver options, exiting - ", *driverName)
-		os.Exit(1)
+		driver = vmdk.NewVolumeDriver(*port, *useMockEsx, mountRoot, *driverName, c)
 	}
 
 	if reflect.ValueOf(driver).IsNil() == true {
@@ -187,14 +256,42 @@ func main() {
 		os.Exit(1)
 	}
 
+	reloader := &configReloader{
+		configFile: *configFile,
+		overrides:  overrides,
+		config:     c,
+		logOutput:  logOutput,
+	}
+	if r, ok := driver.(reconfigurable); ok {
+		reloader.driver = r
+	}
+	if c.MetricsAddress != "" {
+		server, err := metrics.Listen(c.MetricsAddress)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"address": c.MetricsAddress, "error": err,
+			}).Error("Failed to serve metrics ")
+		} else {
+			reloader.metricsServer = server
+			go serveMetrics(server)
+		}
+	}
+
+	initPlatform(&driver, c)
+
 	sigChannel := make(chan os.Signal, 1)
-	signal.Notify(sigChannel, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
-		sig := <-sigChannel
-		log.WithFields(log.Fields{"signal": sig}).Warning("Received signal ")
-		Destroy(driverName)
-		os.Exit(0)
+		for sig := range sigChannel {
+			if sig == syscall.SIGHUP {
+				reloader.reload()
+				continue
+			}
+			log.WithFields(log.Fields{"signal": sig}).Warning("Received signal ")
+			Destroy(driverName)
+			os.Exit(0)
+		}
 	}()
 
-	Init(driverName, &driver)
+	Init(driverName, &driver, c)
 }
@@ -18,18 +18,33 @@ package main
 // relies on docker/go-plugins-helpers/volume API
 
 import (
+	"encoding/json"
+	"net/http"
 	"os"
 	"path/filepath"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/admin"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/config"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/refcount"
 )
 
 const (
 	mountRoot     = "/mnt/vmdk" // VMDK and photon volumes are mounted here
 	pluginSockDir = "/run/docker/plugins"
+
+	// Plugin health endpoint, not part of the Docker volume plugin protocol
+	pluginStatusPath = "/Plugin.Status"
 )
 
+var adminServer *admin.Server // operator API, nil if the driver doesn't support it
+
+// statusReporter is implemented by drivers which report the plugin health
+type statusReporter interface {
+	Status() refcount.Status
+}
+
 // An equivalent function is not exported from the SDK.
 // API supports passing a full address instead of just name.
 // Using the full path during creation and deletion. The path
@@ -40,10 +55,41 @@ func fullSocketAddress(pluginName string) string {
 	return filepath.Join(pluginSockDir, pluginName+".sock")
 }
 
-// Init initializes a handler to service Docker requests using the driver.
-func Init(driverName *string, driver *volume.Driver) {
+// The admin socket lives next to the plugin socket.
+func adminSocketAddress(pluginName string) string {
+	return filepath.Join(pluginSockDir, pluginName+"-admin.sock")
+}
+
+// initPlatform creates the admin server if the driver supports it. Called
+// before the signal handler is installed, which reads adminServer on reload
+// and exit.
+func initPlatform(driver *volume.Driver, c config.Config) {
+	if d, ok := (*driver).(admin.Driver); ok {
+		adminServer = admin.NewServer(d, mountRoot, c)
+	}
+}
+
+// Init initializes a handler to service Docker requests using the driver,
+// and starts the admin server if there is one.
+func Init(driverName *string, driver *volume.Driver, c config.Config) {
 	handler := volume.NewHandler(*driver)
 
+	if adminServer != nil {
+		go func() {
+			err := adminServer.ServeUnix(adminSocketAddress(*driverName))
+			log.WithFields(log.Fields{"error": err}).Warning("Admin server stopped ")
+		}()
+	}
+
+	if reporter, ok := (*driver).(statusReporter); ok {
+		handler.HandleFunc(pluginStatusPath, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(reporter.Status()); err != nil {
+				log.Errorf("Failed to service %s request: %v", pluginStatusPath, err)
+			}
+		})
+	}
+
 	log.WithFields(log.Fields{
 		"address": fullSocketAddress(*driverName),
 	}).Info("Going into ServeUnix - Listening on Unix socket ")
@@ -51,7 +97,18 @@ func Init(driverName *string, driver *volume.Driver) {
 	log.Info(handler.ServeUnix("root", fullSocketAddress(*driverName)))
 }
 
-// Destroy removes the Docker plugin socket.
+// reconfigurePlatform applies a reloaded config to the admin server.
+func reconfigurePlatform(c config.Config) {
+	if adminServer != nil {
+		adminServer.SetConfig(c)
+	}
+}
+
+// Destroy removes the Docker plugin and admin sockets.
 func Destroy(driverName *string) {
 	os.Remove(fullSocketAddress(*driverName))
+	if adminServer != nil {
+		adminServer.Close()
+		os.Remove(adminSocketAddress(*driverName))
+	}
 }
@@ -28,6 +28,7 @@ import (
 	"github.com/Microsoft/go-winio"
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/config"
 )
 
 const (
@@ -105,8 +106,13 @@ func (h *HttpHandler) Serve(listener *net.Listener) error {
 	return http.Serve(*listener, nil)
 }
 
+// initPlatform has nothing to set up before the signal handler on Windows.
+func initPlatform(driver *volume.Driver, c config.Config) {
+}
+
 // Init registers an HTTP service backed by npipe to service requests using the driver.
-func Init(driverName *string, driver *volume.Driver) {
+// The admin API isn't supported on Windows.
+func Init(driverName *string, driver *volume.Driver, c config.Config) {
 	var err error
 	listener, err = winio.ListenPipe(npipeAddr, nil)
 	if err != nil {
@@ -121,6 +127,10 @@ func Init(driverName *string, driver *volume.Driver) {
 	log.Info(httpHandler.Serve(&listener))
 }
 
+// reconfigurePlatform applies a reloaded config, nothing to do on Windows.
+func reconfigurePlatform(c config.Config) {
+}
+
 // Destroy shuts down the npipe listener.
 func Destroy(driverName *string) {
 	listener.Close()
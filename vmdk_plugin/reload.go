@@ -0,0 +1,161 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Config reload on SIGHUP. Logging, the metrics listener and the retry and
+// timeout policy of the driver are changed in place. The driver itself,
+// its target and the container runtime are only set on start.
+
+import (
+	"io"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/config"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/metrics"
+)
+
+// reconfigurable is implemented by drivers which apply config changes
+type reconfigurable interface {
+	Reconfigure(c config.Config)
+}
+
+// configReloader - applies the config file again on SIGHUP
+type configReloader struct {
+	configFile    string
+	overrides     configOverrides
+	config        config.Config
+	logOutput     io.Closer
+	metricsServer *metrics.Server
+	driver        reconfigurable
+}
+
+// serves metrics until the server is closed
+func serveMetrics(server *metrics.Server) {
+	err := server.Serve()
+	log.WithFields(log.Fields{
+		"address": server.Address(), "error": err,
+	}).Info("Metrics server stopped ")
+}
+
+// reload - applies the config file, keeps the current config if the new
+// one is invalid or can't be applied
+func (r *configReloader) reload() {
+	c, _, err := loadConfig(r.configFile, r.overrides)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"config": r.configFile, "error": err,
+		}).Error("Config reload failed, keeping the current config ")
+		return
+	}
+
+	// get the new metrics listener first, it is the only step which can
+	// fail after logging is switched
+	metricsServer := r.metricsServer
+	metricsChanged := c.MetricsAddress != r.config.MetricsAddress
+	if metricsChanged {
+		metricsServer = nil
+		if c.MetricsAddress != "" {
+			// the old listener may hold the address
+			if r.metricsServer != nil {
+				r.metricsServer.Close()
+				r.metricsServer = nil
+			}
+			metricsServer, err = metrics.Listen(c.MetricsAddress)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"config": r.configFile, "address": c.MetricsAddress, "error": err,
+				}).Error("Config reload failed, keeping the current config ")
+				r.restoreMetrics()
+				return
+			}
+		}
+	}
+
+	logOutput, err := setupLogging(c, c.LogLevel, c.LogPath)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"config": r.configFile, "error": err,
+		}).Error("Config reload failed, keeping the current config ")
+		if metricsChanged {
+			if metricsServer != nil {
+				metricsServer.Close()
+			}
+			r.restoreMetrics()
+		}
+		return
+	}
+	if r.logOutput != nil {
+		r.logOutput.Close()
+	}
+	r.logOutput = logOutput
+
+	if metricsChanged {
+		if r.metricsServer != nil {
+			r.metricsServer.Close()
+		}
+		r.metricsServer = metricsServer
+		if metricsServer != nil {
+			go serveMetrics(metricsServer)
+		}
+	}
+
+	r.warnRestartNeeded(c)
+	if r.driver != nil {
+		r.driver.Reconfigure(c)
+	}
+	reconfigurePlatform(c)
+	r.config = c
+
+	log.WithFields(log.Fields{
+		"config":    r.configFile,
+		"log_level": c.LogLevel,
+		"metrics":   c.MetricsAddress,
+	}).Info("Config reloaded ")
+}
+
+// serves metrics again at the current address, after a failed reload
+// closed the listener
+func (r *configReloader) restoreMetrics() {
+	if r.metricsServer != nil || r.config.MetricsAddress == "" {
+		return
+	}
+	server, err := metrics.Listen(r.config.MetricsAddress)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"address": r.config.MetricsAddress, "error": err,
+		}).Error("Failed to serve metrics ")
+		return
+	}
+	r.metricsServer = server
+	go serveMetrics(server)
+}
+
+// warns about changes which are only applied on restart
+func (r *configReloader) warnRestartNeeded(c config.Config) {
+	for name, changed := range map[string]bool{
+		"Driver":          c.Driver != r.config.Driver,
+		"Target":          c.Target != r.config.Target,
+		"Project":         c.Project != r.config.Project,
+		"Host":            c.Host != r.config.Host,
+		"Runtime":         c.Runtime != r.config.Runtime,
+		"RuntimeEndpoint": c.RuntimeEndpoint != r.config.RuntimeEndpoint,
+	} {
+		if changed {
+			log.WithFields(log.Fields{
+				"config": r.configFile, "setting": name,
+			}).Warning("Config change needs a plugin restart to be applied ")
+		}
+	}
+}
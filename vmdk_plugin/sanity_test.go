@@ -75,7 +75,13 @@ func init() {
 	flag.IntVar(&parallelVolumes, "parallel_volumes", 3, "Volumes per docker daemon for create/delete concurrent tests")
 	flag.IntVar(&parallelClones, "parallel_clones", 2, "Volumes per docker daemon for clone concurrent tests")
 	flag.Parse()
-	usingConfigFileDefaults := logInit(logLevel, logFile, configFile)
+	c, usingConfigFileDefaults, err := loadConfig(*configFile, configOverrides{logLevel: *logLevel})
+	if err != nil {
+		panic(fmt.Sprintf("Failed to load config file %s: %v", *configFile, err))
+	}
+	if err = logInit(c, *logFile); err != nil {
+		panic(err.Error())
+	}
 
 	defaultHeaders = map[string]string{"User-Agent": "engine-api-client-1.0"}
 
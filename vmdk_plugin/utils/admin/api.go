@@ -0,0 +1,100 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+// Operator API of the plugin, served as JSON over a local unix socket
+// which only root can use. It exposes the internal state which matters
+// when debugging a host: refcounts, mount IDs, mounts and the outcome of
+// refcount discovery. It also allows repair actions on volumes whose
+// refcounts went wrong, and export and import of volume contents, each of
+// them is audited.
+
+import "time"
+
+const (
+	// StatusPath - plugin health, refcounting state
+	StatusPath = "/v1/status"
+	// RefCountsPath - refcount and mount state per volume
+	RefCountsPath = "/v1/refcounts"
+	// MountIDsPath - Docker mount ID -> volume name
+	MountIDsPath = "/v1/mountids"
+	// MountRootPath - content of the mount root
+	MountRootPath = "/v1/mountroot"
+	// ReconciliationPath - outcome of the last refcount discovery
+	ReconciliationPath = "/v1/reconciliation"
+	// ConfigPath - plugin configuration in use
+	ConfigPath = "/v1/config"
+	// InFlightPath - requests sent to ESX and not completed yet
+	InFlightPath = "/v1/esx/inflight"
+	// AuditPath - repair actions done so far
+	AuditPath = "/v1/audit"
+
+	// Repair actions, POST a RepairRequest
+
+	// RepairUnmountPath - unmount a volume whatever its refcount
+	RepairUnmountPath = "/v1/repair/unmount"
+	// RepairDetachPath - detach an unmounted volume whatever its refcount
+	RepairDetachPath = "/v1/repair/detach"
+	// RepairRefCountPath - set or adjust the refcount of a volume
+	RepairRefCountPath = "/v1/repair/refcount"
+	// RepairResyncPath - rerun refcount discovery now, takes no volume
+	RepairResyncPath = "/v1/repair/resync"
+
+	// Volume contents, the volume is given with ?volume=NAME
+
+	// ExportPath - GET the contents of a volume as a tar stream
+	ExportPath = "/v1/volumes/export"
+	// ImportPath - POST a tar or tar.gz stream to create a volume with it,
+	// create options are given with ?opt=KEY=VALUE
+	ImportPath = "/v1/volumes/import"
+)
+
+// StatusResponse - response to StatusPath
+type StatusResponse struct {
+	State       string `json:"state"`
+	Reason      string `json:"reason,omitempty"`
+	Initialized bool   `json:"initialized"` // refcounts are known
+	Dirty       bool   `json:"dirty"`       // mounts/unmounts happened during discovery
+}
+
+// MountRootEntry - a directory in the mount root
+type MountRootEntry struct {
+	Name    string `json:"name"`
+	Mounted bool   `json:"mounted"`
+	Device  string `json:"device,omitempty"`
+}
+
+// RepairRequest - body of the repair requests. For RepairRefCountPath
+// exactly one of Count and Delta is set.
+type RepairRequest struct {
+	Volume string `json:"volume,omitempty"`
+	Count  *int   `json:"count,omitempty"` // new refcount
+	Delta  *int   `json:"delta,omitempty"` // change of the refcount
+}
+
+// RepairResponse - response to a successful repair request
+type RepairResponse struct {
+	Action   string `json:"action"`
+	Volume   string `json:"volume,omitempty"`   // full volume name
+	RefCount *uint  `json:"refcount,omitempty"` // refcount after the action
+}
+
+// AuditEntry - a repair action, successful or not
+type AuditEntry struct {
+	Time    time.Time     `json:"time"`
+	Action  string        `json:"action"`
+	Request RepairRequest `json:"request"`
+	Error   string        `json:"error,omitempty"`
+}
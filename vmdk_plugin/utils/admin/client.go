@@ -0,0 +1,154 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Admin API client, used by vdvsctl.
+
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	clientTimeout = 60 * time.Second // repair actions may rerun discovery
+	// host part of the URLs, ignored when talking over a unix socket
+	clientURLBase = "http://localhost"
+)
+
+// Client - talks to the admin API over the unix socket
+type Client struct {
+	http   *http.Client
+	stream *http.Client // exports and imports, no timeout
+}
+
+// NewClient - creates a client for the admin socket at path
+func NewClient(path string) *Client {
+	dial := func(network, addr string) (net.Conn, error) {
+		return net.DialTimeout("unix", path, clientTimeout)
+	}
+	transport := &http.Transport{Dial: dial}
+	return &Client{
+		http: &http.Client{
+			Transport: transport,
+			Timeout:   clientTimeout,
+		},
+		stream: &http.Client{Transport: transport},
+	}
+}
+
+// Get - GETs the path and decodes the JSON response into v
+func (c *Client) Get(path string, v interface{}) error {
+	resp, err := c.http.Get(clientURLBase + path)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(resp, v)
+}
+
+// GetRaw - GETs the path and returns the response body as is
+func (c *Client) GetRaw(path string) ([]byte, error) {
+	resp, err := c.http.Get(clientURLBase + path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp, body)
+	}
+	return body, nil
+}
+
+// Repair - POSTs a repair request to the path
+func (c *Client) Repair(path string, req RepairRequest) (*RepairResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Post(clientURLBase+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	var repairResp RepairResponse
+	if err = decodeResponse(resp, &repairResp); err != nil {
+		return nil, err
+	}
+	return &repairResp, nil
+}
+
+// Export - writes the contents of the volume as a tar stream to w
+func (c *Client) Export(volume string, w io.Writer) error {
+	query := url.Values{"volume": {volume}}
+	resp, err := c.stream.Get(clientURLBase + ExportPath + "?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return responseError(resp, body)
+	}
+	// a failed export is cut short, the body then ends with an error
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Import - creates the volume with the create options opts and fills it
+// with the tar or tar.gz stream read from r
+func (c *Client) Import(volume string, opts map[string]string, r io.Reader) (*RepairResponse, error) {
+	query := url.Values{"volume": {volume}}
+	for key, value := range opts {
+		query.Add("opt", key+"="+value)
+	}
+	resp, err := c.stream.Post(clientURLBase+ImportPath+"?"+query.Encode(), "application/x-tar", r)
+	if err != nil {
+		return nil, err
+	}
+	var importResp RepairResponse
+	if err = decodeResponse(resp, &importResp); err != nil {
+		return nil, err
+	}
+	return &importResp, nil
+}
+
+// decodes a JSON response, or returns the error sent by the server
+func decodeResponse(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return responseError(resp, body)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// errors are sent as plain text
+func responseError(resp *http.Response, body []byte) error {
+	msg := strings.TrimSpace(string(body))
+	if msg == "" {
+		msg = resp.Status
+	}
+	return fmt.Errorf("%s (HTTP %d)", msg, resp.StatusCode)
+}
@@ -0,0 +1,120 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Export and import of volume contents. Both are audited like the repair
+// actions.
+
+package admin
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	actionExport = "export"
+	actionImport = "import"
+)
+
+// Exporter - a driver which can export and import volume contents
+type Exporter interface {
+	Export(name string, w io.Writer) error
+	Import(name string, opts map[string]string, r io.Reader) error
+}
+
+// tells whether the tar stream has started, errors can't be sent after
+type startedWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (s *startedWriter) Write(p []byte) (int, error) {
+	s.started = true
+	return s.w.Write(p)
+}
+
+// returns the driver as an Exporter, replies with an error if it isn't one
+func (s *Server) exporter(w http.ResponseWriter) (Exporter, bool) {
+	exporter, ok := s.driver.(Exporter)
+	if !ok {
+		http.Error(w, "Export and import aren't supported by this driver", http.StatusNotImplemented)
+	}
+	return exporter, ok
+}
+
+func (s *Server) exportVolume(w http.ResponseWriter, r *http.Request) {
+	if !checkGet(w, r) {
+		return
+	}
+	exporter, ok := s.exporter(w)
+	if !ok {
+		return
+	}
+	req := RepairRequest{Volume: r.URL.Query().Get("volume")}
+	if req.Volume == "" {
+		http.Error(w, "Volume name is required", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	out := &startedWriter{w: w}
+	err := exporter.Export(req.Volume, out)
+	s.audit.record(actionExport, req, err)
+	if err != nil {
+		if !out.started {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// the client gets a truncated stream instead of a partial archive
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (s *Server) importVolume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	exporter, ok := s.exporter(w)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	req := RepairRequest{Volume: query.Get("volume")}
+	if req.Volume == "" {
+		http.Error(w, "Volume name is required", http.StatusBadRequest)
+		return
+	}
+	opts := make(map[string]string)
+	for _, opt := range query["opt"] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			http.Error(w, fmt.Sprintf("Invalid option %q, expected KEY=VALUE", opt), http.StatusBadRequest)
+			return
+		}
+		opts[kv[0]] = kv[1]
+	}
+
+	err := exporter.Import(req.Volume, opts, r.Body)
+	s.audit.record(actionImport, req, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, r, RepairResponse{Action: actionImport, Volume: req.Volume})
+}
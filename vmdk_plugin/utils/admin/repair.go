@@ -0,0 +1,188 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Repair actions of the admin API. Every action is logged and kept in an
+// in-memory audit trail, whether it succeeded or not.
+
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/refcount"
+)
+
+const (
+	auditTrailSize = 100 // audit entries kept in memory, the log has them all
+
+	actionUnmount  = "unmount"
+	actionDetach   = "detach"
+	actionRefCount = "refcount"
+	actionResync   = "resync"
+)
+
+// auditTrail - the last repair actions
+type auditTrail struct {
+	mtx     sync.Mutex
+	entries []AuditEntry
+}
+
+// records an action in the log and the trail
+func (a *auditTrail) record(action string, req RepairRequest, err error) {
+	entry := AuditEntry{Time: time.Now(), Action: action, Request: req}
+	fields := log.Fields{"audit": true, "action": action, "volume": req.Volume}
+	if req.Count != nil {
+		fields["count"] = *req.Count
+	}
+	if req.Delta != nil {
+		fields["delta"] = *req.Delta
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		fields["error"] = err
+		log.WithFields(fields).Error("Admin repair action failed ")
+	} else {
+		log.WithFields(fields).Warning("Admin repair action done ")
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.entries = append(a.entries, entry)
+	if len(a.entries) > auditTrailSize {
+		a.entries = a.entries[len(a.entries)-auditTrailSize:]
+	}
+}
+
+// returns a copy of the trail, oldest first
+func (a *auditTrail) get() []AuditEntry {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	entries := make([]AuditEntry, len(a.entries))
+	copy(entries, a.entries)
+	return entries
+}
+
+// decodes a repair request, replies with an error and returns false if invalid
+func readRepairRequest(w http.ResponseWriter, r *http.Request, needVolume bool) (RepairRequest, bool) {
+	var req RepairRequest
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return req, false
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request (%v)", err), http.StatusBadRequest)
+			return req, false
+		}
+	}
+	if needVolume && req.Volume == "" {
+		http.Error(w, "Volume name is required", http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+// replies with the error of a repair action
+func writeRepairError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err.(type) {
+	case *refcount.VolumeInUseError:
+		status = http.StatusConflict
+	case *refcount.NotReadyError:
+		status = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func (s *Server) repairUnmount(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRepairRequest(w, r, true)
+	if !ok {
+		return
+	}
+	err := s.driver.RefCounts().ForceUnmount(s.driver, req.Volume)
+	s.audit.record(actionUnmount, req, err)
+	if err != nil {
+		writeRepairError(w, err)
+		return
+	}
+	writeJSON(w, r, RepairResponse{Action: actionUnmount, Volume: req.Volume})
+}
+
+func (s *Server) repairDetach(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRepairRequest(w, r, true)
+	if !ok {
+		return
+	}
+	err := s.driver.RefCounts().ForceDetach(s.driver, req.Volume)
+	s.audit.record(actionDetach, req, err)
+	if err != nil {
+		writeRepairError(w, err)
+		return
+	}
+	writeJSON(w, r, RepairResponse{Action: actionDetach, Volume: req.Volume})
+}
+
+func (s *Server) repairRefCount(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRepairRequest(w, r, true)
+	if !ok {
+		return
+	}
+	if (req.Count == nil) == (req.Delta == nil) {
+		http.Error(w, "Exactly one of count and delta is required", http.StatusBadRequest)
+		return
+	}
+
+	var vol string
+	var count uint
+	var err error
+	if req.Count != nil {
+		vol, count, err = s.driver.RefCounts().SetRefCount(s.driver, req.Volume, *req.Count, false)
+	} else {
+		vol, count, err = s.driver.RefCounts().SetRefCount(s.driver, req.Volume, *req.Delta, true)
+	}
+	s.audit.record(actionRefCount, req, err)
+	if err != nil {
+		writeRepairError(w, err)
+		return
+	}
+	writeJSON(w, r, RepairResponse{Action: actionRefCount, Volume: vol, RefCount: &count})
+}
+
+func (s *Server) repairResync(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRepairRequest(w, r, false)
+	if !ok {
+		return
+	}
+	err := s.driver.RefCounts().Resync(s.driver)
+	s.audit.record(actionResync, req, err)
+	if err != nil {
+		writeRepairError(w, err)
+		return
+	}
+	writeJSON(w, r, RepairResponse{Action: actionResync})
+}
+
+func (s *Server) auditEntries(w http.ResponseWriter, r *http.Request) {
+	if !checkGet(w, r) {
+		return
+	}
+	writeJSON(w, r, s.audit.get())
+}
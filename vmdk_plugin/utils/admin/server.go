@@ -0,0 +1,280 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Admin API server. Connections are only accepted from root, checked with
+// the peer credentials of the unix socket.
+
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers/vmdk/vmdkops"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/config"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/refcount"
+)
+
+const (
+	// Docker treats every socket in the plugins directory as a plugin and
+	// may try to activate it, so we answer the handshake with no interfaces.
+	pluginActivatePath = "/Plugin.Activate"
+	socketMode         = 0600
+)
+
+// Driver - the part of a volume driver the admin server needs
+type Driver interface {
+	refcount.RepairDriver
+	RefCounts() *refcount.RefCountsMap
+	MountIDs() map[string]string
+}
+
+// Server - serves the admin API
+type Server struct {
+	driver    Driver
+	mountRoot string
+	mux       *http.ServeMux
+	listener  net.Listener
+
+	configMtx sync.RWMutex
+	config    config.Config
+
+	audit auditTrail
+}
+
+// NewServer - creates a server for the driver, c is reported as the config in use
+func NewServer(d Driver, mountRoot string, c config.Config) *Server {
+	s := &Server{
+		driver:    d,
+		mountRoot: mountRoot,
+		mux:       http.NewServeMux(),
+		config:    c,
+	}
+	s.mux.HandleFunc(pluginActivatePath, s.pluginActivate)
+	s.mux.HandleFunc(StatusPath, s.status)
+	s.mux.HandleFunc(RefCountsPath, s.refCounts)
+	s.mux.HandleFunc(MountIDsPath, s.mountIDs)
+	s.mux.HandleFunc(MountRootPath, s.mountRootContent)
+	s.mux.HandleFunc(ReconciliationPath, s.reconciliation)
+	s.mux.HandleFunc(ConfigPath, s.configuration)
+	s.mux.HandleFunc(InFlightPath, s.inFlight)
+	s.mux.HandleFunc(AuditPath, s.auditEntries)
+	s.mux.HandleFunc(RepairUnmountPath, s.repairUnmount)
+	s.mux.HandleFunc(RepairDetachPath, s.repairDetach)
+	s.mux.HandleFunc(RepairRefCountPath, s.repairRefCount)
+	s.mux.HandleFunc(RepairResyncPath, s.repairResync)
+	s.mux.HandleFunc(ExportPath, s.exportVolume)
+	s.mux.HandleFunc(ImportPath, s.importVolume)
+	return s
+}
+
+// SetConfig - updates the config reported by the server
+func (s *Server) SetConfig(c config.Config) {
+	s.configMtx.Lock()
+	defer s.configMtx.Unlock()
+	s.config = c
+}
+
+// ServeUnix - listens on a unix socket at path, accessible to root only,
+// and serves requests until Close is called
+func (s *Server) ServeUnix(path string) error {
+	// remove a stale socket left by a previous run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(path, socketMode); err != nil {
+		l.Close()
+		return err
+	}
+	s.listener = &rootOnlyListener{l}
+
+	log.WithFields(log.Fields{"address": path}).Info("Serving admin API ")
+	return http.Serve(s.listener, s.mux)
+}
+
+// Close - stops serving
+func (s *Server) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// rootOnlyListener closes connections from processes not running as root
+type rootOnlyListener struct {
+	net.Listener
+}
+
+func (l *rootOnlyListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		cred, err := peerCred(conn)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Warning("Failed to get admin client credentials ")
+			conn.Close()
+			continue
+		}
+		if cred.Uid != 0 {
+			log.WithFields(log.Fields{"uid": cred.Uid, "pid": cred.Pid}).Warning("Refusing admin client, not root ")
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// returns the credentials of the process at the other end of the connection
+func peerCred(conn net.Conn) (*syscall.Ucred, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("not a unix socket connection")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+// marshals v as JSON and writes it to w
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Failed to service %s request: %v", r.URL.Path, err)
+	}
+}
+
+// only GET is supported by the introspection endpoints, repair actions are POST
+func checkGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func (s *Server) pluginActivate(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, map[string][]string{"Implements": {}})
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	if !checkGet(w, r) {
+		return
+	}
+	refCounts := s.driver.RefCounts()
+	status := refCounts.GetStatus()
+	writeJSON(w, r, StatusResponse{
+		State:       status.State,
+		Reason:      status.Reason,
+		Initialized: refCounts.IsInitialized(),
+		Dirty:       refCounts.IsDirty(),
+	})
+}
+
+func (s *Server) refCounts(w http.ResponseWriter, r *http.Request) {
+	if !checkGet(w, r) {
+		return
+	}
+	writeJSON(w, r, s.driver.RefCounts().GetRefCounts())
+}
+
+func (s *Server) mountIDs(w http.ResponseWriter, r *http.Request) {
+	if !checkGet(w, r) {
+		return
+	}
+	writeJSON(w, r, s.driver.MountIDs())
+}
+
+func (s *Server) mountRootContent(w http.ResponseWriter, r *http.Request) {
+	if !checkGet(w, r) {
+		return
+	}
+	files, err := ioutil.ReadDir(s.mountRoot)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mounts, err := plugin_utils.GetMountInfo(s.mountRoot)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]MountRootEntry, 0, len(files))
+	for _, file := range files {
+		// the dot directories hold the mounts of mount IDs and parents,
+		// they aren't volumes
+		if !file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		dev, mounted := mounts[file.Name()]
+		entries = append(entries, MountRootEntry{Name: file.Name(), Mounted: mounted, Device: dev})
+	}
+	writeJSON(w, r, entries)
+}
+
+func (s *Server) reconciliation(w http.ResponseWriter, r *http.Request) {
+	if !checkGet(w, r) {
+		return
+	}
+	rec := s.driver.RefCounts().GetLastReconciliation()
+	if rec == nil {
+		http.Error(w, "No reconciliation yet", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, r, rec)
+}
+
+func (s *Server) configuration(w http.ResponseWriter, r *http.Request) {
+	if !checkGet(w, r) {
+		return
+	}
+	s.configMtx.RLock()
+	c := s.config
+	s.configMtx.RUnlock()
+	writeJSON(w, r, c)
+}
+
+func (s *Server) inFlight(w http.ResponseWriter, r *http.Request) {
+	if !checkGet(w, r) {
+		return
+	}
+	writeJSON(w, r, vmdkops.InFlight())
+}
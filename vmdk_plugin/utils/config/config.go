@@ -19,42 +19,277 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 const (
 	// Local constants
-	defaultMaxLogSizeMb  = 100
-	defaultMaxLogAgeDays = 28
-	defaultLogLevel      = "info"
+	defaultMaxLogSizeMb    = 100
+	defaultMaxLogAgeDays   = 28
+	defaultLogLevel        = "info"
+	defaultLogFormat       = LogFormatText
+	defaultLogOutput       = LogOutputFile
+	defaultRuntime         = RuntimeDocker
+	defaultDeviceDiscovery = DeviceDiscoveryNetlink
+
+	// Retry and timeout policy
+	defaultEsxMaxRetries            = 5
+	defaultDeviceWaitTimeoutSec     = 10
+	defaultRefCountRetryAttempts    = 20
+	defaultRefCountMaxRetryDelaySec = 60
+	defaultDiscoveryTimeoutSec      = 30
+	defaultDiscoveryWorkers         = 8
+	defaultRuntimeTimeoutSec        = 2
+	defaultTrimRateMbPerSec         = 256
+
+	// LogFormatText - one line per entry, fields as key=value
+	LogFormatText = "text"
+	// LogFormatJSON - one JSON object per line
+	LogFormatJSON = "json"
+
+	// LogOutputFile - LogPath, rotated
+	LogOutputFile = "file"
+	// LogOutputSyslog - local syslog or SyslogAddress
+	LogOutputSyslog = "syslog"
+	// LogOutputJournald - local systemd journal
+	LogOutputJournald = "journald"
+
+	// RuntimeDocker - discover volume usage from Docker
+	RuntimeDocker = "docker"
+	// RuntimeContainerd - discover volume usage from containerd
+	RuntimeContainerd = "containerd"
+
+	// DeviceDiscoveryNetlink - wait for attached disks with kernel uevents
+	DeviceDiscoveryNetlink = "netlink"
+	// DeviceDiscoveryPoll - poll for attached disks
+	DeviceDiscoveryPoll = "poll"
+
+	// DriverVsphere - volumes on vSphere datastores, the default
+	DriverVsphere = "vsphere"
+	// DriverVmdk - deprecated name of the vsphere driver
+	DriverVmdk = "vmdk"
+	// DriverPhoton - volumes on Photon Controller
+	DriverPhoton = "photon"
 )
 
-// Config stores the configuration for the plugin
+// Config stores the configuration for the plugin. Each setting can be
+// overridden by the environment variable in its env tag.
 type Config struct {
-	Driver        string `json:",omitempty"`
-	LogPath       string `json:",omitempty"`
-	MaxLogSizeMb  int    `json:",omitempty"`
-	MaxLogAgeDays int    `json:",omitempty"`
-	LogLevel      string `json:",omitempty"`
-	Target        string `json:",omitempty"`
-	Project       string `json:",omitempty"`
-	Host          string `json:",omitempty"`
+	Driver        string `json:",omitempty" env:"VDVS_DRIVER"`
+	LogPath       string `json:",omitempty" env:"VDVS_LOG_PATH"`
+	MaxLogSizeMb  int    `json:",omitempty" env:"VDVS_MAX_LOG_SIZE_MB"`
+	MaxLogAgeDays int    `json:",omitempty" env:"VDVS_MAX_LOG_AGE_DAYS"`
+	LogLevel      string `json:",omitempty" env:"VDVS_LOG_LEVEL"`
+
+	// Rotated log files to keep, all of them (within MaxLogAgeDays) if 0,
+	// and whether to gzip them.
+	MaxLogBackups int  `json:",omitempty" env:"VDVS_MAX_LOG_BACKUPS"`
+	CompressLogs  bool `json:",omitempty" env:"VDVS_COMPRESS_LOGS"`
+
+	// Log entries format, "text" (default) or "json", and where they go,
+	// "file" (default, LogPath), "syslog" or "journald". SyslogAddress is
+	// the remote syslog as "udp://host:port" or "tcp://host:port", the
+	// local syslog is used if empty.
+	LogFormat     string `json:",omitempty" env:"VDVS_LOG_FORMAT"`
+	LogOutput     string `json:",omitempty" env:"VDVS_LOG_OUTPUT"`
+	SyslogAddress string `json:",omitempty" env:"VDVS_SYSLOG_ADDRESS"`
+
+	Target  string `json:",omitempty" env:"VDVS_TARGET"`
+	Project string `json:",omitempty" env:"VDVS_PROJECT"`
+	Host    string `json:",omitempty" env:"VDVS_HOST"`
+
+	// Container runtime used to discover volume usage on plugin start,
+	// "docker" (default) or "containerd". RuntimeEndpoint overrides the
+	// Docker socket or the containerd state directory.
+	Runtime         string `json:",omitempty" env:"VDVS_RUNTIME"`
+	RuntimeEndpoint string `json:",omitempty" env:"VDVS_RUNTIME_ENDPOINT"`
+
+	// Address (host:port) to serve Prometheus metrics on, at /metrics.
+	// Metrics aren't served if empty.
+	MetricsAddress string `json:",omitempty" env:"VDVS_METRICS_ADDRESS"`
+
+	// Retry and timeout policy, can be changed at runtime with SIGHUP.
+	// EsxMaxRetries - retries of a command the ESX service didn't get
+	// DeviceWaitTimeoutSec - wait for an attached disk to show up in the
+	// guest, or a deleted one to go away
+	EsxMaxRetries        int `json:",omitempty" env:"VDVS_ESX_MAX_RETRIES"`
+	DeviceWaitTimeoutSec int `json:",omitempty" env:"VDVS_DEVICE_WAIT_TIMEOUT_SEC"`
+
+	// How attached disks are found in the guest, "netlink" (default) to
+	// listen to kernel device events, with polling when no event comes,
+	// or "poll" where the plugin can't open a netlink socket.
+	DeviceDiscovery string `json:",omitempty" env:"VDVS_DEVICE_DISCOVERY"`
+
+	// Volume usage discovery (reconciliation of refcounts and mounts).
+	// RefCountRetryAttempts - failed discoveries before degraded mode
+	// RefCountMaxRetryDelaySec - max delay between discovery retries
+	// DiscoveryTimeoutSec - deadline of a discovery pass
+	// DiscoveryWorkers - containers inspected in parallel
+	// RuntimeTimeoutSec - timeout of a single container runtime request
+	RefCountRetryAttempts    int `json:",omitempty" env:"VDVS_REFCOUNT_RETRY_ATTEMPTS"`
+	RefCountMaxRetryDelaySec int `json:",omitempty" env:"VDVS_REFCOUNT_MAX_RETRY_DELAY_SEC"`
+	DiscoveryTimeoutSec      int `json:",omitempty" env:"VDVS_DISCOVERY_TIMEOUT_SEC"`
+	DiscoveryWorkers         int `json:",omitempty" env:"VDVS_DISCOVERY_WORKERS"`
+	RuntimeTimeoutSec        int `json:",omitempty" env:"VDVS_RUNTIME_TIMEOUT_SEC"`
+
+	// Scheduled trim of mounted volumes (vsphere driver), so thin disks
+	// give the space of deleted files back to the datastore. Volumes
+	// created with "-o trim=off" are skipped.
+	// TrimIntervalMin - minutes between trims of a volume, no trim if 0
+	// TrimRateMbPerSec - filesystem space trimmed per second at most
+	TrimIntervalMin  int `json:",omitempty" env:"VDVS_TRIM_INTERVAL_MIN"`
+	TrimRateMbPerSec int `json:",omitempty" env:"VDVS_TRIM_RATE_MB_PER_SEC"`
+
+	// The userns-remap setting of Docker ("default", "user" or
+	// "user:group") if it is enabled. The uid and gid volume options are
+	// then container IDs, mapped to host IDs like Docker does.
+	UsernsRemap string `json:",omitempty" env:"VDVS_USERNS_REMAP"`
+
+	// Create volumes whose Docker name isn't a valid vSphere volume name
+	// under a generated name (alias), instead of refusing them. The
+	// Docker name is recorded in the volume metadata.
+	VolumeAliases bool `json:",omitempty" env:"VDVS_VOLUME_ALIASES"`
+
+	// Volume create options (vsphere driver) used unless given with
+	// docker volume create, and named sets of options selected with
+	// "-o profile=<name>". Not overridden by environment variables.
+	DefaultVolumeOptions map[string]string            `json:",omitempty"`
+	VolumeProfiles       map[string]map[string]string `json:",omitempty"`
 }
 
-// Load the configuration from a file and return a Config.
+// Load the configuration from a file and return a Config. Environment
+// overrides and defaults are applied. Unknown keys and values of the
+// wrong type are reported together as Problems, the settings which could
+// be read are returned with them.
 func Load(path string) (Config, error) {
 	jsonBlob, err := ioutil.ReadFile(path)
 	if err != nil {
 		return Config{}, err
 	}
 	var config Config
-	if err := json.Unmarshal(jsonBlob, &config); err != nil {
-		return Config{}, err
+	problems := parse(jsonBlob, &config)
+	problems = append(problems, applyEnv(&config)...)
+	SetDefaults(&config)
+	if len(problems) > 0 {
+		return config, problems
 	}
+	return config, nil
+}
+
+// Default - the config used without a config file: defaults and
+// environment overrides
+func Default() (Config, error) {
+	var config Config
+	problems := applyEnv(&config)
 	SetDefaults(&config)
+	if len(problems) > 0 {
+		return config, problems
+	}
 	return config, nil
 }
 
+// LoadOrDefault - Load, or Default if there is no file at path. Tells
+// which one was used.
+func LoadOrDefault(path string) (Config, bool, error) {
+	config, err := Load(path)
+	if err != nil && os.IsNotExist(err) {
+		config, err = Default()
+		return config, true, err
+	}
+	return config, false, err
+}
+
+// decodes a JSON object into config. Keys are matched to fields without
+// case, like encoding/json does, each key is decoded on its own so all
+// the problems are found.
+func parse(jsonBlob []byte, config *Config) Problems {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(jsonBlob, &raw); err != nil {
+		return Problems{fmt.Sprintf("invalid JSON: %v", err)}
+	}
+
+	var problems Problems
+	value := reflect.ValueOf(config).Elem()
+	for key, rawValue := range raw {
+		field, found := fieldByName(key)
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s: unknown key", key))
+			continue
+		}
+		if err := json.Unmarshal(rawValue, value.FieldByIndex(field.Index).Addr().Interface()); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: expected %s, got %s", field.Name, kindName(field.Type.Kind()), rawValue))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// returns the Config field for a JSON key
+func fieldByName(key string) (reflect.StructField, bool) {
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		if strings.EqualFold(t.Field(i).Name, key) {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func kindName(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Int:
+		return "an integer"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Map:
+		return "an object"
+	}
+	return "a string"
+}
+
+// sets the settings whose environment variable is set
+func applyEnv(config *Config) Problems {
+	var problems Problems
+	value := reflect.ValueOf(config).Elem()
+	t := value.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		env, isSet := os.LookupEnv(name)
+		if !isSet {
+			continue
+		}
+		field := value.Field(i)
+		switch field.Kind() {
+		case reflect.Int:
+			n, err := strconv.Atoi(env)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: expected an integer, got %q", name, env))
+				continue
+			}
+			field.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(env)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: expected true or false, got %q", name, env))
+				continue
+			}
+			field.SetBool(b)
+		default:
+			field.SetString(env)
+		}
+	}
+	return problems
+}
+
 // SetDefaults for any config setting that is at its `bottom`
 func SetDefaults(config *Config) {
 	if config.LogPath == "" {
@@ -69,4 +304,30 @@ func SetDefaults(config *Config) {
 	if config.LogLevel == "" {
 		config.LogLevel = defaultLogLevel
 	}
+	if config.LogFormat == "" {
+		config.LogFormat = defaultLogFormat
+	}
+	if config.LogOutput == "" {
+		config.LogOutput = defaultLogOutput
+	}
+	if config.Runtime == "" {
+		config.Runtime = defaultRuntime
+	}
+	if config.DeviceDiscovery == "" {
+		config.DeviceDiscovery = defaultDeviceDiscovery
+	}
+	setDefaultInt(&config.EsxMaxRetries, defaultEsxMaxRetries)
+	setDefaultInt(&config.DeviceWaitTimeoutSec, defaultDeviceWaitTimeoutSec)
+	setDefaultInt(&config.RefCountRetryAttempts, defaultRefCountRetryAttempts)
+	setDefaultInt(&config.RefCountMaxRetryDelaySec, defaultRefCountMaxRetryDelaySec)
+	setDefaultInt(&config.DiscoveryTimeoutSec, defaultDiscoveryTimeoutSec)
+	setDefaultInt(&config.DiscoveryWorkers, defaultDiscoveryWorkers)
+	setDefaultInt(&config.RuntimeTimeoutSec, defaultRuntimeTimeoutSec)
+	setDefaultInt(&config.TrimRateMbPerSec, defaultTrimRateMbPerSec)
+}
+
+func setDefaultInt(value *int, defaultValue int) {
+	if *value == 0 {
+		*value = defaultValue
+	}
 }
@@ -19,6 +19,8 @@ package config_test
 import (
 	"github.com/stretchr/testify/assert"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/config"
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -29,3 +31,77 @@ func TestLoad(t *testing.T) {
 	assert.Equal(t, conf.MaxLogAgeDays, 28)
 	assert.Equal(t, conf.LogPath, "/var/log/docker-volume-vsphere.log")
 }
+
+func TestValidate(t *testing.T) {
+	conf, err := config.Load("../../default-config.json")
+	assert.Nil(t, err)
+	assert.Nil(t, config.Validate(conf))
+
+	bad := conf
+	bad.LogLevel = "loud"
+	assert.NotNil(t, config.Validate(bad))
+
+	bad = conf
+	bad.MetricsAddress = "9119"
+	assert.NotNil(t, config.Validate(bad))
+
+	bad = conf
+	bad.DiscoveryWorkers = -1
+	bad.Driver = config.DriverPhoton
+	bad.Target = "http://photon:9000"
+	assert.Equal(t, config.Problems{
+		"Project is required by the photon driver",
+		"Host is required by the photon driver",
+		"invalid DiscoveryWorkers -1, expected 1 to 256",
+	}, config.Validate(bad))
+}
+
+func TestLoadProblems(t *testing.T) {
+	f, err := ioutil.TempFile("", "vdvs-config")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`{"logLevel": "warning", "MaxLogSizeMb": "100", "LogPth": "/tmp/x.log"}`)
+	f.Close()
+
+	os.Setenv("VDVS_DISCOVERY_WORKERS", "many")
+	_, err = config.Load(f.Name())
+	assert.Equal(t, config.Problems{
+		"LogPth: unknown key",
+		"MaxLogSizeMb: expected an integer, got \"100\"",
+		"VDVS_DISCOVERY_WORKERS: expected an integer, got \"many\"",
+	}, err)
+
+	os.Setenv("VDVS_DISCOVERY_WORKERS", "4")
+	defer os.Unsetenv("VDVS_DISCOVERY_WORKERS")
+	ioutil.WriteFile(f.Name(), []byte(`{"logLevel": "warning"}`), 0600)
+	conf, err := config.Load(f.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, "warning", conf.LogLevel)
+	assert.Equal(t, 4, conf.DiscoveryWorkers)
+}
+
+func TestMergeVolumeOptions(t *testing.T) {
+	conf := config.Config{
+		DefaultVolumeOptions: map[string]string{"size": "10gb", "fstype": "ext4"},
+		VolumeProfiles: map[string]map[string]string{
+			"db-gold": {"size": "100gb", "vsan-policy-name": "gold"},
+		},
+	}
+
+	opts, err := conf.MergeVolumeOptions(map[string]string{"access": "read-only"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"size": "10gb", "fstype": "ext4", "access": "read-only"}, opts)
+
+	opts, err = conf.MergeVolumeOptions(map[string]string{"profile": "db-gold", "fstype": "xfs"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"size": "100gb", "fstype": "xfs", "vsan-policy-name": "gold"}, opts)
+
+	_, err = conf.MergeVolumeOptions(map[string]string{"profile": "db-silver"})
+	assert.NotNil(t, err)
+
+	config.SetDefaults(&conf)
+	conf.VolumeProfiles["db-gold"]["diskformat"] = "thik"
+	assert.Equal(t, config.Problems{
+		`VolumeProfiles[db-gold]: invalid diskformat "thik": valid values are thin, zeroedthick, eagerzeroedthick`,
+	}, config.Validate(conf))
+}
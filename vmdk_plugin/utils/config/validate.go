@@ -0,0 +1,143 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+// Validation of the config values. All the problems are reported at once,
+// so a templated config can be fixed in one go.
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/userns"
+)
+
+// Problems - everything wrong with a config
+type Problems []string
+
+func (p Problems) Error() string {
+	return strings.Join(p, "; ")
+}
+
+// Validate - checks the values of a config with defaults set. Returns
+// Problems, nil if there are none.
+func Validate(config Config) error {
+	var problems Problems
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch config.Driver {
+	case "", DriverVsphere, DriverVmdk:
+	case DriverPhoton:
+		if config.Target == "" {
+			add("Target is required by the %s driver", DriverPhoton)
+		} else if u, err := url.Parse(config.Target); err != nil ||
+			(u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("invalid Target %s, expected http://host:port or https://host:port", config.Target)
+		}
+		if config.Project == "" {
+			add("Project is required by the %s driver", DriverPhoton)
+		}
+		if config.Host == "" {
+			add("Host is required by the %s driver", DriverPhoton)
+		}
+	default:
+		add("invalid Driver %s, expected %s, %s or %s", config.Driver, DriverVsphere, DriverVmdk, DriverPhoton)
+	}
+
+	if _, err := log.ParseLevel(config.LogLevel); err != nil {
+		add("invalid LogLevel %s, expected debug, info, warning, error, fatal or panic", config.LogLevel)
+	}
+	if config.LogFormat != LogFormatText && config.LogFormat != LogFormatJSON {
+		add("invalid LogFormat %s, expected %s or %s", config.LogFormat, LogFormatText, LogFormatJSON)
+	}
+	switch config.LogOutput {
+	case LogOutputFile, LogOutputSyslog, LogOutputJournald:
+	default:
+		add("invalid LogOutput %s, expected %s, %s or %s", config.LogOutput,
+			LogOutputFile, LogOutputSyslog, LogOutputJournald)
+	}
+	if _, _, err := ParseSyslogAddress(config.SyslogAddress); err != nil {
+		add("invalid SyslogAddress: %v", err)
+	}
+	if config.Runtime != RuntimeDocker && config.Runtime != RuntimeContainerd {
+		add("invalid Runtime %s, expected %s or %s", config.Runtime, RuntimeDocker, RuntimeContainerd)
+	}
+	if config.DeviceDiscovery != DeviceDiscoveryNetlink && config.DeviceDiscovery != DeviceDiscoveryPoll {
+		add("invalid DeviceDiscovery %s, expected %s or %s", config.DeviceDiscovery,
+			DeviceDiscoveryNetlink, DeviceDiscoveryPoll)
+	}
+	if config.UsernsRemap != "" {
+		if _, _, err := userns.ParseRemap(config.UsernsRemap); err != nil {
+			add("invalid UsernsRemap: %v", err)
+		}
+	}
+	if config.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(config.MetricsAddress); err != nil {
+			add("invalid MetricsAddress %s: %v", config.MetricsAddress, err)
+		}
+	}
+
+	// allowed values after defaults
+	for _, check := range []struct {
+		name     string
+		value    int
+		min, max int
+	}{
+		{"MaxLogSizeMb", config.MaxLogSizeMb, 1, 10240},
+		{"MaxLogAgeDays", config.MaxLogAgeDays, 1, 3650},
+		{"MaxLogBackups", config.MaxLogBackups, 0, 1000},
+		{"EsxMaxRetries", config.EsxMaxRetries, 1, 100},
+		{"DeviceWaitTimeoutSec", config.DeviceWaitTimeoutSec, 1, 600},
+		{"RefCountRetryAttempts", config.RefCountRetryAttempts, 1, 1000},
+		{"RefCountMaxRetryDelaySec", config.RefCountMaxRetryDelaySec, 1, 3600},
+		{"DiscoveryTimeoutSec", config.DiscoveryTimeoutSec, 1, 3600},
+		{"DiscoveryWorkers", config.DiscoveryWorkers, 1, 256},
+		{"RuntimeTimeoutSec", config.RuntimeTimeoutSec, 1, 600},
+		{"TrimIntervalMin", config.TrimIntervalMin, 0, 525600},
+		{"TrimRateMbPerSec", config.TrimRateMbPerSec, 1, 102400},
+	} {
+		if check.value < check.min || check.value > check.max {
+			add("invalid %s %d, expected %d to %d", check.name, check.value, check.min, check.max)
+		}
+	}
+
+	problems = append(problems, validateVolumeOptions(config)...)
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// ParseSyslogAddress - returns network and address to dial for a syslog
+// address, "" for both for the local syslog
+func ParseSyslogAddress(address string) (string, string, error) {
+	if address == "" {
+		return "", "", nil
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", err
+	}
+	if (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+		return "", "", fmt.Errorf("invalid syslog address %s, expected udp://host:port or tcp://host:port", address)
+	}
+	return u.Scheme, u.Host, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+// Default volume create options and named profiles. The options given with
+// docker volume create win over the profile, which wins over the defaults.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/volopts"
+)
+
+// ProfileOption - volume create option selecting a profile
+const ProfileOption = "profile"
+
+// MergeVolumeOptions - returns the create options for opts, the options
+// given with docker volume create: DefaultVolumeOptions, overridden by
+// the profile selected in opts, overridden by opts. The profile option is
+// not part of the result.
+func (c Config) MergeVolumeOptions(opts map[string]string) (map[string]string, error) {
+	merged := make(map[string]string)
+	for key, value := range c.DefaultVolumeOptions {
+		merged[key] = value
+	}
+	if name, selected := opts[ProfileOption]; selected {
+		profile, exists := c.VolumeProfiles[name]
+		if !exists {
+			return nil, fmt.Errorf("Unknown volume profile %s, available profiles: %s",
+				name, strings.Join(c.profileNames(), ", "))
+		}
+		for key, value := range profile {
+			merged[key] = value
+		}
+	}
+	for key, value := range opts {
+		if key != ProfileOption {
+			merged[key] = value
+		}
+	}
+	return merged, nil
+}
+
+// returns the names of the profiles, sorted
+func (c Config) profileNames() []string {
+	names := make([]string, 0, len(c.VolumeProfiles))
+	for name := range c.VolumeProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// returns the problems of the default options and the profiles
+func validateVolumeOptions(c Config) Problems {
+	var problems Problems
+	check := func(where string, opts map[string]string) {
+		if _, clone := opts[volopts.CloneFrom]; clone {
+			problems = append(problems, fmt.Sprintf("%s: %s can't have a default", where, volopts.CloneFrom))
+		}
+		if _, err := volopts.Vsphere.Validate(opts); err != nil {
+			for _, problem := range err.(volopts.Error) {
+				problems = append(problems, where+": "+problem)
+			}
+		}
+	}
+
+	check("DefaultVolumeOptions", c.DefaultVolumeOptions)
+	for _, name := range c.profileNames() {
+		if name == "" || strings.ContainsAny(name, " \t,=") {
+			problems = append(problems, fmt.Sprintf("VolumeProfiles: invalid profile name %q", name))
+		}
+		check("VolumeProfiles["+name+"]", c.VolumeProfiles[name])
+	}
+	return problems
+}
@@ -0,0 +1,341 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Volume contents as tar archives. Ownership, permissions, times, links and
+// device nodes are kept, so a volume populated from an archive or a
+// directory looks like the source to the containers using it.
+
+package fs
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// gzip magic number, to tell a tar.gz from a tar
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Populate - mounts the new filesystem on device on a temporary directory
+// and fills it with fill, e.g. PopulateDir or Extract
+func Populate(device string, fstype string, fill func(dir string) error) error {
+	dir, err := MountTemp(device, fstype, false)
+	if err != nil {
+		return err
+	}
+	err = fill(dir)
+	errUnmount := UnmountTemp(dir)
+	if err != nil {
+		return err
+	}
+	return errUnmount
+}
+
+// MountTemp - mounts device on a new temporary directory, outside of the
+// mount root so Docker and the refcounts don't see it
+func MountTemp(device string, fstype string, isReadOnly bool) (string, error) {
+	dir, err := ioutil.TempDir("", "vdvs-mount-")
+	if err != nil {
+		return "", err
+	}
+	err = Mount(dir, fstype, device, isReadOnly)
+	if err != nil {
+		os.Remove(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// UnmountTemp - unmounts and removes a directory mounted by MountTemp
+func UnmountTemp(dir string) error {
+	err := Unmount(dir)
+	if err != nil {
+		return err
+	}
+	return os.Remove(dir)
+}
+
+// PopulateDir - copies the contents of source, a tar or tar.gz file or a
+// directory, into dir
+func PopulateDir(source string, dir string) error {
+	stat, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("Failed to populate from %s: %v", source, err)
+	}
+	log.WithFields(log.Fields{"source": source, "dir": dir}).Info("Populating volume ")
+
+	if stat.IsDir() {
+		return CopyDir(source, dir)
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("Failed to populate from %s: %v", source, err)
+	}
+	defer f.Close()
+	err = Extract(f, dir)
+	if err != nil {
+		return fmt.Errorf("Failed to populate from %s: %v", source, err)
+	}
+	return nil
+}
+
+// CopyDir - copies the contents of directory src into dir
+func CopyDir(src string, dir string) error {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(Archive(src, w))
+	}()
+	err := Extract(r, dir)
+	r.CloseWithError(err)
+	if err != nil {
+		return fmt.Errorf("Failed to copy %s: %v", src, err)
+	}
+	return nil
+}
+
+// Archive - writes the contents of dir as a tar stream to w. Sockets are
+// skipped, files with several links are archived once and then as links.
+func Archive(dir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	links := make(map[uint64]string) // inode -> first name archived
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		target := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if target, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, target)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uname, hdr.Gname = "", "" // numeric ids only
+
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && st.Nlink > 1 {
+			if first, seen := links[st.Ino]; seen {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				links[st.Ino] = hdr.Name
+			}
+		}
+
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Extract - extracts a tar or tar.gz stream into dir, with the ownership,
+// permissions and times of the archive. Entries can't be written outside
+// of dir, through .. or symlinks.
+func Extract(r io.Reader, dir string) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(gzipMagic)); err == nil && string(magic) == string(gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+
+	// directory times change as entries are added, set them last
+	type dirTimes struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTimes
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		path, err := safePath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		err = extractEntry(tr, hdr, dir, path)
+		if err != nil {
+			return fmt.Errorf("Failed to extract %s: %v", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTimes{path, hdr.ModTime})
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime)
+	}
+	return nil
+}
+
+// creates the file of a tar entry at path and sets its metadata
+func extractEntry(tr *tar.Reader, hdr *tar.Header, dir string, path string) error {
+	mode := hdr.FileInfo().Mode()
+	if hdr.Typeflag != tar.TypeDir {
+		// replace what is there, but not the directories of the volume
+		if stat, err := os.Lstat(path); err == nil && !stat.IsDir() {
+			if err = os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(path, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		return lchown(hdr, path, os.Symlink(hdr.Linkname, path))
+	case tar.TypeLink:
+		target, err := safePath(dir, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		// the target has its metadata already
+		return os.Link(target, path)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devMode := uint32(syscall.S_IFIFO)
+		if hdr.Typeflag == tar.TypeChar {
+			devMode = syscall.S_IFCHR
+		} else if hdr.Typeflag == tar.TypeBlock {
+			devMode = syscall.S_IFBLK
+		}
+		dev := int((hdr.Devmajor&0xfff)<<8 | hdr.Devminor&0xff | (hdr.Devminor&^0xff)<<12)
+		if err := syscall.Mknod(path, devMode|0600, dev); err != nil {
+			return err
+		}
+	default:
+		log.WithFields(log.Fields{"name": hdr.Name, "type": hdr.Typeflag}).Warning("Skipping unsupported archive entry ")
+		return nil
+	}
+
+	if err := lchown(hdr, path, nil); err != nil {
+		return err
+	}
+	// after chown, which clears setuid and setgid
+	if err := os.Chmod(path, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+}
+
+// sets the owner of the entry at path, unless creating it failed with err
+func lchown(hdr *tar.Header, path string, err error) error {
+	if err != nil {
+		return err
+	}
+	return os.Lchown(path, hdr.Uid, hdr.Gid)
+}
+
+// returns the path of an archive entry in dir, an error if the name leaves
+// dir or goes through a symlink
+func safePath(dir string, name string) (string, error) {
+	rel := filepath.Clean(name)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("Archive entry %s is outside of the volume", name)
+	}
+	path := dir
+	parts := strings.Split(strings.Trim(filepath.Clean("/"+rel), "/"), "/")
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		path = filepath.Join(path, part)
+		if i == len(parts)-1 {
+			break
+		}
+		stat, err := os.Lstat(path)
+		if err == nil && stat.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("Archive entry %s is under a symlink", name)
+		}
+	}
+	return path, nil
+}
+
+// SetRoot - sets the owner and permissions of dir, the root of a new
+// volume. An ID or mode of -1 is left as is.
+func SetRoot(dir string, uid int, gid int, mode int) error {
+	if uid >= 0 || gid >= 0 {
+		if err := os.Lchown(dir, uid, gid); err != nil {
+			return fmt.Errorf("Failed to set the owner of the volume root: %v", err)
+		}
+	}
+	if mode >= 0 {
+		// syscall.Chmod takes the setuid, setgid and sticky bits as is
+		if err := syscall.Chmod(dir, uint32(mode)); err != nil {
+			return fmt.Errorf("Failed to set the permissions of the volume root: %v", err)
+		}
+	}
+	return nil
+}
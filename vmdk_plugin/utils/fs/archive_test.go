@@ -0,0 +1,102 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCopyDir(t *testing.T) {
+	src, err := ioutil.TempDir("", "archive-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "archive-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	os.Chmod(src, 0750)
+	os.MkdirAll(filepath.Join(src, "data/sub"), 0700)
+	ioutil.WriteFile(filepath.Join(src, "data/file"), []byte("contents"), 0640)
+	os.Chmod(filepath.Join(src, "data/file"), 0750|os.ModeSetuid)
+	os.Link(filepath.Join(src, "data/file"), filepath.Join(src, "link"))
+	os.Symlink("data/file", filepath.Join(src, "symlink"))
+	os.Lchown(filepath.Join(src, "data/sub"), 1234, 5678)
+
+	if err = CopyDir(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if stat, _ := os.Stat(dst); stat.Mode().Perm() != 0750 {
+		t.Errorf("root mode = %v, expected 0750", stat.Mode())
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dst, "data/file")); string(data) != "contents" {
+		t.Errorf("data/file = %q", data)
+	}
+	if stat, _ := os.Stat(filepath.Join(dst, "data/file")); stat.Mode() != 0750|os.ModeSetuid {
+		t.Errorf("data/file mode = %v, expected setuid 0750", stat.Mode())
+	}
+	file, _ := os.Stat(filepath.Join(dst, "data/file"))
+	link, _ := os.Stat(filepath.Join(dst, "link"))
+	if !os.SameFile(file, link) {
+		t.Errorf("link isn't a hard link of data/file")
+	}
+	if target, _ := os.Readlink(filepath.Join(dst, "symlink")); target != "data/file" {
+		t.Errorf("symlink = %q, expected data/file", target)
+	}
+	if os.Getuid() == 0 {
+		stat, _ := os.Stat(filepath.Join(dst, "data/sub"))
+		st := stat.Sys().(*syscall.Stat_t)
+		if st.Uid != 1234 || st.Gid != 5678 {
+			t.Errorf("data/sub owner = %d:%d, expected 1234:5678", st.Uid, st.Gid)
+		}
+	}
+}
+
+func TestExtractUnsafe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	entries := [][]tar.Header{
+		{{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644}},
+		{{Name: "a/../../escape", Typeflag: tar.TypeReg, Mode: 0644}},
+		{{Name: "out", Typeflag: tar.TypeSymlink, Linkname: "/tmp"}, {Name: "out/escape", Typeflag: tar.TypeReg, Mode: 0644}},
+	}
+	for _, headers := range entries {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for i := range headers {
+			tw.WriteHeader(&headers[i])
+		}
+		tw.Close()
+		if err := Extract(&buf, dir); err == nil {
+			t.Errorf("Extract of %s succeeded", headers[len(headers)-1].Name)
+		}
+	}
+}
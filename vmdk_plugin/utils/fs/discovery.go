@@ -0,0 +1,285 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Device discovery. Waits for attached disks to show up in the guest, and
+// for deleted ones to go away, by listening to kernel uevents over
+// netlink. Each block device event triggers a check, a check also runs
+// when no event came for a while, with backoff, which is all there is if
+// netlink can't be used.
+
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/metrics"
+)
+
+const (
+	// kernel uevents multicast group, udev's own events are in group 2
+	ueventKernelGroup = 1
+	ueventBufSize     = 64 * 1024
+
+	// checks without events start at minPollInterval and back off
+	minPollInterval = 50 * time.Millisecond
+	maxPollInterval = 1 * time.Second
+)
+
+// use polling only, set with SetPolling, accessed atomically
+var pollOnly int32
+
+// SetPolling - poll for devices instead of listening to uevents, e.g.
+// where the plugin can't open a netlink socket
+func SetPolling(poll bool) {
+	var value int32
+	if poll {
+		value = 1
+	}
+	atomic.StoreInt32(&pollOnly, value)
+}
+
+// DeviceMatch - checks for a device, returns it and true once found
+type DeviceMatch func() (string, bool)
+
+// DeviceWaiter - waits for a disk to show up or go away. Create it before
+// the disk is attached or deleted, so no event is missed.
+type DeviceWaiter struct {
+	name string // volume or disk, for logs
+	fd   int    // netlink socket, -1 when polling
+}
+
+// NewDeviceWaiter - listens to uevents, or polls if netlink is disabled
+// or fails
+func NewDeviceWaiter(name string) *DeviceWaiter {
+	w := &DeviceWaiter{name: name, fd: -1}
+	if atomic.LoadInt32(&pollOnly) != 0 {
+		return w
+	}
+	fd, err := openUeventSocket()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"name": name, "error": err,
+		}).Warning("Failed to listen to device events, polling for the device ")
+		return w
+	}
+	w.fd = fd
+	return w
+}
+
+func openUeventSocket() (int, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC,
+		syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return -1, err
+	}
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: ueventKernelGroup,
+	})
+	if err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// Close - stops listening to uevents
+func (w *DeviceWaiter) Close() {
+	if w.fd >= 0 {
+		syscall.Close(w.fd)
+		w.fd = -1
+	}
+}
+
+// Wait - waits for match to find an attached device, for the device wait
+// timeout. The waiter is closed.
+func (w *DeviceWaiter) Wait(match DeviceMatch) (string, error) {
+	start := time.Now()
+	timeout := time.Duration(atomic.LoadInt64(&devWaitTimeout))
+	device, err := w.waitFor(match, timeout)
+	outcome := "found"
+	if err != nil {
+		outcome = "timeout"
+	}
+	metrics.DeviceWaitDuration.ObserveSince(start, outcome)
+	return device, err
+}
+
+// checks with match on each block device event and when no event came for
+// a while, until it matches or the timeout expires. Closes the waiter.
+func (w *DeviceWaiter) waitFor(match DeviceMatch, timeout time.Duration) (string, error) {
+	defer w.Close()
+	deadline := time.Now().Add(timeout)
+	interval := minPollInterval
+	buf := make([]byte, ueventBufSize)
+	for {
+		if device, found := match(); found {
+			log.WithFields(log.Fields{"name": w.name, "device": device}).Debug("Device found ")
+			return device, nil
+		}
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			log.WithFields(log.Fields{
+				"name": w.name, "timeout": timeout,
+			}).Warning("Exceeded timeout while waiting for the device ")
+			return "", fmt.Errorf("Timed out after %v waiting for the device of %s", timeout, w.name)
+		}
+		if interval > remaining {
+			interval = remaining
+		}
+
+		if w.fd < 0 || !w.waitEvent(buf, interval) {
+			if w.fd < 0 {
+				time.Sleep(interval)
+			}
+			// no event, back off
+			interval *= 2
+			if interval > maxPollInterval {
+				interval = maxPollInterval
+			}
+			continue
+		}
+		interval = minPollInterval
+	}
+}
+
+// waits up to timeout for a block device uevent, false if none came or the
+// socket failed, polling goes on then
+func (w *DeviceWaiter) waitEvent(buf []byte, timeout time.Duration) bool {
+	tv := syscall.NsecToTimeval(timeout.Nanoseconds())
+	err := syscall.SetsockoptTimeval(w.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+	if err != nil {
+		w.pollOnError(err)
+		return false
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		n, _, err := syscall.Recvfrom(w.fd, buf, 0)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			return false
+		}
+		if err != nil {
+			w.pollOnError(err)
+			return false
+		}
+		if event := parseUevent(buf[:n]); event["SUBSYSTEM"] == "block" {
+			log.WithFields(log.Fields{
+				"name": w.name, "action": event["ACTION"], "device": event["DEVNAME"],
+			}).Debug("Device event ")
+			return true
+		}
+	}
+	return false
+}
+
+func (w *DeviceWaiter) pollOnError(err error) {
+	log.WithFields(log.Fields{
+		"name": w.name, "error": err,
+	}).Warning("Failed to read device events, polling for the device ")
+	w.Close()
+}
+
+// parses a kernel uevent, "action@devpath" followed by KEY=value
+// properties, NUL separated
+func parseUevent(msg []byte) map[string]string {
+	event := make(map[string]string)
+	for _, field := range strings.Split(string(msg), "\x00") {
+		if kv := strings.SplitN(field, "=", 2); len(kv) == 2 {
+			event[kv[0]] = kv[1]
+		}
+	}
+	return event
+}
+
+// MatchUUID - matches the disk with a VMDK UUID (the disk WWN), as
+// /dev/<disk>. The kernel knows the WWN before udev adds the
+// /dev/disk/by-id links.
+func MatchUUID(uuid string) DeviceMatch {
+	uuid = normalizeUUID(uuid)
+	return func() (string, bool) {
+		disks, err := ioutil.ReadDir(bdevPath)
+		if err != nil {
+			return "", false
+		}
+		for _, disk := range disks {
+			device := "/dev/" + disk.Name()
+			if id, err := DeviceUUID(device); err == nil && id == uuid {
+				if _, err = os.Stat(device); err == nil {
+					return device, true
+				}
+			}
+		}
+		return "", false
+	}
+}
+
+// MatchPath - matches a device path, e.g. a /dev/disk/by-path link
+func MatchPath(path string) DeviceMatch {
+	return func() (string, bool) {
+		_, err := os.Stat(path)
+		return path, err == nil
+	}
+}
+
+// MatchAny - matches the first device found by one of matches
+func MatchAny(matches ...DeviceMatch) DeviceMatch {
+	return func() (string, bool) {
+		for _, match := range matches {
+			if device, found := match(); found {
+				return device, true
+			}
+		}
+		return "", false
+	}
+}
+
+// matches a disk found by match if it has no UUID in the guest, disks
+// with a UUID are found by MatchUUID
+func matchWithoutUUID(match DeviceMatch) DeviceMatch {
+	return func() (string, bool) {
+		device, found := match()
+		if !found {
+			return "", false
+		}
+		id, err := DeviceUUID(device)
+		return device, err == nil && id == ""
+	}
+}
+
+// matches once a device node is gone
+func matchGone(node string) DeviceMatch {
+	return func() (string, bool) {
+		_, err := os.Stat(node)
+		return node, os.IsNotExist(err)
+	}
+}
+
+// returns the /dev node of a device path
+func deviceNode(device string) (string, error) {
+	node, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return "", fmt.Errorf("Failed to find device %s: %v", device, err)
+	}
+	return node, nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseUevent(t *testing.T) {
+	msg := "add@/devices/pci0000:00/0000:00:15.0/0000:03:00.0/host2/target2:0:1/2:0:1:0/block/sdb\x00" +
+		"ACTION=add\x00DEVNAME=sdb\x00DEVTYPE=disk\x00SUBSYSTEM=block\x00"
+	event := parseUevent([]byte(msg))
+	if event["ACTION"] != "add" || event["DEVNAME"] != "sdb" || event["SUBSYSTEM"] != "block" {
+		t.Errorf("parseUevent(%q) = %v", msg, event)
+	}
+}
+
+func TestDeviceWaiter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, poll := range []bool{false, true} {
+		SetPolling(poll)
+		device := filepath.Join(dir, "disk")
+
+		// found without an event
+		waiter := NewDeviceWaiter("test")
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			ioutil.WriteFile(device, nil, 0644)
+		}()
+		found, err := waiter.waitFor(MatchPath(device), 5*time.Second)
+		if err != nil || found != device {
+			t.Errorf("poll=%t: waitFor = %q, %v, expected %q", poll, found, err, device)
+		}
+
+		// gone
+		os.Remove(device)
+		waiter = NewDeviceWaiter("test")
+		if _, err = waiter.waitFor(matchGone(device), time.Second); err != nil {
+			t.Errorf("poll=%t: waitFor gone device = %v", poll, err)
+		}
+
+		// timeout
+		waiter = NewDeviceWaiter("test")
+		start := time.Now()
+		if _, err = waiter.waitFor(MatchPath(device), 300*time.Millisecond); err == nil {
+			t.Errorf("poll=%t: waitFor a missing device succeeded", poll)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("poll=%t: timeout took %v", poll, elapsed)
+		}
+	}
+	SetPolling(false)
+}
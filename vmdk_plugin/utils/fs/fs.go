@@ -22,13 +22,13 @@ import (
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
-	"golang.org/x/exp/inotify"
-	"io"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/metrics"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -39,12 +39,26 @@ const (
 	pciAddrLen      = 10                       // Length of PCI dev addr
 	diskPathByDevID = "/dev/disk/by-id/wwn-0x" // Path for devices named by ID
 	scsiHostPath    = "/sys/class/scsi_host/"  // Path for scsi hosts
-	devWaitTimeout  = 10 * time.Second         // give it plenty of time to sense the attached disk
+	defaultDevWait  = 10 * time.Second         // give it plenty of time to sense the attached disk
 	bdevPath        = "/sys/block/"
 	deleteFile      = "/device/delete"
-	watchPath       = "/dev/disk/by-id"
 )
 
+// BLKFLSBUF ioctl, flush the buffer cache of a disk
+const blkFlushBufs = 0x1261
+
+// wait for an attached disk, as time.Duration, accessed atomically
+var devWaitTimeout = int64(defaultDevWait)
+
+// SetDevWaitTimeout - set how long to wait for an attached disk to show up,
+// the default is used if not positive
+func SetDevWaitTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultDevWait
+	}
+	atomic.StoreInt64(&devWaitTimeout, int64(timeout))
+}
+
 // FstypeDefault contains the default FS when not specified by the user
 const FstypeDefault = "ext4"
 
@@ -55,56 +69,11 @@ var BinSearchPath = []string{"/bin", "/sbin", "/usr/bin", "/usr/sbin"}
 type VolumeDevSpec struct {
 	Unit                    string
 	ControllerPciSlotNumber string
-}
-
-// DevAttachWaitPrep create the watcher.
-func DevAttachWaitPrep(name string, devPath string) (*inotify.Watcher, bool) {
-	watcher, errWatcher := inotify.NewWatcher()
-
-	if errWatcher != nil {
-		log.WithFields(log.Fields{"Name": name}).Error("Failed to create watcher. Skipping inotify ")
-		return nil, true
-	}
-
-	err := watcher.Watch(devPath)
-
-	if err != nil {
-		log.WithFields(log.Fields{
-			"Name": name, "path": devPath, "err": err.Error(),
-		}).Error("Failed to watch. Skipping inotify ")
-		return nil, true
-	}
-
-	return watcher, false
-}
-
-// DevAttachWait waits for attach operation to be completed
-func DevAttachWait(watcher *inotify.Watcher, name string, device string) {
-loop:
-	for {
-		select {
-		case ev := <-watcher.Event:
-			log.Debug("event: ", ev)
-			if ev.Name == device {
-				// Log when the device is discovered
-				log.WithFields(
-					log.Fields{"device": device, "event": ev},
-				).Info("Scan complete ")
-				break loop
-			}
-		case err := <-watcher.Error:
-			log.WithFields(
-				log.Fields{"device": device, "error": err},
-			).Error("Hit error during watch ")
-			break loop
-		case <-time.After(devWaitTimeout):
-			log.WithFields(
-				log.Fields{"timeout": devWaitTimeout, "device": device},
-			).Warning("Exceeded timeout while waiting for device attach to complete")
-			break loop
-		}
-	}
-	watcher.Close()
+	// pvscsi, lsisas or nvme, empty from older ESX services (PVSCSI)
+	ControllerType string
+	// UUID of the VMDK, seen as the disk WWN by the guest if the VM has
+	// disk.EnableUUID set. Empty from older ESX services.
+	DiskUUID string
 }
 
 // Mkdir creates a directory at the specified path
@@ -124,19 +93,51 @@ func Mkdir(path string) error {
 	return nil
 }
 
-// Mkfs creates a filesystem at the specified device
-func Mkfs(mkfscmd string, label string, device string) error {
+// max filesystem label length, mkfs fails or truncates longer labels
+var labelMaxLen = map[string]int{
+	"btrfs": 255,
+	"ext2":  16,
+	"ext3":  16,
+	"ext4":  16,
+	"xfs":   12,
+}
+
+// Label - returns the filesystem label for a volume, the volume name
+// without the datastore, truncated to what the filesystem allows
+func Label(fstype string, name string) string {
+	label := name
+	if at := strings.LastIndex(label, "@"); at >= 0 {
+		label = label[:at]
+	}
+	if max, ok := labelMaxLen[fstype]; ok && len(label) > max {
+		label = label[:max]
+	}
+	return label
+}
+
+// Mkfs creates a filesystem at the specified device, labeled with the
+// volume name (see Label), args are extra options of the mkfs command
+func Mkfs(mkfscmd string, name string, device string, args ...string) error {
 	var err error
 	var out []byte
 
+	fstype := strings.Split(mkfscmd, ".")[1]
+	label := Label(fstype, name)
+	if label != name {
+		log.WithFields(log.Fields{
+			"name": name, "label": label, "fstype": fstype,
+		}).Debug("Volume name doesn't fit in the filesystem label, truncated ")
+	}
+	start := time.Now()
 	// Workaround older versions of e2fsprogs, issue 629.
 	// If mkfscmd is of an ext* filesystem use -F flag
 	// to avoid having mkfs command to expect user confirmation.
-	if strings.Split(mkfscmd, ".")[1][0:3] == "ext" {
-		out, err = exec.Command(mkfscmd, "-F", "-L", label, device).CombinedOutput()
-	} else {
-		out, err = exec.Command(mkfscmd, "-L", label, device).CombinedOutput()
+	args = append(args, "-L", label, device)
+	if fstype[0:3] == "ext" {
+		args = append([]string{"-F"}, args...)
 	}
+	out, err = exec.Command(mkfscmd, args...).CombinedOutput()
+	metrics.MkfsDuration.ObserveSince(start, fstype)
 	if err != nil {
 		return fmt.Errorf("Failed to create filesystem on %s: %s. Output = %s",
 			device, err, out)
@@ -159,23 +160,55 @@ func MkfsLookup() map[string]string {
 
 // Mount the filesystem (`fs`) on the device at the given mount point.
 func Mount(mountpoint string, fstype string, device string, isReadOnly bool) error {
+	return MountWithOptions(mountpoint, fstype, device, isReadOnly, "")
+}
+
+// MountWithOptions - mount the filesystem on the device with filesystem
+// specific options, comma separated
+func MountWithOptions(mountpoint string, fstype string, device string, isReadOnly bool, options string) error {
 	log.WithFields(log.Fields{
 		"device":     device,
 		"fstype":     fstype,
 		"mountpoint": mountpoint,
+		"options":    options,
 	}).Debug("Calling syscall.Mount() ")
 
 	flags := 0
 	if isReadOnly {
 		flags = syscall.MS_RDONLY
 	}
-	err := syscall.Mount(device, mountpoint, fstype, uintptr(flags), "")
+	err := syscall.Mount(device, mountpoint, fstype, uintptr(flags), options)
 	if err != nil {
 		return fmt.Errorf("Failed to mount device %s at %s: %s", device, mountpoint, err)
 	}
 	return nil
 }
 
+// MountBind - bind mounts the directory dir at mountpoint, read-only if
+// isReadOnly
+func MountBind(mountpoint string, dir string, isReadOnly bool) error {
+	log.WithFields(log.Fields{
+		"dir":        dir,
+		"mountpoint": mountpoint,
+		"read-only":  isReadOnly,
+	}).Debug("Bind mounting directory ")
+
+	err := syscall.Mount(dir, mountpoint, "", syscall.MS_BIND, "")
+	if err != nil {
+		return fmt.Errorf("Failed to bind mount %s at %s: %s", dir, mountpoint, err)
+	}
+	if !isReadOnly {
+		return nil
+	}
+	// a bind mount is made read-only by a remount
+	err = syscall.Mount("", mountpoint, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+	if err != nil {
+		syscall.Unmount(mountpoint, 0)
+		return fmt.Errorf("Failed to make the bind mount at %s read-only: %s", mountpoint, err)
+	}
+	return nil
+}
+
 // MountWithID - mount device with ID
 func MountWithID(mountpoint string, fstype string, id string, isReadOnly bool) error {
 	log.WithFields(log.Fields{
@@ -204,13 +237,17 @@ func MountWithID(mountpoint string, fstype string, id string, isReadOnly bool) e
 	return nil
 }
 
-// Unmount a device from the given mount point.
+// Unmount a device from the given mount point. The file a raw device was
+// bind mounted on is removed.
 func Unmount(mountPoint string) error {
 	err := syscall.Unmount(mountPoint, 0)
 	if err != nil {
 		return fmt.Errorf("Unmount device at %s failed: %s",
 			mountPoint, err)
 	}
+	if stat, err := os.Lstat(mountPoint); err == nil && stat.Mode().IsRegular() {
+		os.Remove(mountPoint)
+	}
 	return nil
 }
 
@@ -218,40 +255,22 @@ func makeDevicePathWithID(id string) string {
 	return diskPathByDevID + strings.Join(strings.Split(id, "-"), "")
 }
 
-// GetDevicePathByID - return full path for device with given ID
+// GetDevicePathByID - return full path for device with given ID. The
+// virtual SCSI controllers are only rescanned if the device isn't there yet.
 func GetDevicePathByID(id string) (string, error) {
-	hosts, err := ioutil.ReadDir(scsiHostPath)
-	if err != nil {
-		return "", err
-	}
-	time.Sleep(10)
-	for _, host := range hosts {
-		//Scan so we may have the device before attempting a mount
-		scanHost := scsiHostPath + host.Name() + "/scan"
-		bytes := []byte("- - -")
-		log.WithFields(log.Fields{"disk id": id, "scan cmd": scanHost}).Info("Rescanning ... ")
-		err = ioutil.WriteFile(scanHost, bytes, 0644)
-		if err != nil {
-			return "", err
-		}
-	}
-
-	watcher, skipInotify := DevAttachWaitPrep(id, watchPath)
-
-	device := makeDevicePathWithID(id)
-
-	if skipInotify {
-		time.Sleep(10)
-	} else {
-		// Wait for the attach to complete, may timeout
-		// in which case we continue creating the file system.
-		DevAttachWait(watcher, id, device)
+	waiter := NewDeviceWaiter(id)
+	match := MatchAny(MatchUUID(id), MatchPath(makeDevicePathWithID(id)))
+	if device, found := match(); found {
+		waiter.Close()
+		return device, nil
 	}
-	_, err = os.Stat(device)
-	if err != nil {
+	log.WithFields(log.Fields{"disk id": id}).Info("Disk not found, rescanning the SCSI controllers ")
+	if err := rescanVirtualControllers(); err != nil {
+		waiter.Close()
 		return "", err
 	}
-	return device, nil
+
+	return waiter.Wait(match)
 }
 
 // DeleteDevicePathWithID - delete device with given ID
@@ -275,37 +294,101 @@ func DeleteDevicePathWithID(id string) error {
 	return nil
 }
 
-// GetDevicePath - return device path or error
-func GetDevicePath(str []byte) (string, error) {
+// RemoveDevice - removes a disk from the guest before it is detached, so
+// no stale device node is left for udev to race with on the next attach.
+// Flushes the buffers of the disk, deletes the SCSI device and waits for
+// the device node to go away. The disk must not be mounted.
+func RemoveDevice(device string) error {
+	node, err := deviceNode(device)
+	if err != nil {
+		return err
+	}
+
+	err = flushDevice(node)
+	if err != nil {
+		return err
+	}
+
+	waiter := NewDeviceWaiter(node)
+	deleteNode := bdevPath + filepath.Base(node) + deleteFile
+	log.WithFields(log.Fields{"device": node, "node": deleteNode}).Debug("Deleting device ")
+	err = ioutil.WriteFile(deleteNode, []byte("1"), 0644)
+	if err != nil {
+		waiter.Close()
+		return fmt.Errorf("Failed to delete device %s: %v", node, err)
+	}
+	timeout := time.Duration(atomic.LoadInt64(&devWaitTimeout))
+	_, err = waiter.waitFor(matchGone(node), timeout)
+	return err
+}
+
+// writes the dirty buffers of a disk and drops its buffer cache
+func flushDevice(node string) error {
+	f, err := os.Open(node)
+	if err != nil {
+		return fmt.Errorf("Failed to open device %s: %v", node, err)
+	}
+	defer f.Close()
+
+	err = f.Sync()
+	if err != nil {
+		return fmt.Errorf("Failed to sync device %s: %v", node, err)
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), blkFlushBufs, 0)
+	if errno != 0 {
+		return fmt.Errorf("Failed to flush buffers of device %s: %v", node, errno)
+	}
+	return nil
+}
+
+// GetAttachedDevice - waits for the disk attached by ESX, as described by
+// the attach response, and returns its device path. The disk is found by
+// its UUID, or by controller slot and unit with older ESX services and VMs
+// without disk.EnableUUID. Only the target of the disk is rescanned. The
+// device is checked to be the attached disk, by its UUID or else by its
+// filesystem label, one of labels (see VerifyDevice). The waiter is closed.
+func GetAttachedDevice(name string, labels []string, str []byte, waiter *DeviceWaiter) (string, error) {
 	var volDev VolumeDevSpec
 	err := json.Unmarshal(str, &volDev)
-	if err != nil && len(err.Error()) != 0 {
+	if err != nil {
+		waiter.Close()
 		return "", err
 	}
 
-	// Get the device node for the unit returned from the attach.
-	// Lookup each device that has a label and if that label matches
-	// the one for the given bus number.
-	// The device we need is then constructed from the dir name with
-	// the matching label.
-	pciSlotAddr := fmt.Sprintf("%s/%s/address", sysPciSlots, volDev.ControllerPciSlotNumber)
+	pciDev, slotErr := controllerPciDevice(volDev)
+	var match DeviceMatch
+	if volDev.DiskUUID != "" {
+		match = MatchUUID(volDev.DiskUUID)
+		// the guest only sees the UUID if the VM has disk.EnableUUID
+		if slotErr == nil {
+			match = MatchAny(match, matchWithoutUUID(matchSlot(volDev, pciDev)))
+		}
+	} else {
+		if slotErr != nil {
+			waiter.Close()
+			return "", slotErr
+		}
+		match = matchSlot(volDev, pciDev)
+	}
 
-	fh, err := os.Open(pciSlotAddr)
+	if _, found := match(); !found && slotErr == nil {
+		rescanTarget(volDev, pciDev)
+	}
+	device, err := waiter.Wait(match)
 	if err != nil {
-		log.WithFields(log.Fields{"Error": err}).Warn("Get device path failed for unit# %s @ PCI slot %s: ",
-			volDev.Unit, volDev.ControllerPciSlotNumber)
-		return "", fmt.Errorf("Device not found")
+		return "", err
 	}
-
-	buf := make([]byte, pciAddrLen)
-	_, err = fh.Read(buf)
-
-	fh.Close()
-	if err != nil && err != io.EOF {
-		log.WithFields(log.Fields{"Error": err}).Warn("Get device path failed for unit# %s @ PCI slot %s: ",
-			volDev.Unit, volDev.ControllerPciSlotNumber)
-		return "", fmt.Errorf("Device not found")
+	if volDev.DiskUUID != "" {
+		if id, err := DeviceUUID(device); err == nil && id == "" {
+			log.WithFields(log.Fields{
+				"name": name, "uuid": volDev.DiskUUID, "device": device,
+			}).Info("Disk has no UUID in the guest, is disk.EnableUUID set for the VM? Found it by PCI slot and unit ")
+		}
 	}
-	return fmt.Sprintf("/dev/disk/by-path/pci-%s.0-scsi-0:0:%s:0", string(buf), volDev.Unit), nil
 
+	err = VerifyDevice(device, volDev.DiskUUID, labels)
+	if err != nil {
+		return "", err
+	}
+	return device, nil
 }
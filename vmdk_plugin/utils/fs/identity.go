@@ -0,0 +1,167 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Disk identity checks. A VMDK UUID is the WWN of the disk in the guest
+// (if the VM has disk.EnableUUID set), it tells whether a device node is
+// the disk of a volume before it is formatted or mounted. Without it, the
+// filesystem label written by Mkfs is checked.
+
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	wwidFile          = "/device/wwid" // in /sys/block/<dev>
+	naaPrefix         = "naa."         // wwid of disks with a WWN
+	blkidNothingFound = 2              // blkid exit code when nothing is found
+	fsNone            = "none"
+)
+
+// DevicePathByUUID - the /dev/disk/by-id path of the disk with a VMDK UUID
+func DevicePathByUUID(uuid string) string {
+	return diskPathByDevID + normalizeUUID(uuid)
+}
+
+// UUIDs are shown with dashes or spaces and in any case, e.g.
+// "6000C29d-8f2e-..." on ESX and "naa.6000c29d8f2e..." in the guest
+func normalizeUUID(uuid string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(uuid))
+}
+
+// DeviceUUID - the UUID the guest sees for a disk device, empty if the
+// disk has none (the VM doesn't have disk.EnableUUID)
+func DeviceUUID(device string) (string, error) {
+	node, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return "", err
+	}
+	wwid, err := ioutil.ReadFile(bdevPath + filepath.Base(node) + wwidFile)
+	if err != nil {
+		return "", err
+	}
+	id := strings.TrimSpace(string(wwid))
+	if !strings.HasPrefix(id, naaPrefix) {
+		return "", nil
+	}
+	return normalizeUUID(strings.TrimPrefix(id, naaPrefix)), nil
+}
+
+// VerifyDevice - checks that device is the disk with the VMDK UUID. If the
+// UUID isn't known or the guest doesn't see it, the filesystem label must
+// be one of labels instead. Disks are accepted unchecked if labels is
+// empty, for new and raw disks.
+func VerifyDevice(device string, uuid string, labels []string) error {
+	if uuid != "" {
+		found, err := DeviceUUID(device)
+		if err != nil {
+			return fmt.Errorf("Failed to check the identity of device %s: %v", device, err)
+		}
+		if found != "" {
+			if found != normalizeUUID(uuid) {
+				return fmt.Errorf("Device %s is disk %s, not the attached disk %s, refusing to use it",
+					device, found, normalizeUUID(uuid))
+			}
+			return nil
+		}
+	}
+	if len(labels) == 0 {
+		log.WithFields(log.Fields{
+			"device": device, "uuid": uuid,
+		}).Debug("Disk has no UUID in the guest, identity not checked ")
+		return nil
+	}
+	label, err := GetLabel(device)
+	if err != nil {
+		return fmt.Errorf("Failed to check the identity of device %s: %v", device, err)
+	}
+	for _, expected := range labels {
+		if label == expected {
+			return nil
+		}
+	}
+	return fmt.Errorf("Device %s has a filesystem labeled %q, not %q of the volume, refusing to use it",
+		device, label, labels[0])
+}
+
+// VolumeLabels - the labels the filesystem of a volume may have, the one
+// Mkfs writes and the full name, written by older plugins, truncated
+func VolumeLabels(fstype string, name string) []string {
+	labels := []string{Label(fstype, name)}
+	legacy := name
+	if max, ok := labelMaxLen[fstype]; ok && len(legacy) > max {
+		legacy = legacy[:max]
+	}
+	if legacy != labels[0] {
+		labels = append(labels, legacy)
+	}
+	return labels
+}
+
+// GetLabel - the label of the filesystem on device, empty if it has none
+func GetLabel(device string) (string, error) {
+	out, err := exec.Command("blkid", "-p", "-o", "value", "-s", "LABEL", device).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == blkidNothingFound {
+			return "", nil
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to probe device %s: %v", device, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// GetFilesystem - the type of the filesystem (or other signature, like a
+// partition table) on device, "none" if the device is blank
+func GetFilesystem(device string) (string, error) {
+	out, err := exec.Command("blkid", "-p", "-o", "value", "-s", "TYPE", device).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == blkidNothingFound {
+			return fsNone, nil
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to probe device %s: %v", device, err)
+	}
+	fstype := strings.TrimSpace(string(out))
+	if fstype == "" {
+		// a signature without a type, e.g. a partition table
+		fstype = "unknown"
+	}
+	return fstype, nil
+}
+
+// CheckBlank - checks that a new disk has no filesystem before mkfs, a
+// device with data is another disk than the one just created
+func CheckBlank(device string) error {
+	fstype, err := GetFilesystem(device)
+	if err != nil {
+		return err
+	}
+	if fstype != fsNone {
+		return fmt.Errorf("Device %s already has a %s filesystem, refusing to format it", device, fstype)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestVolumeLabels(t *testing.T) {
+	tests := []struct {
+		fstype string
+		name   string
+		labels []string
+	}{
+		{"ext4", "vol1", []string{"vol1"}},
+		{"ext4", "vol1@ds1", []string{"vol1", "vol1@ds1"}},
+		{"ext4", "vol1@datastore-with-long-name", []string{"vol1", "vol1@datastore-w"}},
+		{"xfs", "a-long-volume-name@ds1", []string{"a-long-volum"}},
+	}
+	for _, test := range tests {
+		if labels := VolumeLabels(test.fstype, test.name); !reflect.DeepEqual(labels, test.labels) {
+			t.Errorf("VolumeLabels(%s, %s) = %v, expected %v", test.fstype, test.name, labels, test.labels)
+		}
+	}
+}
+
+// a disk without UUID in the guest is checked by its filesystem label
+func TestVerifyDeviceWithoutUUID(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 is missing")
+	}
+	if _, err := exec.LookPath("blkid"); err != nil {
+		t.Skip("blkid is missing")
+	}
+	file, err := ioutil.TempFile("", "identity_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := file.Name()
+	defer os.Remove(image)
+	err = file.Truncate(32 * 1024 * 1024)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a blank disk can't be told apart
+	if err = VerifyDevice(image, "", VolumeLabels("ext4", "vol1@ds1")); err == nil {
+		t.Errorf("VerifyDevice accepted a blank disk for vol1")
+	}
+	if err = VerifyDevice(image, "", nil); err != nil {
+		t.Errorf("VerifyDevice without labels = %v", err)
+	}
+
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", "-L", Label("ext4", "vol1@ds1"), image).CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.ext4 failed: %v %s", err, out)
+	}
+	if err = VerifyDevice(image, "", VolumeLabels("ext4", "vol1@ds1")); err != nil {
+		t.Errorf("VerifyDevice of the disk of vol1 = %v", err)
+	}
+	if err = VerifyDevice(image, "", VolumeLabels("ext4", "vol2@ds1")); err == nil {
+		t.Errorf("VerifyDevice accepted the disk of vol1 for vol2")
+	}
+}
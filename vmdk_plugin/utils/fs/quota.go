@@ -0,0 +1,132 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Project quotas of XFS and ext4. A directory gets a project ID, inherited
+// by everything created in it, and the blocks of the project are limited
+// on the filesystem. statfs of the directory reports the project limit as
+// the filesystem size.
+
+package fs
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// ProjectQuotaOption - mount option enforcing project quotas, for XFS
+	// and ext4
+	ProjectQuotaOption = "prjquota"
+
+	// FS_IOC_FSGETXATTR and FS_IOC_FSSETXATTR ioctls, struct fsxattr
+	fsIocFsgetxattr = 0x801c581f
+	fsIocFssetxattr = 0x401c5820
+	// FS_XFLAG_PROJINHERIT, new files get the project ID of the directory
+	fsXflagProjinherit = 0x200
+
+	// quotactl(QCMD(Q_SETQUOTA, PRJQUOTA)), struct if_dqblk
+	qSetQuota   = 0x800008
+	prjQuota    = 2
+	qifBlimits  = 1
+	qifBlockLen = 1024
+)
+
+// ProjectQuotaMkfsArgs - mkfs options for a filesystem with project quotas,
+// XFS has them with any mkfs
+var ProjectQuotaMkfsArgs = map[string][]string{
+	"ext4": {"-O", "quota,project"},
+	"xfs":  nil,
+}
+
+// struct fsxattr
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+// struct if_dqblk
+type ifDqblk struct {
+	bhardlimit uint64
+	bsoftlimit uint64
+	curspace   uint64
+	ihardlimit uint64
+	isoftlimit uint64
+	curinodes  uint64
+	btime      uint64
+	itime      uint64
+	valid      uint32
+}
+
+func dirXattr(dir string, request uintptr, attr *fsxattr) error {
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(unsafe.Pointer(attr)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// ProjectID - the project ID of a directory
+func ProjectID(dir string) (uint32, error) {
+	var attr fsxattr
+	if err := dirXattr(dir, fsIocFsgetxattr, &attr); err != nil {
+		return 0, fmt.Errorf("Failed to get the project of %s: %v", dir, err)
+	}
+	return attr.projid, nil
+}
+
+// SetProjectID - sets the project ID of a directory, inherited by the files
+// created in it
+func SetProjectID(dir string, id uint32) error {
+	var attr fsxattr
+	err := dirXattr(dir, fsIocFsgetxattr, &attr)
+	if err == nil {
+		attr.projid = id
+		attr.xflags |= fsXflagProjinherit
+		err = dirXattr(dir, fsIocFssetxattr, &attr)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to set the project of %s: %v", dir, err)
+	}
+	return nil
+}
+
+// SetProjectQuota - limits the blocks of the project on the filesystem of
+// device to limit bytes, 0 removes the limit
+func SetProjectQuota(device string, id uint32, limit uint64) error {
+	special, err := syscall.BytePtrFromString(device)
+	if err != nil {
+		return err
+	}
+	// limits are in 1KB blocks, rounded up
+	blocks := (limit + qifBlockLen - 1) / qifBlockLen
+	dq := ifDqblk{bhardlimit: blocks, bsoftlimit: blocks, valid: qifBlimits}
+	_, _, errno := syscall.Syscall6(syscall.SYS_QUOTACTL, uintptr(qSetQuota<<8|prjQuota),
+		uintptr(unsafe.Pointer(special)), uintptr(id), uintptr(unsafe.Pointer(&dq)), 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("Failed to set the quota of project %d on %s: %v", id, device, errno)
+	}
+	return nil
+}
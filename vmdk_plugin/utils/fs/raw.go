@@ -0,0 +1,134 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Raw block volumes. A raw volume has no filesystem, the device node of its
+// disk is bind mounted on a file at the volume mount point, and Docker
+// bind mounts that into the container. It shows in /proc/mounts like a
+// mounted filesystem, so refcounting and recovery find it the same way.
+
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// BLKROSET ioctl, make a disk read-only
+	blkSetReadOnly = 0x125D
+	sysDevBlock    = "/sys/dev/block"
+)
+
+// MountRaw - bind mounts the device node of a raw volume at mountpoint, a
+// file created if needed. A read-only volume gets a read-only disk, a
+// read-only mount doesn't stop writes to a device node.
+func MountRaw(mountpoint string, device string, isReadOnly bool) error {
+	log.WithFields(log.Fields{
+		"device":     device,
+		"mountpoint": mountpoint,
+		"read-only":  isReadOnly,
+	}).Debug("Bind mounting raw device ")
+
+	node, err := deviceNode(device)
+	if err != nil {
+		return err
+	}
+	err = mkMountFile(mountpoint)
+	if err != nil {
+		return err
+	}
+	if isReadOnly {
+		err = setReadOnly(node)
+		if err != nil {
+			return err
+		}
+	}
+	err = syscall.Mount(node, mountpoint, "", syscall.MS_BIND, "")
+	if err != nil {
+		return fmt.Errorf("Failed to bind mount device %s at %s: %s", node, mountpoint, err)
+	}
+	return nil
+}
+
+// RawDevice - the /dev node of the disk bind mounted at the mount point of
+// a raw volume, an error if mountpoint isn't a block device
+func RawDevice(mountpoint string) (string, error) {
+	var st syscall.Stat_t
+	err := syscall.Stat(mountpoint, &st)
+	if err != nil {
+		return "", err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return "", fmt.Errorf("%s is not a block device", mountpoint)
+	}
+	rdev := uint64(st.Rdev)
+	major := (rdev>>8)&0xfff | (rdev>>32)&^0xfff
+	minor := rdev&0xff | (rdev>>12)&^0xff
+	link, err := os.Readlink(fmt.Sprintf("%s/%d:%d", sysDevBlock, major, minor))
+	if err != nil {
+		return "", fmt.Errorf("Failed to find the device of %s: %v", mountpoint, err)
+	}
+	return "/dev/" + filepath.Base(link), nil
+}
+
+// creates the file a raw device is bind mounted on. An empty directory
+// left by a volume with a filesystem is replaced.
+func mkMountFile(path string) error {
+	stat, err := os.Lstat(path)
+	if err == nil && stat.IsDir() {
+		err = os.Remove(path)
+		if err != nil {
+			return fmt.Errorf("%v is a directory and can't be replaced: %v", path, err)
+		}
+		err = os.ErrNotExist
+	}
+	if os.IsNotExist(err) {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	if !stat.Mode().IsRegular() && stat.Mode()&os.ModeDevice == 0 {
+		return fmt.Errorf("%v already exist and it's not a file", path)
+	}
+	return nil
+}
+
+// makes a disk read-only until it is removed from the guest
+func setReadOnly(node string) error {
+	f, err := os.Open(node)
+	if err != nil {
+		return fmt.Errorf("Failed to open device %s: %v", node, err)
+	}
+	defer f.Close()
+
+	readOnly := int32(1)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), blkSetReadOnly, uintptr(unsafe.Pointer(&readOnly)))
+	if errno != 0 {
+		return fmt.Errorf("Failed to make device %s read-only: %v", node, errno)
+	}
+	return nil
+}
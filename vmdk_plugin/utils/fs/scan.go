@@ -0,0 +1,165 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Disk lookup by controller slot. ESX reports the PCI slot of the
+// controller a disk is attached to, the controller type and the unit.
+// The disk is looked up in sysfs under that controller, and only that
+// target (or NVMe controller) is rescanned if it doesn't show up by itself.
+
+package fs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Controller types reported by ESX, an empty type is PVSCSI
+const (
+	controllerPvscsi = "pvscsi"
+	controllerLsiSas = "lsisas"
+	controllerNvme   = "nvme"
+)
+
+// disks of a target in sysfs, under the PCI device of a SCSI controller.
+// SAS targets are under a port and an end device.
+var scsiDiskPatterns = []string{
+	"%s/host*/target*:0:%s/*:0:%s:0/block/*",
+	"%s/host*/port-*/end_device-*/target*:0:%s/*:0:%s:0/block/*",
+}
+
+// drivers of the SCSI controllers of a VM, as in the proc_name of their
+// SCSI hosts: PVSCSI and the LSI Logic parallel and SAS controllers
+var virtualScsiDrivers = []string{"vmw_pvscsi", "mptspi", "mptsas"}
+
+// returns the sysfs PCI device of the controller of an attached disk
+func controllerPciDevice(volDev VolumeDevSpec) (string, error) {
+	pciSlotAddr := fmt.Sprintf("%s/%s/address", sysPciSlots, volDev.ControllerPciSlotNumber)
+
+	fh, err := os.Open(pciSlotAddr)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Warnf("Get device path failed for unit# %s @ PCI slot %s: ",
+			volDev.Unit, volDev.ControllerPciSlotNumber)
+		return "", fmt.Errorf("Device not found")
+	}
+
+	buf := make([]byte, pciAddrLen)
+	_, err = fh.Read(buf)
+
+	fh.Close()
+	if err != nil && err != io.EOF {
+		log.WithFields(log.Fields{"Error": err}).Warnf("Get device path failed for unit# %s @ PCI slot %s: ",
+			volDev.Unit, volDev.ControllerPciSlotNumber)
+		return "", fmt.Errorf("Device not found")
+	}
+	return fmt.Sprintf("%s/%s.0", sysPciDevs, string(buf)), nil
+}
+
+// matches the disk at the unit of volDev on the controller at pciDev, as
+// /dev/<disk>. NVMe disks are namespace unit+1.
+func matchSlot(volDev VolumeDevSpec, pciDev string) DeviceMatch {
+	var patterns []string
+	if volDev.ControllerType == controllerNvme {
+		unit, err := strconv.Atoi(volDev.Unit)
+		if err == nil {
+			patterns = append(patterns, fmt.Sprintf("%s/nvme/nvme*/nvme*n%d", pciDev, unit+1))
+		}
+	} else {
+		for _, pattern := range scsiDiskPatterns {
+			patterns = append(patterns, fmt.Sprintf(pattern, pciDev, volDev.Unit, volDev.Unit))
+		}
+	}
+
+	return func() (string, bool) {
+		for _, pattern := range patterns {
+			disks, _ := filepath.Glob(pattern)
+			if len(disks) != 1 {
+				continue
+			}
+			device := "/dev/" + filepath.Base(disks[0])
+			if _, err := os.Stat(device); err == nil {
+				return device, true
+			}
+		}
+		return "", false
+	}
+}
+
+// rescans the target of the disk at the unit of volDev on the controller
+// at pciDev, or the namespaces of an NVMe controller, not every SCSI host
+func rescanTarget(volDev VolumeDevSpec, pciDev string) {
+	var files []string
+	var cmd string
+	if volDev.ControllerType == controllerNvme {
+		files, _ = filepath.Glob(pciDev + "/nvme/nvme*/rescan_controller")
+		cmd = "1"
+	} else {
+		hosts, _ := filepath.Glob(pciDev + "/host*")
+		for _, host := range hosts {
+			files = append(files, scsiHostPath+filepath.Base(host)+"/scan")
+		}
+		// channel, target, lun
+		cmd = fmt.Sprintf("0 %s 0", volDev.Unit)
+	}
+
+	for _, file := range files {
+		log.WithFields(log.Fields{"scan cmd": file, "target": cmd}).Debug("Rescanning ... ")
+		err := ioutil.WriteFile(file, []byte(cmd), 0644)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"scan cmd": file, "error": err,
+			}).Warning("Failed to rescan the controller of the attached disk ")
+		}
+	}
+}
+
+// rescans the SCSI hosts of the virtual controllers, for a disk whose
+// controller and target aren't known (Photon doesn't report them). Other
+// SCSI hosts, iSCSI or USB storage, aren't rescanned.
+func rescanVirtualControllers() error {
+	hosts, err := ioutil.ReadDir(scsiHostPath)
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		procName, err := ioutil.ReadFile(scsiHostPath + host.Name() + "/proc_name")
+		if err != nil || !isVirtualScsiDriver(strings.TrimSpace(string(procName))) {
+			continue
+		}
+		scanHost := scsiHostPath + host.Name() + "/scan"
+		log.WithFields(log.Fields{"scan cmd": scanHost}).Info("Rescanning ... ")
+		// channel, target, lun wildcards
+		if err = ioutil.WriteFile(scanHost, []byte("- - -"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isVirtualScsiDriver(driver string) bool {
+	for _, d := range virtualScsiDrivers {
+		if d == driver {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Trim (discard) of the free space of a mounted filesystem, like fstrim
+// does, so a thin disk gives the blocks of deleted files back to the
+// datastore. Trims are done by range, for callers to limit the rate.
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// FITRIM ioctl, _IOWR('X', 121, struct fstrim_range)
+const fitrim = 0xc0185879
+
+// ErrTrimNotSupported - the filesystem or the disk doesn't support discard
+var ErrTrimNotSupported = errors.New("trim isn't supported by the filesystem or the disk")
+
+// struct fstrim_range
+type fstrimRange struct {
+	start  uint64
+	length uint64
+	minLen uint64
+}
+
+// FilesystemSize - size in bytes of the filesystem mounted at mountpoint
+func FilesystemSize(mountpoint string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(mountpoint, &st); err != nil {
+		return 0, fmt.Errorf("Failed to get the size of the filesystem at %s: %v", mountpoint, err)
+	}
+	return st.Blocks * uint64(st.Bsize), nil
+}
+
+// TrimRange - trims the free space of the filesystem mounted at mountpoint
+// in length bytes from start. Returns the bytes trimmed.
+func TrimRange(mountpoint string, start uint64, length uint64) (uint64, error) {
+	f, err := os.Open(mountpoint)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := fstrimRange{start: start, length: length}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fitrim, uintptr(unsafe.Pointer(&r)))
+	switch errno {
+	case 0:
+		// the kernel sets length to the bytes trimmed
+		return r.length, nil
+	case syscall.EOPNOTSUPP, syscall.ENOTTY:
+		return 0, ErrTrimNotSupported
+	}
+	return 0, fmt.Errorf("Trim of %s failed: %v", mountpoint, errno)
+}
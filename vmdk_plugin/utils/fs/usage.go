@@ -0,0 +1,186 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Usage of mounted volumes, from statfs on the mount point and the I/O
+// counters the kernel keeps for the disk in /sys/block/<dev>/stat.
+
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	statFile   = "/stat" // in /sys/block/<dev>
+	sizeFile   = "/size"
+	sectorSize = 512 // unit of the sector counts in /sys/block, whatever the disk
+
+	mountReadOnly = 0x0001 // ST_RDONLY statfs flag
+)
+
+// statfs mount flags (ST_*), in the order mount shows them
+var mountFlags = []struct {
+	flag int64
+	name string
+}{
+	{0x0002, "nosuid"},
+	{0x0004, "nodev"},
+	{0x0008, "noexec"},
+	{0x0010, "sync"},
+	{0x0040, "mand"},
+	{0x0400, "noatime"},
+	{0x0800, "nodiratime"},
+	{0x1000, "relatime"},
+}
+
+// VolumeUsage - usage of a mounted volume
+type VolumeUsage struct {
+	Device string `json:"device"`
+	// nil for raw volumes, which have no filesystem
+	Filesystem *FilesystemUsage `json:"filesystem,omitempty"`
+	// nil if the disk isn't found in /sys/block
+	Disk *DiskStats `json:"disk,omitempty"`
+}
+
+// FilesystemUsage - space and inodes of a mounted filesystem
+type FilesystemUsage struct {
+	SizeBytes uint64 `json:"sizeBytes"`
+	UsedBytes uint64 `json:"usedBytes"`
+	// available to containers not running as root, as df shows
+	FreeBytes  uint64   `json:"freeBytes"`
+	Inodes     uint64   `json:"inodes"`
+	InodesUsed uint64   `json:"inodesUsed"`
+	InodesFree uint64   `json:"inodesFree"`
+	ReadOnly   bool     `json:"readOnly"`
+	MountFlags []string `json:"mountFlags"`
+}
+
+// DiskStats - size and I/O counters of a disk since it was attached
+type DiskStats struct {
+	SizeBytes   uint64 `json:"sizeBytes"`
+	Reads       uint64 `json:"reads"`
+	ReadBytes   uint64 `json:"readBytes"`
+	ReadTimeMs  uint64 `json:"readTimeMs"`
+	Writes      uint64 `json:"writes"`
+	WriteBytes  uint64 `json:"writeBytes"`
+	WriteTimeMs uint64 `json:"writeTimeMs"`
+	InFlight    uint64 `json:"inFlight"`
+	IOTimeMs    uint64 `json:"ioTimeMs"`
+}
+
+// GetUsage - usage of the volume mounted at mountpoint from device. The
+// filesystem isn't looked at for raw volumes.
+func GetUsage(mountpoint string, device string, raw bool) (*VolumeUsage, error) {
+	usage := &VolumeUsage{Device: device}
+	if !raw {
+		fsUsage, err := GetFilesystemUsage(mountpoint)
+		if err != nil {
+			return nil, err
+		}
+		usage.Filesystem = fsUsage
+	}
+	if disk, err := GetDiskStats(device); err == nil {
+		usage.Disk = disk
+	}
+	return usage, nil
+}
+
+// GetFilesystemUsage - statfs of the filesystem mounted at mountpoint
+func GetFilesystemUsage(mountpoint string) (*FilesystemUsage, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(mountpoint, &st)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the usage of %s: %v", mountpoint, err)
+	}
+	blockSize := uint64(st.Frsize)
+	if blockSize == 0 {
+		blockSize = uint64(st.Bsize)
+	}
+	usage := &FilesystemUsage{
+		SizeBytes:  st.Blocks * blockSize,
+		UsedBytes:  (st.Blocks - st.Bfree) * blockSize,
+		FreeBytes:  st.Bavail * blockSize,
+		Inodes:     st.Files,
+		InodesUsed: st.Files - st.Ffree,
+		InodesFree: st.Ffree,
+		ReadOnly:   int64(st.Flags)&mountReadOnly != 0,
+		MountFlags: []string{"rw"},
+	}
+	if usage.ReadOnly {
+		usage.MountFlags[0] = "ro"
+	}
+	for _, f := range mountFlags {
+		if int64(st.Flags)&f.flag != 0 {
+			usage.MountFlags = append(usage.MountFlags, f.name)
+		}
+	}
+	return usage, nil
+}
+
+// GetDiskStats - size and I/O counters of the disk of device
+func GetDiskStats(device string) (*DiskStats, error) {
+	node, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return nil, err
+	}
+	dir := bdevPath + filepath.Base(node)
+	stat, err := ioutil.ReadFile(dir + statFile)
+	if err != nil {
+		return nil, err
+	}
+	disk, err := parseDiskStats(string(stat))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", dir+statFile, err)
+	}
+	if size, err := ioutil.ReadFile(dir + sizeFile); err == nil {
+		sectors, _ := strconv.ParseUint(strings.TrimSpace(string(size)), 10, 64)
+		disk.SizeBytes = sectors * sectorSize
+	}
+	return disk, nil
+}
+
+// parses /sys/block/<dev>/stat: reads, merged reads, sectors read, read
+// ms, writes, merged writes, sectors written, write ms, in flight, io ms,
+// then fields newer kernels add
+func parseDiskStats(stat string) (*DiskStats, error) {
+	fields := strings.Fields(stat)
+	if len(fields) < 11 {
+		return nil, fmt.Errorf("expected at least 11 fields, found %d", len(fields))
+	}
+	values := make([]uint64, 11)
+	for i := range values {
+		value, err := strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return &DiskStats{
+		Reads:       values[0],
+		ReadBytes:   values[2] * sectorSize,
+		ReadTimeMs:  values[3],
+		Writes:      values[4],
+		WriteBytes:  values[6] * sectorSize,
+		WriteTimeMs: values[7],
+		InFlight:    values[8],
+		IOTimeMs:    values[9],
+	}, nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package fs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseDiskStats(t *testing.T) {
+	stat := "    1200      30    96000     450     800      12    64000     900        2     1100     1350\n"
+	disk, err := parseDiskStats(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := DiskStats{Reads: 1200, ReadBytes: 96000 * 512, ReadTimeMs: 450, Writes: 800,
+		WriteBytes: 64000 * 512, WriteTimeMs: 900, InFlight: 2, IOTimeMs: 1100}
+	if *disk != expected {
+		t.Errorf("parseDiskStats(%q) = %+v, expected %+v", stat, *disk, expected)
+	}
+
+	if _, err = parseDiskStats("1 2 3"); err == nil {
+		t.Errorf("parseDiskStats of a short line succeeded")
+	}
+}
+
+func TestGetUsage(t *testing.T) {
+	usage, err := GetUsage(os.TempDir(), "/nonexistent", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := usage.Filesystem
+	if fs == nil || fs.SizeBytes == 0 || fs.UsedBytes > fs.SizeBytes || len(fs.MountFlags) == 0 {
+		t.Errorf("GetUsage(%s) = %+v", os.TempDir(), fs)
+	}
+	if usage.Disk != nil {
+		t.Errorf("GetUsage found disk stats for a missing device: %+v", usage.Disk)
+	}
+}
@@ -0,0 +1,376 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+// Minimal Prometheus instrumentation: counters, histograms and gauges with
+// labels, exposed in the Prometheus text format (version 0.0.4) over HTTP.
+//
+// Metrics register themselves in a single registry when created, the plugin
+// metrics are all defined in plugin_metrics.go. Metrics are cheap to update
+// and safe to use from multiple goroutines.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// Path - where metrics are served
+	Path = "/metrics"
+
+	contentType = "text/plain; version=0.0.4"
+	// separates label values in the keys of the series maps
+	labelSep = "\xff"
+)
+
+// metric - something which can write its samples in the text format
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+// registry - all the metrics, by name
+var (
+	registryMtx sync.RWMutex
+	registry    = make(map[string]metric)
+)
+
+// registers m, replacing a metric of the same name
+func register(m metric) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	registry[m.name()] = m
+}
+
+// desc - name, help and label names of a metric
+type desc struct {
+	metricName string
+	help       string
+	labels     []string
+}
+
+func (d *desc) name() string {
+	return d.metricName
+}
+
+// writes the HELP and TYPE lines
+func (d *desc) writeHeader(w io.Writer, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.metricName, strings.Replace(d.help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.metricName, metricType)
+}
+
+// returns the map key for the label values
+func (d *desc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labels) {
+		log.WithFields(log.Fields{
+			"metric": d.metricName, "labels": d.labels, "values": labelValues,
+		}).Error("Wrong number of metric label values ")
+	}
+	return strings.Join(labelValues, labelSep)
+}
+
+// formats the labels of a series, with optional extra label
+func (d *desc) labelString(key string, extraName string, extraValue string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		values := strings.Split(key, labelSep)
+		for i, label := range d.labels {
+			value := ""
+			if i < len(values) {
+				value = values[i]
+			}
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", label, escape(value)))
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, escape(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return strings.Replace(s, `"`, `\"`, -1)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// returns the keys of a series map, sorted
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CounterVec - counters partitioned by labels
+type CounterVec struct {
+	desc
+	mtx    sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec - creates and registers a counter
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{metricName: name, help: help, labels: labels},
+		values: make(map[string]float64),
+	}
+	register(c)
+	return c
+}
+
+// Inc - adds 1 to the counter with the given label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add - adds v, which must not be negative, to the counter
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.values[key] += v
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.writeHeader(w, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, c.labelString(key, "", ""), formatFloat(c.values[key]))
+	}
+}
+
+// DurationBuckets - histogram buckets in seconds for operations ranging
+// from a local syscall to an ESX task
+var DurationBuckets = []float64{0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// histogram - one series of a HistogramVec
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec - histograms partitioned by labels
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mtx     sync.Mutex
+	values  map[string]*histogram
+}
+
+// NewHistogramVec - creates and registers a histogram with the given
+// upper bounds of the buckets, sorted
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{metricName: name, help: help, labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+	register(h)
+	return h
+}
+
+// Observe - records a value in the histogram with the given label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	series := h.values[key]
+	if series == nil {
+		series = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = series
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.buckets) {
+		series.counts[i]++
+	}
+	series.count++
+	series.sum += v
+}
+
+// ObserveSince - records the time elapsed since start, in seconds
+func (h *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.writeHeader(w, "histogram")
+
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := h.values[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += series.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName,
+				h.labelString(key, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelString(key, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, h.labelString(key, "", ""), formatFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, h.labelString(key, "", ""), series.count)
+	}
+}
+
+// GaugeFunc - a gauge whose values are collected when scraped. The
+// function returns the value per label values, joined as for the key.
+type GaugeFunc struct {
+	desc
+	metricType string // gauge, or counter for NewCounterVecFunc
+	collect    func() map[string]float64
+}
+
+// NewGaugeFunc - creates and registers a gauge without labels
+func NewGaugeFunc(name string, help string, collect func() float64) *GaugeFunc {
+	return NewGaugeVecFunc(name, help, func() map[string]float64 {
+		return map[string]float64{"": collect()}
+	})
+}
+
+// NewGaugeVecFunc - creates and registers a gauge with labels. collect
+// returns the values keyed by LabelKey of the label values.
+func NewGaugeVecFunc(name string, help string, collect func() map[string]float64, labels ...string) *GaugeFunc {
+	return newFunc(name, help, "gauge", collect, labels)
+}
+
+// NewCounterVecFunc - creates and registers a counter with labels whose
+// values are collected when scraped, like NewGaugeVecFunc, for counters
+// kept elsewhere, e.g. by the kernel
+func NewCounterVecFunc(name string, help string, collect func() map[string]float64, labels ...string) *GaugeFunc {
+	return newFunc(name, help, "counter", collect, labels)
+}
+
+func newFunc(name string, help string, metricType string, collect func() map[string]float64, labels []string) *GaugeFunc {
+	g := &GaugeFunc{
+		desc:       desc{metricName: name, help: help, labels: labels},
+		metricType: metricType,
+		collect:    collect,
+	}
+	register(g)
+	return g
+}
+
+// LabelKey - key of the label values, for NewGaugeVecFunc
+func LabelKey(labelValues ...string) string {
+	return strings.Join(labelValues, labelSep)
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	values := g.collect()
+	g.writeHeader(w, g.metricType)
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, g.labelString(key, "", ""), formatFloat(values[key]))
+	}
+}
+
+// WriteAll - writes all the metrics in the text format, sorted by name
+func WriteAll(w io.Writer) {
+	registryMtx.RLock()
+	metrics := make([]metric, 0, len(registry))
+	for _, m := range registry {
+		metrics = append(metrics, m)
+	}
+	registryMtx.RUnlock()
+
+	sort.Sort(byName(metrics))
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+type byName []metric
+
+func (m byName) Len() int           { return len(m) }
+func (m byName) Less(i, j int) bool { return m[i].name() < m[j].name() }
+func (m byName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// Handler - serves the metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		WriteAll(&buf)
+		w.Header().Set("Content-Type", contentType)
+		w.Write(buf.Bytes())
+	})
+}
+
+// Server - serves the metrics over HTTP until closed
+type Server struct {
+	listener net.Listener
+}
+
+// Listen - listens at the given address (host:port), call Serve to
+// serve the metrics
+func Listen(address string) (*Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{listener: listener}, nil
+}
+
+// Address - the address the server listens at
+func (s *Server) Address() string {
+	return s.listener.Addr().String()
+}
+
+// Serve - serves the metrics on Path until Close is called
+func (s *Server) Serve() error {
+	mux := http.NewServeMux()
+	mux.Handle(Path, Handler())
+	log.WithFields(log.Fields{"address": s.Address(), "path": Path}).Info("Serving metrics ")
+	return http.Serve(s.listener, mux)
+}
+
+// Close - stops listening, Serve returns
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+// Test the text format of the metrics and the server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounter(t *testing.T) {
+	c := NewCounterVec("test_requests_total", "Test requests.", "cmd")
+	c.Inc("attach")
+	c.Inc("attach")
+	c.Add(3, `de"tach`)
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	assert.Equal(t, `# HELP test_requests_total Test requests.
+# TYPE test_requests_total counter
+test_requests_total{cmd="attach"} 2
+test_requests_total{cmd="de\"tach"} 3
+`, buf.String())
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogramVec("test_duration_seconds", "Test durations.", []float64{0.1, 1}, "op")
+	h.Observe(0.05, "mount")
+	h.Observe(0.1, "mount")
+	h.Observe(0.5, "mount")
+	h.Observe(2, "mount")
+
+	var buf bytes.Buffer
+	h.write(&buf)
+	assert.Equal(t, `# HELP test_duration_seconds Test durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{op="mount",le="0.1"} 2
+test_duration_seconds_bucket{op="mount",le="1"} 3
+test_duration_seconds_bucket{op="mount",le="+Inf"} 4
+test_duration_seconds_sum{op="mount"} 2.65
+test_duration_seconds_count{op="mount"} 4
+`, buf.String())
+}
+
+func TestGauge(t *testing.T) {
+	NewGaugeFunc("test_volumes", "Test volumes.", func() float64 { return 3 })
+	NewGaugeVecFunc("test_state", "Test state.", func() map[string]float64 {
+		return map[string]float64{LabelKey("ready"): 1, LabelKey("degraded"): 0}
+	}, "state")
+
+	var buf bytes.Buffer
+	WriteAll(&buf)
+	assert.Contains(t, buf.String(), "# TYPE test_volumes gauge\ntest_volumes 3\n")
+	assert.Contains(t, buf.String(), "test_state{state=\"degraded\"} 0\ntest_state{state=\"ready\"} 1\n")
+}
+
+func TestServer(t *testing.T) {
+	server, err := Listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	done := make(chan error, 1)
+	go func() { done <- server.Serve() }()
+
+	resp, err := http.Get("http://" + server.Address() + Path)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, contentType, resp.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), "# TYPE ")
+
+	server.Close()
+	assert.NotNil(t, <-done)
+}
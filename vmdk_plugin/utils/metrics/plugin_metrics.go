@@ -0,0 +1,92 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+// Metrics of the plugin. Gauges on refcounts are registered by the refcount
+// package since they are collected from the RefCountsMap of the driver.
+
+import "time"
+
+// TrimBuckets - histogram buckets in seconds for trims, rate limited to
+// take seconds to hours
+var TrimBuckets = []float64{1, 5, 15, 60, 300, 900, 1800, 3600, 7200}
+
+var (
+	// EsxRequests - commands sent to the ESX service, by command
+	EsxRequests = NewCounterVec("vdvs_esx_requests_total",
+		"Commands sent to the ESX service.", "cmd")
+	// EsxRequestErrors - commands which failed, by command
+	EsxRequestErrors = NewCounterVec("vdvs_esx_request_errors_total",
+		"Commands sent to the ESX service which failed.", "cmd")
+	// EsxRequestDuration - time to get a reply from ESX, by command
+	EsxRequestDuration = NewHistogramVec("vdvs_esx_request_duration_seconds",
+		"Time to get a reply to a command from the ESX service, including the wait for earlier commands.",
+		DurationBuckets, "cmd")
+
+	// VolumeRequests - Docker requests, by operation (mount, unmount)
+	VolumeRequests = NewCounterVec("vdvs_volume_requests_total",
+		"Volume requests from Docker.", "op")
+	// VolumeRequestErrors - Docker requests which failed, by operation
+	VolumeRequestErrors = NewCounterVec("vdvs_volume_request_errors_total",
+		"Volume requests from Docker which failed.", "op")
+	// VolumeRequestDuration - time to serve Docker requests, by operation
+	VolumeRequestDuration = NewHistogramVec("vdvs_volume_request_duration_seconds",
+		"Time to serve a volume request from Docker.", DurationBuckets, "op")
+
+	// DeviceWaitDuration - time waiting for an attached disk to show up in
+	// the guest, by outcome (found, timeout, error)
+	DeviceWaitDuration = NewHistogramVec("vdvs_device_wait_duration_seconds",
+		"Time waiting for an attached disk to show up in the guest.", DurationBuckets, "outcome")
+	// MkfsDuration - time to create a filesystem, by filesystem type
+	MkfsDuration = NewHistogramVec("vdvs_mkfs_duration_seconds",
+		"Time to create a filesystem on a new volume.", DurationBuckets, "fstype")
+
+	// TrimRuns - scheduled trims of mounted volumes, by outcome (success,
+	// failure, unsupported, interrupted)
+	TrimRuns = NewCounterVec("vdvs_trim_runs_total",
+		"Scheduled trims of mounted volumes.", "outcome")
+	// TrimmedBytes - free space trimmed, by volume
+	TrimmedBytes = NewCounterVec("vdvs_trimmed_bytes_total",
+		"Free space trimmed on mounted volumes, in bytes.", "volume")
+	// TrimDuration - time to trim a volume, rate limit included
+	TrimDuration = NewHistogramVec("vdvs_trim_duration_seconds",
+		"Time to trim a mounted volume, including the waits of the rate limit.", TrimBuckets, "outcome")
+
+	// Reconciliations - refcount discovery passes, by outcome (success, failure)
+	Reconciliations = NewCounterVec("vdvs_reconciliations_total",
+		"Volume usage discovery passes.", "outcome")
+	// RecoveryActions - recovery mounts and unmounts done on reconciliation,
+	// by action and outcome
+	RecoveryActions = NewCounterVec("vdvs_recovery_actions_total",
+		"Recovery mounts and unmounts done after volume usage discovery.", "action", "outcome")
+)
+
+// Outcome - "success" or "failure" label value for err
+func Outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// ObserveRequest - records a Docker request of the given operation which
+// started at start, errMsg is the error sent to Docker
+func ObserveRequest(op string, start time.Time, errMsg string) {
+	VolumeRequests.Inc(op)
+	if errMsg != "" {
+		VolumeRequestErrors.Inc(op)
+	}
+	VolumeRequestDuration.ObserveSince(start, op)
+}
@@ -23,6 +23,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
 )
 
 const (
@@ -35,6 +36,13 @@ const (
 
 	// PluginInitError message to indicate that plugin initialization(refcounting) is not yet complete
 	PluginInitError = "Plugin initialization in progress."
+
+	// PluginDegradedError message to indicate that refcounting failed and the plugin is in degraded mode
+	PluginDegradedError = "Plugin is degraded, volume usage is unknown (%s)."
+
+	// MountIDsDir - directory under the mount root with a bind mount of the
+	// volume for each Docker mount ID, <mount root>/.mounts/<volume>/<ID>
+	MountIDsDir = ".mounts"
 )
 
 // VolumeInfo - Volume fullname, datastore and metadata
@@ -44,7 +52,9 @@ type VolumeInfo struct {
 	VolumeMeta    map[string]interface{}
 }
 
-// GetMountInfo - return a map of mounted volumes and devices
+// GetMountInfo - return a map of mounted volumes and devices. Raw volumes
+// are bind mounts of a device node, /proc/mounts shows the devtmpfs, their
+// device is found from the mount point.
 func GetMountInfo(mountRoot string) (map[string]string, error) {
 	volumeMountMap := make(map[string]string) //map [volume mount path] -> device
 	data, err := ioutil.ReadFile(linuxMountsFile)
@@ -63,7 +73,13 @@ func GetMountInfo(mountRoot string) (map[string]string, error) {
 		if filepath.Dir(field[1]) != mountRoot {
 			continue
 		}
-		volumeMountMap[filepath.Base(field[1])] = field[0]
+		device := field[0]
+		if !strings.HasPrefix(device, "/dev/") {
+			if raw, err := fs.RawDevice(field[1]); err == nil {
+				device = raw
+			}
+		}
+		volumeMountMap[filepath.Base(field[1])] = device
 	}
 	return volumeMountMap, nil
 }
@@ -82,6 +98,21 @@ func AlreadyMounted(name string, mountRoot string) bool {
 	return false
 }
 
+// MountIDPath - the bind mount of the volume for a Docker mount ID
+func MountIDPath(mountRoot string, name string, id string) string {
+	return filepath.Join(mountRoot, MountIDsDir, name, id)
+}
+
+// VolumeOfMountPath - the volume name of a path where a volume is mounted,
+// the mount point of the volume or the bind mount of a mount ID
+func VolumeOfMountPath(path string) string {
+	dir := filepath.Dir(path)
+	if filepath.Base(filepath.Dir(dir)) == MountIDsDir {
+		return filepath.Base(dir)
+	}
+	return filepath.Base(path)
+}
+
 // JoinVolName - return a full name in format volume@datastore
 func JoinVolName(volName string, datastoreName string) string {
 	return strings.Join([]string{volName, datastoreName}, "@")
@@ -0,0 +1,178 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin_utils
+
+// Usage of the volumes mounted on this host, shown by docker volume inspect
+// and exposed as metrics.
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/metrics"
+)
+
+const (
+	// UsageKey - volume status key of the usage of a mounted volume
+	UsageKey = "usage"
+
+	// usage is collected once for all the metrics of a scrape
+	usageCacheTime = 1 * time.Second
+)
+
+// GetVolumeUsage - usage of the volume if it is mounted in mountRoot, nil
+// otherwise
+func GetVolumeUsage(name string, mountRoot string) (*fs.VolumeUsage, error) {
+	volumeMap, err := GetMountInfo(mountRoot)
+	if err != nil {
+		return nil, err
+	}
+	device, mounted := volumeMap[name]
+	if !mounted {
+		return nil, nil
+	}
+	return volumeUsage(filepath.Join(mountRoot, name), device)
+}
+
+// AddVolumeUsage - adds the usage of the volume to its status if it is
+// mounted in mountRoot. Errors are logged, the status is still valid.
+func AddVolumeUsage(status map[string]interface{}, name string, mountRoot string) {
+	usage, err := GetVolumeUsage(name, mountRoot)
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to get volume usage ")
+		return
+	}
+	if usage != nil && status != nil {
+		status[UsageKey] = usage
+	}
+}
+
+// raw volumes have a block device at the mount point
+func volumeUsage(mountpoint string, device string) (*fs.VolumeUsage, error) {
+	_, err := fs.RawDevice(mountpoint)
+	return fs.GetUsage(mountpoint, device, err == nil)
+}
+
+// usage of all the mounted volumes, cached for a scrape
+type usageCollector struct {
+	mountRoot string
+	mtx       sync.Mutex
+	collected time.Time
+	usage     map[string]*fs.VolumeUsage
+}
+
+func (c *usageCollector) get() map[string]*fs.VolumeUsage {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if time.Since(c.collected) < usageCacheTime {
+		return c.usage
+	}
+	c.usage = make(map[string]*fs.VolumeUsage)
+	c.collected = time.Now()
+	volumeMap, err := GetMountInfo(c.mountRoot)
+	if err != nil {
+		return c.usage
+	}
+	for name, device := range volumeMap {
+		usage, err := volumeUsage(filepath.Join(c.mountRoot, name), device)
+		if err != nil {
+			log.WithFields(log.Fields{"name": name, "error": err}).Debug("Failed to get volume usage ")
+			continue
+		}
+		c.usage[name] = usage
+	}
+	return c.usage
+}
+
+// returns the values of a metric for each volume which has it
+func (c *usageCollector) collect(value func(u *fs.VolumeUsage) (float64, bool)) func() map[string]float64 {
+	return func() map[string]float64 {
+		values := make(map[string]float64)
+		for name, usage := range c.get() {
+			if v, ok := value(usage); ok {
+				values[metrics.LabelKey(name)] = v
+			}
+		}
+		return values
+	}
+}
+
+// returns a filesystem value, none for raw volumes
+func fsValue(value func(f *fs.FilesystemUsage) uint64) func(u *fs.VolumeUsage) (float64, bool) {
+	return func(u *fs.VolumeUsage) (float64, bool) {
+		if u.Filesystem == nil {
+			return 0, false
+		}
+		return float64(value(u.Filesystem)), true
+	}
+}
+
+// returns a disk value, none if the disk wasn't found
+func diskValue(value func(d *fs.DiskStats) uint64) func(u *fs.VolumeUsage) (float64, bool) {
+	return func(u *fs.VolumeUsage) (float64, bool) {
+		if u.Disk == nil {
+			return 0, false
+		}
+		return float64(value(u.Disk)), true
+	}
+}
+
+// RegisterUsageMetrics - registers the usage metrics of the volumes mounted
+// in mountRoot, by volume, collected when scraped
+func RegisterUsageMetrics(mountRoot string) {
+	c := &usageCollector{mountRoot: mountRoot}
+
+	metrics.NewGaugeVecFunc("vdvs_volume_fs_size_bytes", "Size of the filesystem of a mounted volume.",
+		c.collect(fsValue(func(f *fs.FilesystemUsage) uint64 { return f.SizeBytes })), "volume")
+	metrics.NewGaugeVecFunc("vdvs_volume_fs_used_bytes", "Space used in the filesystem of a mounted volume.",
+		c.collect(fsValue(func(f *fs.FilesystemUsage) uint64 { return f.UsedBytes })), "volume")
+	metrics.NewGaugeVecFunc("vdvs_volume_fs_free_bytes",
+		"Space available to unprivileged users in the filesystem of a mounted volume.",
+		c.collect(fsValue(func(f *fs.FilesystemUsage) uint64 { return f.FreeBytes })), "volume")
+	metrics.NewGaugeVecFunc("vdvs_volume_fs_inodes", "Inodes of the filesystem of a mounted volume.",
+		c.collect(fsValue(func(f *fs.FilesystemUsage) uint64 { return f.Inodes })), "volume")
+	metrics.NewGaugeVecFunc("vdvs_volume_fs_inodes_used", "Inodes used in the filesystem of a mounted volume.",
+		c.collect(fsValue(func(f *fs.FilesystemUsage) uint64 { return f.InodesUsed })), "volume")
+	metrics.NewGaugeVecFunc("vdvs_volume_fs_read_only", "1 if the filesystem of a mounted volume is read-only.",
+		c.collect(fsValue(func(f *fs.FilesystemUsage) uint64 {
+			if f.ReadOnly {
+				return 1
+			}
+			return 0
+		})), "volume")
+
+	metrics.NewGaugeVecFunc("vdvs_volume_disk_size_bytes", "Size of the disk of a mounted volume.",
+		c.collect(diskValue(func(d *fs.DiskStats) uint64 { return d.SizeBytes })), "volume")
+	metrics.NewCounterVecFunc("vdvs_volume_disk_reads_total", "Reads completed on the disk of a mounted volume.",
+		c.collect(diskValue(func(d *fs.DiskStats) uint64 { return d.Reads })), "volume")
+	metrics.NewCounterVecFunc("vdvs_volume_disk_read_bytes_total", "Bytes read from the disk of a mounted volume.",
+		c.collect(diskValue(func(d *fs.DiskStats) uint64 { return d.ReadBytes })), "volume")
+	metrics.NewCounterVecFunc("vdvs_volume_disk_writes_total", "Writes completed on the disk of a mounted volume.",
+		c.collect(diskValue(func(d *fs.DiskStats) uint64 { return d.Writes })), "volume")
+	metrics.NewCounterVecFunc("vdvs_volume_disk_written_bytes_total", "Bytes written to the disk of a mounted volume.",
+		c.collect(diskValue(func(d *fs.DiskStats) uint64 { return d.WriteBytes })), "volume")
+	metrics.NewCounterVecFunc("vdvs_volume_disk_io_time_seconds_total",
+		"Time the disk of a mounted volume was busy with I/O.",
+		c.collect(func(u *fs.VolumeUsage) (float64, bool) {
+			if u.Disk == nil {
+				return 0, false
+			}
+			return float64(u.Disk.IOTimeMs) / 1000, true
+		}), "volume")
+}
@@ -0,0 +1,174 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// containerd implementation of ContainerRuntime.
+//
+// containerd keeps a bundle for each task it runs, in the runtime state
+// directory:
+//   <state dir>/<runtime>/<namespace>/<container id>/config.json
+//   <state dir>/<runtime>/<namespace>/<container id>/init.pid
+// config.json is the OCI runtime spec of the container, which lists its
+// mounts, and init.pid is the pid of the container init process. We read
+// those directly so no containerd client is needed. Containers whose init
+// process is gone are considered stopped.
+
+package refcount
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
+	"golang.org/x/net/context"
+)
+
+const (
+	// ContainerdStateDir - default containerd state directory
+	ContainerdStateDir = "/run/containerd"
+
+	specFile    = "config.json"
+	initPidFile = "init.pid"
+	procDir     = "/proc"
+)
+
+// Task runtimes (shim v1 and v2) which keep bundles in the state dir
+var containerdTaskRuntimes = []string{
+	"io.containerd.runtime.v2.task",
+	"io.containerd.runtime.v1.linux",
+}
+
+// The parts of the OCI runtime spec we need
+type ociSpec struct {
+	Mounts []struct {
+		Destination string   `json:"destination"`
+		Type        string   `json:"type"`
+		Source      string   `json:"source"`
+		Options     []string `json:"options"`
+	} `json:"mounts"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type containerdRuntime struct {
+	stateDir string
+}
+
+// NewContainerdRuntime - creates a runtime reading containerd task state from stateDir
+func NewContainerdRuntime(stateDir string) ContainerRuntime {
+	return &containerdRuntime{stateDir: stateDir}
+}
+
+func (rt *containerdRuntime) Name() string {
+	return ContainerdRuntime + " at " + rt.stateDir
+}
+
+func (rt *containerdRuntime) Ping(ctx context.Context) error {
+	stat, err := os.Stat(rt.stateDir)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("%s is not a directory", rt.stateDir)
+	}
+	return nil
+}
+
+// Container IDs are <namespace>/<id> since IDs are only unique per namespace
+func (rt *containerdRuntime) ListContainers(ctx context.Context) ([]Container, error) {
+	var containers []Container
+	for _, taskRuntime := range containerdTaskRuntimes {
+		bundles, err := filepath.Glob(filepath.Join(rt.stateDir, taskRuntime, "*", "*", specFile))
+		if err != nil {
+			return nil, err
+		}
+		for _, spec := range bundles {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			bundle := filepath.Dir(spec)
+			if !isTaskAlive(bundle) {
+				continue
+			}
+			id := filepath.Join(filepath.Base(filepath.Dir(bundle)), filepath.Base(bundle))
+			containers = append(containers, Container{ID: id, Names: []string{id}})
+		}
+	}
+	return containers, nil
+}
+
+func (rt *containerdRuntime) ContainerMounts(ctx context.Context, id string) ([]Mount, error) {
+	for _, taskRuntime := range containerdTaskRuntimes {
+		data, err := ioutil.ReadFile(filepath.Join(rt.stateDir, taskRuntime, id, specFile))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var spec ociSpec
+		if err = json.Unmarshal(data, &spec); err != nil {
+			return nil, fmt.Errorf("Failed to parse spec of container %s: %v", id, err)
+		}
+
+		mounts := make([]Mount, 0, len(spec.Mounts))
+		for _, m := range spec.Mounts {
+			rw := true
+			for _, opt := range m.Options {
+				if opt == "ro" {
+					rw = false
+				}
+			}
+			// containerd knows nothing about volume names, volumes are
+			// mounted at <mount root>/<volume name>, or bind mounted for
+			// a mount ID below it
+			mounts = append(mounts, Mount{
+				Name:        plugin_utils.VolumeOfMountPath(m.Source),
+				Source:      m.Source,
+				Destination: m.Destination,
+				RW:          rw,
+			})
+		}
+		return mounts, nil
+	}
+	// the task exited since it was listed
+	return nil, &ContainerNotFoundError{ID: id}
+}
+
+// containerd tasks are created with their mounts, no mount request comes
+// for a starting one
+func (rt *containerdRuntime) StartingContainers(ctx context.Context, volume string) ([]Container, error) {
+	return nil, nil
+}
+
+// checks that the init process of the task in the bundle is running
+func isTaskAlive(bundle string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(bundle, initPidFile))
+	if err != nil {
+		log.Debugf("No init pid for %s (%v), skipping", bundle, err)
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(procDir, strconv.Itoa(pid)))
+	return err == nil
+}
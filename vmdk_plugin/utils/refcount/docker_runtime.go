@@ -0,0 +1,121 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Docker implementation of ContainerRuntime, talks to the engine API.
+
+package refcount
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"golang.org/x/net/context"
+)
+
+type dockerRuntime struct {
+	endpoint string
+	client   *client.Client
+}
+
+// NewDockerRuntime - creates a runtime talking to Docker at the given endpoint
+func NewDockerRuntime(endpoint string) (ContainerRuntime, error) {
+	c, err := client.NewClient(endpoint, ApiVersion, nil, defaultHeaders)
+	if err != nil {
+		log.Errorf("Failed to create client for Docker at %s.( %v)", endpoint, err)
+		return nil, err
+	}
+	return &dockerRuntime{endpoint: endpoint, client: c}, nil
+}
+
+func (rt *dockerRuntime) Name() string {
+	return DockerRuntime + " at " + rt.endpoint
+}
+
+func (rt *dockerRuntime) Ping(ctx context.Context) error {
+	info, err := rt.client.Info(ctx)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Docker info: version=%s, root=%s, OS=%s",
+		info.ServerVersion, info.DockerRootDir, info.OperatingSystem)
+	return nil
+}
+
+func (rt *dockerRuntime) ListContainers(ctx context.Context) ([]Container, error) {
+	filters := filters.NewArgs()
+	filters.Add("status", "running")
+	filters.Add("status", "paused")
+	filters.Add("status", "restarting")
+
+	containers, err := rt.client.ContainerList(ctx, types.ContainerListOptions{
+		All:    true,
+		Filter: filters,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Container, 0, len(containers))
+	for _, ct := range containers {
+		result = append(result, Container{ID: ct.ID, Names: ct.Names, Labels: ct.Labels})
+	}
+	return result, nil
+}
+
+func (rt *dockerRuntime) ContainerMounts(ctx context.Context, id string) ([]Mount, error) {
+	containerJSONInfo, err := rt.client.ContainerInspect(ctx, id)
+	if client.IsErrContainerNotFound(err) {
+		return nil, &ContainerNotFoundError{ID: id}
+	} else if err != nil {
+		return nil, err
+	}
+
+	mounts := make([]Mount, 0, len(containerJSONInfo.Mounts))
+	for _, m := range containerJSONInfo.Mounts {
+		mounts = append(mounts, Mount{
+			Name:        m.Name,
+			Source:      m.Source,
+			Destination: m.Destination,
+			RW:          m.RW,
+		})
+	}
+	return mounts, nil
+}
+
+// Docker mounts the volumes of a container before it is running, the
+// container is created, exited or restarting then
+func (rt *dockerRuntime) StartingContainers(ctx context.Context, volume string) ([]Container, error) {
+	filters := filters.NewArgs()
+	filters.Add("status", "created")
+	filters.Add("status", "exited")
+	filters.Add("status", "restarting")
+	filters.Add("volume", volume)
+
+	containers, err := rt.client.ContainerList(ctx, types.ContainerListOptions{
+		All:    true,
+		Filter: filters,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Container, 0, len(containers))
+	for _, ct := range containers {
+		result = append(result, Container{ID: ct.ID, Names: ct.Names, Labels: ct.Labels})
+	}
+	return result, nil
+}
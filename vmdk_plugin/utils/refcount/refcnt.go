@@ -35,14 +35,23 @@
 //
 // Refcounts are changed in Mount/Unmount. The code in this file provides
 // generic refcnt API and also supports refcount discovery on restarts:
-// - Connects to Docker over unix socket, enumerates Volume Mounts and builds
-//   "volume mounts refcount" map as Docker sees it.
+// - Connects to Docker over unix socket (or another container runtime, see
+//   runtime.go), enumerates Volume Mounts and builds "volume mounts refcount"
+//   map as Docker sees it. Containers are inspected in parallel by a bounded
+//   pool of workers, within a single deadline.
 // - Gets actual mounts from /proc/mounts, and makes sure the refcounts and
 //   actual mounts are in sync.
 //
 // The process is initiated on plugin start,and ONLY if Docker is already
 // running and thus answering client.Info() request.
 //
+// The plugin health follows the discovery:
+// - initializing: discovery hasn't completed yet
+// - ready: refcounts are known, all operations are allowed
+// - degraded: Docker couldn't be reached after all the retries. Discovery
+//   keeps retrying in the background, and operations which need refcounts
+//   (Remove and detaching Unmount) are refused until it succeeds.
+//
 // After refcount discovery, results are compared to /proc/mounts content.
 //
 // We rely on all plugin mounts being in /mnt/vmdk/<volume_name>, and will
@@ -68,20 +77,25 @@
 // The serialization of operations per volume is assured by the volume/store
 // of the docker daemon.
 //
+// Operator repair actions and on-demand discovery are in repair.go.
+//
 
 package refcount
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/docker/engine-api/client"
-	"github.com/docker/engine-api/types"
-	"github.com/docker/engine-api/types/filters"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/config"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/metrics"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
 	"golang.org/x/net/context"
 )
@@ -93,10 +107,117 @@ const (
 	dockerConnTimeoutSec    = 2
 	refCountDelayStartSec   = 2
 	refCountRetryAttempts   = 20
+	refCountMaxDelaySec     = 60 // retry interval in degraded mode
+
+	// Container inspection during discovery is done by a bounded pool of
+	// workers, and the whole discovery pass has to fit in a single deadline.
+	discoveryWorkers    = 8
+	discoveryTimeoutSec = 30
+	inspectRetryDelay   = 500 * time.Millisecond
 
 	photonDriver = "photon"
 )
 
+// Policy - retry and timeout policy of refcount discovery. It can be
+// changed at any time, it is used from the next discovery step on.
+type Policy struct {
+	RetryAttempts    int           // failed discoveries before degraded mode
+	MaxRetryDelay    time.Duration // max delay between discovery retries
+	DiscoveryTimeout time.Duration // deadline of a discovery pass
+	RuntimeTimeout   time.Duration // timeout of a single container runtime request
+	Workers          int           // containers inspected in parallel
+}
+
+// DefaultPolicy - policy used unless set otherwise
+func DefaultPolicy() Policy {
+	return Policy{
+		RetryAttempts:    refCountRetryAttempts,
+		MaxRetryDelay:    refCountMaxDelaySec * time.Second,
+		DiscoveryTimeout: discoveryTimeoutSec * time.Second,
+		RuntimeTimeout:   dockerConnTimeoutSec * time.Second,
+		Workers:          discoveryWorkers,
+	}
+}
+
+// NewPolicy - policy from the config, defaults are used for unset values
+func NewPolicy(c config.Config) Policy {
+	p := DefaultPolicy()
+	if c.RefCountRetryAttempts > 0 {
+		p.RetryAttempts = c.RefCountRetryAttempts
+	}
+	if c.RefCountMaxRetryDelaySec > 0 {
+		p.MaxRetryDelay = time.Duration(c.RefCountMaxRetryDelaySec) * time.Second
+	}
+	if c.DiscoveryTimeoutSec > 0 {
+		p.DiscoveryTimeout = time.Duration(c.DiscoveryTimeoutSec) * time.Second
+	}
+	if c.RuntimeTimeoutSec > 0 {
+		p.RuntimeTimeout = time.Duration(c.RuntimeTimeoutSec) * time.Second
+	}
+	if c.DiscoveryWorkers > 0 {
+		p.Workers = c.DiscoveryWorkers
+	}
+	return p
+}
+
+// State - plugin health, driven by refcount discovery
+type State int
+
+const (
+	// StateInitializing - refcount discovery hasn't completed yet
+	StateInitializing State = iota
+	// StateReady - refcounts are known
+	StateReady
+	// StateDegraded - discovery failed after all retries, still retrying
+	StateDegraded
+)
+
+// String - printable name of the state
+func (s State) String() string {
+	switch s {
+	case StateInitializing:
+		return "initializing"
+	case StateReady:
+		return "ready"
+	case StateDegraded:
+		return "degraded"
+	}
+	return "unknown"
+}
+
+// Status - plugin health as reported to the user
+type Status struct {
+	State    string    `json:"state"`
+	Reason   string    `json:"reason,omitempty"` // last discovery error, if any
+	Since    time.Time `json:"since"`            // time of the last state change
+	Attempts int       `json:"attempts"`         // discovery attempts so far
+}
+
+// RefCountInfo - refcount and mount state of a volume as reported to the user
+type RefCountInfo struct {
+	Count   uint   `json:"count"`
+	Mounted bool   `json:"mounted"`
+	Dev     string `json:"dev,omitempty"`
+}
+
+// RecoveryAction - a recovery mount or unmount done on reconciliation
+type RecoveryAction struct {
+	Volume string `json:"volume"`
+	Action string `json:"action"` // "mount", "unmount" or "unmount mount IDs"
+	Error  string `json:"error,omitempty"`
+}
+
+// Reconciliation - outcome of a refcount discovery pass
+type Reconciliation struct {
+	Started    time.Time        `json:"started"`
+	Finished   time.Time        `json:"finished"`
+	Runtime    string           `json:"runtime"`
+	Containers int              `json:"containers"` // running containers found
+	Volumes    int              `json:"volumes"`    // volumes in use by them
+	Recovery   []RecoveryAction `json:"recovery,omitempty"`
+	Error      string           `json:"error,omitempty"`
+}
+
 // info about individual volume ref counts and mount
 type refCount struct {
 	// refcount for the given volume.
@@ -119,6 +240,38 @@ type RefCountsMap struct {
 	refcntInitSuccess bool        // save refcounting success
 	isDirty           bool        // flag to check reconciling has been interrupted
 	StateMtx          *sync.Mutex // (Exported) Synchronizes refcounting between mount/unmount and refcounting thread
+	discoveryMtx      *sync.Mutex // Serializes discovery passes, they may also be requested by the operator
+
+	// plugin health, protected by its own lock so that it can be reported
+	// while mount/unmount hold StateMtx
+	healthMtx   *sync.RWMutex
+	state       State
+	stateReason string
+	stateSince  time.Time
+	attempts    int
+
+	// outcome of the last discovery pass, nil until the first one completes
+	lastReconciliation *Reconciliation
+
+	// retry and timeout policy, protected by healthMtx
+	policy Policy
+
+	// Source of container and mount info for discovery
+	runtime ContainerRuntime
+
+	// Map of container ID -> names of plugin volumes mounted by the container.
+	// Containers are added once inspected, so a discovery pass which hits
+	// the deadline keeps what it learned and the next pass only inspects
+	// the remaining containers. Only used by the discovery thread.
+	inspected map[string][]string
+}
+
+// outcome of a single container inspection
+type inspectResult struct {
+	container Container
+	volumes   []string // names of plugin volumes used by the container
+	gone      bool     // container was removed after it was listed
+	err       error
 }
 
 var (
@@ -138,15 +291,26 @@ func init() {
 	defaultHeaders = map[string]string{"User-Agent": "engine-api-client-1.0"}
 }
 
-// NewRefCountsMap - creates a new RefCountsMap
-func NewRefCountsMap() *RefCountsMap {
+// NewRefCountsMap - creates a new RefCountsMap discovering volume usage from
+// the given container runtime
+func NewRefCountsMap(rt ContainerRuntime) *RefCountsMap {
 	return &RefCountsMap{
+		runtime: rt,
+
 		refMap: make(map[string]*refCount),
 		mtx:    &sync.RWMutex{},
 
 		StateMtx:          &sync.Mutex{},
+		discoveryMtx:      &sync.Mutex{},
 		isDirty:           false,
 		refcntInitSuccess: false,
+
+		healthMtx:  &sync.RWMutex{},
+		state:      StateInitializing,
+		stateSince: time.Now(),
+		policy:     DefaultPolicy(),
+
+		inspected: make(map[string][]string),
 	}
 }
 
@@ -162,6 +326,149 @@ func (r *RefCountsMap) IsInitialized() bool {
 	return r.refcntInitSuccess
 }
 
+// GetState - return the current plugin health state
+func (r *RefCountsMap) GetState() State {
+	r.healthMtx.RLock()
+	defer r.healthMtx.RUnlock()
+	return r.state
+}
+
+// GetStatus - return a snapshot of the plugin health
+func (r *RefCountsMap) GetStatus() Status {
+	r.healthMtx.RLock()
+	defer r.healthMtx.RUnlock()
+	return Status{
+		State:    r.state.String(),
+		Reason:   r.stateReason,
+		Since:    r.stateSince,
+		Attempts: r.attempts,
+	}
+}
+
+// NotReadyReason - explains why operations relying on refcounts are refused
+func (r *RefCountsMap) NotReadyReason() string {
+	r.healthMtx.RLock()
+	defer r.healthMtx.RUnlock()
+	if r.state == StateDegraded {
+		return fmt.Sprintf(plugin_utils.PluginDegradedError, r.stateReason)
+	}
+	return plugin_utils.PluginInitError
+}
+
+// GetRefCounts - return refcount and mount state of all volumes in the map
+func (r *RefCountsMap) GetRefCounts() map[string]RefCountInfo {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	refCounts := make(map[string]RefCountInfo)
+	for vol, rc := range r.refMap {
+		refCounts[vol] = RefCountInfo{Count: rc.count, Mounted: rc.mounted, Dev: rc.dev}
+	}
+	return refCounts
+}
+
+// IsDirty - return if mounts/unmounts happened during the current discovery
+func (r *RefCountsMap) IsDirty() bool {
+	return r.checkDirty()
+}
+
+// SetPolicy - set the retry and timeout policy of discovery
+func (r *RefCountsMap) SetPolicy(p Policy) {
+	r.healthMtx.Lock()
+	defer r.healthMtx.Unlock()
+	r.policy = p
+}
+
+// GetPolicy - return the retry and timeout policy of discovery
+func (r *RefCountsMap) GetPolicy() Policy {
+	r.healthMtx.RLock()
+	defer r.healthMtx.RUnlock()
+	return r.policy
+}
+
+// GetLastReconciliation - return the outcome of the last discovery pass,
+// or nil if there was none yet
+func (r *RefCountsMap) GetLastReconciliation() *Reconciliation {
+	r.healthMtx.RLock()
+	defer r.healthMtx.RUnlock()
+	if r.lastReconciliation == nil {
+		return nil
+	}
+	rec := *r.lastReconciliation
+	return &rec
+}
+
+// StartingContainers - the containers using the volume which may be the one
+// a mount request is for, from the container runtime
+func (r *RefCountsMap) StartingContainers(volume string) ([]Container, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.GetPolicy().RuntimeTimeout)
+	defer cancel()
+	return r.runtime.StartingContainers(ctx, volume)
+}
+
+// RegisterMetrics - registers gauges on the refcounts and plugin health
+func (r *RefCountsMap) RegisterMetrics() {
+	metrics.NewGaugeFunc("vdvs_volumes_in_use",
+		"Volumes with a refcount.", func() float64 {
+			return float64(len(r.GetRefCounts()))
+		})
+	metrics.NewGaugeFunc("vdvs_refcount_total",
+		"Sum of the refcounts of all volumes.", func() float64 {
+			total := uint(0)
+			for _, rc := range r.GetRefCounts() {
+				total += rc.Count
+			}
+			return float64(total)
+		})
+	metrics.NewGaugeFunc("vdvs_volumes_mounted",
+		"Volumes mounted in the mount root.", func() float64 {
+			volumes, err := plugin_utils.GetMountInfo(mountRoot)
+			if err != nil {
+				return 0
+			}
+			return float64(len(volumes))
+		})
+	metrics.NewGaugeVecFunc("vdvs_plugin_state",
+		"Plugin health, 1 for the current state.", func() map[string]float64 {
+			current := r.GetState()
+			states := make(map[string]float64)
+			for _, state := range []State{StateInitializing, StateReady, StateDegraded} {
+				states[metrics.LabelKey(state.String())] = 0
+				if state == current {
+					states[metrics.LabelKey(state.String())] = 1
+				}
+			}
+			return states
+		}, "state")
+	metrics.NewGaugeFunc("vdvs_last_reconciliation_timestamp_seconds",
+		"Time the last volume usage discovery pass finished, 0 if none yet.", func() float64 {
+			rec := r.GetLastReconciliation()
+			if rec == nil {
+				return 0
+			}
+			return float64(rec.Finished.Unix())
+		})
+}
+
+// records the outcome of a discovery attempt and moves to the given state
+func (r *RefCountsMap) setState(state State, err error) {
+	r.healthMtx.Lock()
+	defer r.healthMtx.Unlock()
+
+	r.attempts++
+	r.stateReason = ""
+	if err != nil {
+		r.stateReason = err.Error()
+	}
+	if r.state != state {
+		log.WithFields(log.Fields{
+			"from": r.state, "to": state, "reason": r.stateReason,
+		}).Warning("Plugin state change ")
+		r.state = state
+		r.stateSince = time.Now()
+	}
+}
+
 // dirty the background refcount process
 // this flag is marked dirty from the driver
 // caller acquires lock on state as appropriate
@@ -176,64 +483,100 @@ func (r *RefCountsMap) Init(d drivers.VolumeDriver, mountDir string, name string
 	// If refcounting wasn't successful, schedule one again
 	if err != nil {
 		log.Infof("Refcounting failed: (%v).", err)
+		r.setState(StateInitializing, err)
 		go func() {
 			r.retryCalculate(d, mountDir, name)
 		}()
+		return
 	}
+	r.setState(StateReady, nil)
 }
 
 // create a timer to calculate refcount after a delay. If failed, retry again
-// until retry attempt limit reached
+// with exponential backoff. Once the retry attempt limit is reached the
+// plugin is degraded, and we keep retrying at the max interval until
+// refcounting succeeds.
 func (r *RefCountsMap) retryCalculate(d drivers.VolumeDriver, mountDir string, name string) {
-	attemptLeft := refCountRetryAttempts
-	delay := refCountDelayStartSec
-	for attemptLeft > 0 {
-		// generate a random delay everytime
-		log.Infof("Scheduling again after %d seconds", delay)
-		timer := time.NewTimer(time.Duration(delay) * time.Second)
+	attempts := 1 // the failed one in Init
+	delay := refCountDelayStartSec * time.Second
+	for {
+		log.Infof("Scheduling again after %v", delay)
+		timer := time.NewTimer(delay)
 
 		<-timer.C
 		err := r.calculate(d, mountDir, driverName)
-		if err != nil {
+		if err == nil {
+			r.setState(StateReady, nil)
+			return // all good
+		}
+
+		// the policy may change between attempts
+		policy := r.GetPolicy()
+		attempts++
+		attemptLeft := policy.RetryAttempts - attempts
+		if attemptLeft > 0 {
 			log.Infof("Refcounting failed: (%v). Attempts left: %d ", err, attemptLeft)
-			attemptLeft--
-			// exponential backoff
-			delay += delay
+			r.setState(StateInitializing, err)
 		} else {
-			return // all good
+			// couldn't complete refcounting even after retries.
+			// Keep serving what we can and retry in background.
+			log.Warningf("Refcounting failed: (%v). Retrying in degraded mode.", err)
+			r.setState(StateDegraded, err)
+		}
+
+		// exponential backoff
+		delay += delay
+		if delay > policy.MaxRetryDelay {
+			delay = policy.MaxRetryDelay
 		}
 	}
-	// couldn't complete refcounting even after retries.
-	// docker logs artifical panic and restarts the plugin.
-	panic(fmt.Sprintf("Failed to talk to docker to calculate volumes usage. Please restart docker"))
 }
 
-// calculate Refcounts. Discover volume usage refcounts from Docker.
+// calculate Refcounts. Discover volume usage refcounts from the container runtime.
 func (r *RefCountsMap) calculate(d drivers.VolumeDriver, mountDir string, name string) error {
-	c, err := client.NewClient(DockerUSocket, ApiVersion, nil, defaultHeaders)
-	if err != nil {
-		log.Panicf("Failed to create client for Docker at %s.( %v)",
-			DockerUSocket, err)
-	}
+	r.discoveryMtx.Lock()
+	defer r.discoveryMtx.Unlock()
+
 	mountRoot = mountDir
 	driverName = name
 
-	log.Infof("Getting volume data from %s", DockerUSocket)
+	log.Infof("Getting volume data from %s", r.runtime.Name())
+
+	rec := &Reconciliation{Started: time.Now(), Runtime: r.runtime.Name()}
+	defer func() {
+		rec.Finished = time.Now()
+		r.healthMtx.Lock()
+		r.lastReconciliation = rec
+		r.healthMtx.Unlock()
 
-	ctx, cancel := context.WithTimeout(context.Background(), dockerConnTimeoutSec*time.Second)
+		outcome := "success"
+		if rec.Error != "" {
+			outcome = "failure"
+		}
+		metrics.Reconciliations.Inc(outcome)
+		for _, action := range rec.Recovery {
+			actionOutcome := "success"
+			if action.Error != "" {
+				actionOutcome = "failure"
+			}
+			metrics.RecoveryActions.Inc(action.Action, actionOutcome)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.GetPolicy().RuntimeTimeout)
 	defer cancel()
-	info, err := c.Info(ctx)
+	err := r.runtime.Ping(ctx)
 	if err != nil {
-		log.Infof("Can't connect to %s due to (%v), skipping discovery", DockerUSocket, err)
+		log.Infof("Can't connect to %s due to (%v), skipping discovery", r.runtime.Name(), err)
+		rec.Error = err.Error()
 		return err
 	}
-	log.Debugf("Docker info: version=%s, root=%s, OS=%s",
-		info.ServerVersion, info.DockerRootDir, info.OperatingSystem)
 
 	// connects (and polls if needed) and then calls discovery
-	err = r.discoverAndSync(c, d)
+	err = r.discoverAndSync(d, rec)
 	if err != nil {
 		log.Errorf("Failed to discover mount refcounts(%v)", err)
+		rec.Error = err.Error()
 		return err
 	}
 
@@ -354,65 +697,58 @@ func (r *RefCountsMap) checkDirty() bool {
 	return r.isDirty
 }
 
-// enumerates volumes and  builds RefCountsMap, then sync with mount info
-func (r *RefCountsMap) discoverAndSync(c *client.Client, d drivers.VolumeDriver) error {
+// nameMapper is implemented by drivers which keep volumes under other
+// names than the Docker ones (aliases). Refcounts use the driver's names.
+type nameMapper interface {
+	BackendName(name string) string
+}
+
+// enumerates volumes and  builds RefCountsMap, then sync with mount info.
+// The outcome is recorded in rec.
+func (r *RefCountsMap) discoverAndSync(d drivers.VolumeDriver, rec *Reconciliation) error {
 	// we assume to  have empty refcounts. Let's enforce
 
 	r.StateMtx.Lock()
 	r.isDirty = false
 	r.StateMtx.Unlock()
 
-	filters := filters.NewArgs()
-	filters.Add("status", "running")
-	filters.Add("status", "paused")
-	filters.Add("status", "restarting")
-
-	ctx, cancel := context.WithTimeout(context.Background(), dockerConnTimeoutSec*time.Second)
+	// single deadline for the whole discovery pass
+	policy := r.GetPolicy()
+	ctx, cancel := context.WithTimeout(context.Background(), policy.DiscoveryTimeout)
 	defer cancel()
-	containers, err := c.ContainerList(ctx, types.ContainerListOptions{
-		All:    true,
-		Filter: filters,
-	})
+
+	ctxList, cancelList := context.WithTimeout(ctx, policy.RuntimeTimeout)
+	containers, err := r.runtime.ListContainers(ctxList)
+	cancelList()
 	if err != nil {
 		log.Errorf("ContainerList failed (err: %v)", err)
 		return err
 	}
 
+	log.Infof("Found %d running or paused containers", len(containers))
+	rec.Containers = len(containers)
+	err = r.inspectContainers(ctx, policy, containers)
+	if err != nil {
+		return err
+	}
+
 	// use same datastore for all volumes with short names
 	datastoreName := ""
 
-	log.Infof("Found %d running or paused containers", len(containers))
+	mapper, mapNames := d.(nameMapper)
+	counts := make(map[string]uint)
 	for _, ct := range containers {
-
-		if r.checkDirty() {
-			return fmt.Errorf("refcounting wasn't clean.")
-		}
-
-		ctx_inspect, cancel_inspect := context.WithTimeout(context.Background(), dockerConnTimeoutSec*time.Second)
-		defer cancel_inspect()
-		containerJSONInfo, err := c.ContainerInspect(ctx_inspect, ct.ID)
-		if err != nil {
-			log.Errorf("ContainerInspect failed for %s (err: %v)", ct.Names, err)
-			// We intentionally don't cleanup refMap because whatever refCounts(if any) we were able to
-			// populate are valid.
-			return err
-		}
-		log.Debugf("  Mounts for %v", ct.Names)
-		for _, mount := range containerJSONInfo.Mounts {
-			// check if the mount location belongs to vmdk plugin
-			if isVMDKMount(mount.Source) != true {
-				continue
+		for _, name := range r.inspected[ct.ID] {
+			if mapNames {
+				name = mapper.BackendName(name)
 			}
-
-			volumeInfo, err := plugin_utils.GetVolumeInfo(mount.Name, datastoreName, d)
+			volumeInfo, err := plugin_utils.GetVolumeInfo(name, datastoreName, d)
 			if err != nil {
-				log.Errorf("Unable to get volume info for volume %s. err:%v", mount.Name, err)
+				log.Errorf("Unable to get volume info for volume %s. err:%v", name, err)
 				return err
 			}
 			datastoreName = volumeInfo.DatastoreName
-			r.Incr(volumeInfo.VolumeName)
-			log.Debugf("name=%v (driver=%s source=%s) (%v)",
-				mount.Name, mount.Driver, mount.Source, mount)
+			counts[volumeInfo.VolumeName]++
 		}
 	}
 
@@ -429,19 +765,163 @@ func (r *RefCountsMap) discoverAndSync(c *client.Client, d drivers.VolumeDriver)
 	// Check that refcounts and actual mount info from Linux match
 	// If they don't, unmount unneeded stuff, or yell if something is
 	// not mounted but should be (it's error. we should not get there)
+	rec.Volumes = len(counts)
+	r.setCounts(counts)
 	r.updateRefMap()
-	r.syncMountsWithRefCounters(d)
+	rec.Recovery = r.syncMountsWithRefCounters(d)
 	// mark reconciling success so that further unmounts can instantly be processed
 	r.refcntInitSuccess = true
 	return nil
 }
 
-// syncronize mount info with refcounts - and unmounts if needed
-func (r *RefCountsMap) syncMountsWithRefCounters(d drivers.VolumeDriver) {
+// inspects the given containers with a bounded pool of workers and records
+// the plugin volumes used by each of them. Containers which fail inspection
+// are retried until the discovery deadline expires.
+func (r *RefCountsMap) inspectContainers(ctx context.Context, policy Policy, containers []Container) error {
+	// forget containers which are not running anymore, and skip the ones
+	// already inspected by a previous (failed) pass
+	running := make(map[string]bool)
+	var pending []Container
+	for _, ct := range containers {
+		running[ct.ID] = true
+		if _, exists := r.inspected[ct.ID]; !exists {
+			pending = append(pending, ct)
+		}
+	}
+	for id := range r.inspected {
+		if !running[id] {
+			delete(r.inspected, id)
+		}
+	}
+
+	for attempt := 1; len(pending) > 0; attempt++ {
+		if r.checkDirty() {
+			return fmt.Errorf("refcounting wasn't clean.")
+		}
+
+		log.Debugf("Inspecting %d containers (attempt %d)", len(pending), attempt)
+		failed := r.inspectBatch(ctx, policy, pending)
+		if len(failed) == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			// We intentionally keep the containers we were able to inspect,
+			// they are valid and won't be inspected again on the next pass.
+			return fmt.Errorf("failed to inspect %d of %d containers before discovery deadline",
+				len(failed), len(containers))
+		case <-time.After(inspectRetryDelay):
+		}
+		pending = failed
+	}
+	return nil
+}
+
+// inspects a batch of containers in parallel, returns the containers for
+// which inspection failed
+func (r *RefCountsMap) inspectBatch(ctx context.Context, policy Policy, containers []Container) []Container {
+	var failed []Container
+	for _, res := range inspectAll(ctx, r.runtime, policy, containers) {
+		if res.err != nil {
+			log.Errorf("Failed to get mounts for %s (err: %v)", res.container.Names, res.err)
+			failed = append(failed, res.container)
+			continue
+		}
+		if res.gone {
+			// uses no volumes anymore, nothing to remember
+			continue
+		}
+		r.inspected[res.container.ID] = res.volumes
+	}
+	return failed
+}
+
+// inspects containers with a bounded pool of workers
+func inspectAll(ctx context.Context, rt ContainerRuntime, policy Policy, containers []Container) []inspectResult {
+	workers := policy.Workers
+	if len(containers) < workers {
+		workers = len(containers)
+	}
+
+	jobs := make(chan Container)
+	results := make(chan inspectResult, len(containers))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ct := range jobs {
+				results <- inspectContainer(ctx, rt, policy.RuntimeTimeout, ct)
+			}
+		}()
+	}
+	for _, ct := range containers {
+		jobs <- ct
+	}
+	close(jobs)
+	wg.Wait()
+	close(results)
+
+	all := make([]inspectResult, 0, len(containers))
+	for res := range results {
+		all = append(all, res)
+	}
+	return all
+}
+
+// inspects a single container and returns the plugin volumes it uses
+func inspectContainer(ctx context.Context, rt ContainerRuntime, timeout time.Duration, ct Container) inspectResult {
+	res := inspectResult{container: ct}
+
+	ctxInspect, cancelInspect := context.WithTimeout(ctx, timeout)
+	defer cancelInspect()
+	mounts, err := rt.ContainerMounts(ctxInspect, ct.ID)
+	if _, notFound := err.(*ContainerNotFoundError); notFound {
+		log.Debugf("Container %v is gone, skipping it", ct.Names)
+		res.gone = true
+		return res
+	} else if err != nil {
+		res.err = err
+		return res
+	}
+
+	log.Debugf("  Mounts for %v", ct.Names)
+	for _, mount := range mounts {
+		// check if the mount location belongs to vmdk plugin
+		if isVMDKMount(mount.Source) != true {
+			continue
+		}
+		res.volumes = append(res.volumes, mount.Name)
+		log.Debugf("name=%v (source=%s) (%v)", mount.Name, mount.Source, mount)
+	}
+	return res
+}
+
+// replaces refcounts with the discovered ones
+func (r *RefCountsMap) setCounts(counts map[string]uint) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.refMap = make(map[string]*refCount)
+	for vol, count := range counts {
+		rc := newRefCount()
+		rc.count = count
+		r.refMap[vol] = rc
+	}
+}
+
+// syncronize mount info with refcounts - and unmounts if needed.
+// Returns the recovery actions taken.
+func (r *RefCountsMap) syncMountsWithRefCounters(d drivers.VolumeDriver) []RecoveryAction {
 	// Lock the RefCountsMap
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
 
+	// the device of a volume stays busy while bind mounts of its mount IDs
+	// are left, they go first
+	actions := r.unmountStaleMountIDs()
+
 	for vol, cnt := range r.refMap {
 		f := log.Fields{
 			"name":    vol,
@@ -455,10 +935,13 @@ func (r *RefCountsMap) syncMountsWithRefCounters(d drivers.VolumeDriver) {
 			if cnt.count == 0 {
 				// Volume mounted but not used - UNMOUNT and DETACH !
 				log.WithFields(f).Info("Initiating recovery unmount. ")
+				action := RecoveryAction{Volume: vol, Action: "unmount"}
 				err := d.UnmountVolume(vol)
 				if err != nil {
 					log.Warning("Failed to unmount - manual recovery may be needed")
+					action.Error = err.Error()
 				}
+				actions = append(actions, action)
 			}
 		} else {
 			if cnt.count == 0 {
@@ -472,9 +955,11 @@ func (r *RefCountsMap) syncMountsWithRefCounters(d drivers.VolumeDriver) {
 				// but not using files on the volumes, and the volume is (manually?)
 				// unmounted. Unlikely but possible. Mount !
 				log.WithFields(f).Warning("Initiating recovery mount. ")
+				action := RecoveryAction{Volume: vol, Action: "mount"}
 				status, err := d.GetVolume(vol)
 				if err != nil {
 					log.Warning("Failed to mount - manual recovery may be needed")
+					action.Error = err.Error()
 				} else {
 					//Ensure the refcount map has this disk ID
 					id := ""
@@ -494,11 +979,49 @@ func (r *RefCountsMap) syncMountsWithRefCounters(d drivers.VolumeDriver) {
 					_, err = d.MountVolume(vol, status["fstype"].(string), id, isReadOnly, false)
 					if err != nil {
 						log.Warning("Failed to mount - manual recovery may be needed")
+						action.Error = err.Error()
 					}
 				}
+				actions = append(actions, action)
+			}
+		}
+	}
+	return actions
+}
+
+// unmounts the bind mounts of mount IDs left for volumes no container
+// uses, /proc/mounts shows them out of the mount root so updateRefMap
+// doesn't see them. Caller holds mtx.
+func (r *RefCountsMap) unmountStaleMountIDs() []RecoveryAction {
+	var actions []RecoveryAction
+	dir := filepath.Join(mountRoot, plugin_utils.MountIDsDir)
+	volumes, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return actions
+	}
+	for _, vol := range volumes {
+		if cnt, used := r.refMap[vol.Name()]; used && cnt.count > 0 {
+			continue
+		}
+		log.WithFields(log.Fields{"name": vol.Name()}).Info("Initiating recovery unmount of mount IDs. ")
+		action := RecoveryAction{Volume: vol.Name(), Action: "unmount mount IDs"}
+		volDir := filepath.Join(dir, vol.Name())
+		ids, _ := ioutil.ReadDir(volDir)
+		for _, id := range ids {
+			path := filepath.Join(volDir, id.Name())
+			if err = fs.Unmount(path); err != nil && plugin_utils.AlreadyMounted(id.Name(), volDir) {
+				log.WithFields(log.Fields{
+					"name": vol.Name(), "id": id.Name(), "error": err,
+				}).Warning("Failed to unmount volume for mount ID - manual recovery may be needed ")
+				action.Error = err.Error()
+				continue
 			}
+			os.Remove(path)
 		}
+		os.Remove(volDir)
+		actions = append(actions, action)
 	}
+	return actions
 }
 
 // updates refcount map with mounted volumes using mount info
@@ -0,0 +1,282 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package refcount
+
+// Test refcount discovery with a fake container runtime and volume driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
+	"golang.org/x/net/context"
+)
+
+const testDatastore = "datastore1"
+
+// fakeRuntime serves containers and mounts from memory
+type fakeRuntime struct {
+	mtx        sync.Mutex
+	containers []Container
+	mounts     map[string][]Mount
+	failures   map[string]int  // container ID -> number of inspections to fail
+	inspects   map[string]int  // container ID -> number of inspections
+	removed    map[string]bool // container IDs removed after listing
+	onFailure  func()          // called when an inspection fails
+	onInspect  func()          // called on each inspection
+}
+
+func newFakeRuntime() *fakeRuntime {
+	return &fakeRuntime{
+		mounts:   make(map[string][]Mount),
+		failures: make(map[string]int),
+		inspects: make(map[string]int),
+		removed:  make(map[string]bool),
+	}
+}
+
+func (rt *fakeRuntime) addContainer(id string, volumes ...string) {
+	rt.containers = append(rt.containers, Container{ID: id, Names: []string{id}})
+	for _, vol := range volumes {
+		rt.mounts[id] = append(rt.mounts[id], Mount{
+			Name:   vol,
+			Source: filepath.Join(mountRoot, vol),
+			RW:     true,
+		})
+	}
+}
+
+func (rt *fakeRuntime) Name() string { return "fake" }
+
+func (rt *fakeRuntime) Ping(ctx context.Context) error { return nil }
+
+func (rt *fakeRuntime) ListContainers(ctx context.Context) ([]Container, error) {
+	return rt.containers, nil
+}
+
+func (rt *fakeRuntime) ContainerMounts(ctx context.Context, id string) ([]Mount, error) {
+	rt.mtx.Lock()
+	defer rt.mtx.Unlock()
+	rt.inspects[id]++
+	if rt.onInspect != nil {
+		rt.onInspect()
+	}
+	if rt.failures[id] > 0 {
+		rt.failures[id]--
+		if rt.onFailure != nil {
+			rt.onFailure()
+		}
+		return nil, fmt.Errorf("inspect of %s failed", id)
+	}
+	if rt.removed[id] {
+		return nil, &ContainerNotFoundError{ID: id}
+	}
+	return rt.mounts[id], nil
+}
+
+func (rt *fakeRuntime) StartingContainers(ctx context.Context, volume string) ([]Container, error) {
+	return nil, nil
+}
+
+// fakeDriver records recovery mounts and unmounts, and repair detaches
+type fakeDriver struct {
+	refCounts *RefCountsMap
+	mounted   []string
+	unmounted []string
+	detached  []string
+}
+
+func (d *fakeDriver) MountVolume(name string, fstype string, id string, isReadOnly bool, skipAttach bool) (string, error) {
+	d.mounted = append(d.mounted, name)
+	return filepath.Join(mountRoot, name), nil
+}
+
+func (d *fakeDriver) UnmountVolume(name string) error {
+	d.unmounted = append(d.unmounted, name)
+	return nil
+}
+
+func (d *fakeDriver) GetVolume(name string) (map[string]interface{}, error) {
+	return map[string]interface{}{"datastore": testDatastore, "fstype": "ext4"}, nil
+}
+
+func (d *fakeDriver) VolumesInRefMap() []string {
+	return d.refCounts.GetVolumeNames()
+}
+
+func (d *fakeDriver) Detach(name string) error {
+	d.detached = append(d.detached, name)
+	return nil
+}
+
+func (d *fakeDriver) ForgetMountIDs(name string) {}
+
+func setup(t *testing.T) (*fakeRuntime, *fakeDriver, *RefCountsMap) {
+	dir, err := ioutil.TempDir("", "refcnt_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountRoot = dir
+	driverName = "vsphere"
+
+	rt := newFakeRuntime()
+	r := NewRefCountsMap(rt)
+	return rt, &fakeDriver{refCounts: r}, r
+}
+
+func TestDiscoverAndSync(t *testing.T) {
+	rt, d, r := setup(t)
+	defer os.RemoveAll(mountRoot)
+
+	rt.addContainer("c1", "vol1@"+testDatastore)
+	rt.addContainer("c2", "vol1@"+testDatastore, "vol2")
+	rt.addContainer("c3")
+	rt.mounts["c3"] = []Mount{{Name: "local", Source: "/var/lib/docker/volumes/local/_data"}}
+
+	rec := &Reconciliation{}
+	assert.Nil(t, r.discoverAndSync(d, rec))
+	assert.True(t, r.IsInitialized())
+	assert.Equal(t, 3, rec.Containers)
+	assert.Equal(t, 2, rec.Volumes)
+	assert.Len(t, rec.Recovery, 2)
+	assert.Equal(t, uint(2), r.GetCount("vol1@"+testDatastore))
+	assert.Equal(t, uint(1), r.GetCount("vol2@"+testDatastore))
+	assert.Len(t, r.GetVolumeNames(), 2)
+
+	// nothing is mounted in the test, so both volumes are recovery mounted
+	sort.Strings(d.mounted)
+	assert.Equal(t, []string{"vol1@" + testDatastore, "vol2@" + testDatastore}, d.mounted)
+	assert.Empty(t, d.unmounted)
+}
+
+func TestDiscoverRetriesFailedInspection(t *testing.T) {
+	rt, d, r := setup(t)
+	defer os.RemoveAll(mountRoot)
+
+	for i := 0; i < 3*discoveryWorkers; i++ {
+		rt.addContainer(fmt.Sprintf("c%d", i), "vol1@"+testDatastore)
+	}
+	rt.failures["c1"] = 2
+
+	assert.Nil(t, r.discoverAndSync(d, &Reconciliation{}))
+	assert.Equal(t, uint(3*discoveryWorkers), r.GetCount("vol1@"+testDatastore))
+	assert.Equal(t, 3, rt.inspects["c1"])
+	assert.Equal(t, 1, rt.inspects["c0"])
+}
+
+func TestDiscoverSkipsRemovedContainers(t *testing.T) {
+	rt, d, r := setup(t)
+	defer os.RemoveAll(mountRoot)
+
+	rt.addContainer("c1", "vol1@"+testDatastore)
+	rt.addContainer("c2", "vol2@"+testDatastore)
+	rt.removed["c2"] = true
+
+	assert.Nil(t, r.discoverAndSync(d, &Reconciliation{}))
+	assert.True(t, r.IsInitialized())
+	assert.Equal(t, 1, rt.inspects["c2"])
+	assert.Equal(t, uint(1), r.GetCount("vol1@"+testDatastore))
+	assert.Equal(t, uint(0), r.GetCount("vol2@"+testDatastore))
+
+	users, err := r.VolumeUsers(d, "vol2@"+testDatastore)
+	assert.Nil(t, err)
+	assert.Empty(t, users)
+}
+
+func TestDiscoverKeepsPartialResults(t *testing.T) {
+	rt, d, r := setup(t)
+	defer os.RemoveAll(mountRoot)
+
+	rt.addContainer("c1", "vol1@"+testDatastore)
+	rt.addContainer("c2", "vol2@"+testDatastore)
+	rt.failures["c2"] = 1
+	// a parallel mount dirties the first pass
+	rt.onFailure = func() {
+		r.StateMtx.Lock()
+		r.MarkDirty()
+		r.StateMtx.Unlock()
+	}
+
+	assert.NotNil(t, r.discoverAndSync(d, &Reconciliation{}))
+	assert.False(t, r.IsInitialized())
+	assert.Empty(t, d.mounted)
+
+	// the second pass only inspects the container which failed
+	assert.Nil(t, r.discoverAndSync(d, &Reconciliation{}))
+	assert.True(t, r.IsInitialized())
+	assert.Equal(t, 1, rt.inspects["c1"])
+	assert.Equal(t, 2, rt.inspects["c2"])
+	assert.Equal(t, uint(1), r.GetCount("vol1@"+testDatastore))
+	assert.Equal(t, uint(1), r.GetCount("vol2@"+testDatastore))
+}
+
+func TestDiscoverForgetsStoppedContainers(t *testing.T) {
+	rt, d, r := setup(t)
+	defer os.RemoveAll(mountRoot)
+
+	rt.addContainer("c1", "vol1@"+testDatastore)
+	rt.addContainer("c2", "vol1@"+testDatastore)
+	assert.Nil(t, r.discoverAndSync(d, &Reconciliation{}))
+	assert.Equal(t, uint(2), r.GetCount("vol1@"+testDatastore))
+
+	rt.containers = rt.containers[:1]
+	assert.Nil(t, r.discoverAndSync(d, &Reconciliation{}))
+	assert.Equal(t, uint(1), r.GetCount("vol1@"+testDatastore))
+	assert.Len(t, r.inspected, 1)
+}
+
+func TestSyncRemovesStaleMountIDs(t *testing.T) {
+	rt, d, r := setup(t)
+	defer os.RemoveAll(mountRoot)
+
+	rt.addContainer("c1", "vol1@"+testDatastore)
+	used := plugin_utils.MountIDPath(mountRoot, "vol1@"+testDatastore, "id1")
+	stale := plugin_utils.MountIDPath(mountRoot, "vol2@"+testDatastore, "id2")
+	assert.Nil(t, os.MkdirAll(used, 0755))
+	assert.Nil(t, os.MkdirAll(stale, 0755))
+
+	rec := &Reconciliation{}
+	assert.Nil(t, r.discoverAndSync(d, rec))
+	_, err := os.Stat(used)
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Dir(stale))
+	assert.True(t, os.IsNotExist(err))
+	assert.Contains(t, rec.Recovery, RecoveryAction{Volume: "vol2@" + testDatastore, Action: "unmount mount IDs"})
+	assert.NotContains(t, rec.Recovery, RecoveryAction{Volume: "vol1@" + testDatastore, Action: "unmount mount IDs"})
+}
+
+func TestState(t *testing.T) {
+	r := NewRefCountsMap(newFakeRuntime())
+	assert.Equal(t, StateInitializing, r.GetState())
+
+	r.setState(StateDegraded, fmt.Errorf("docker is down"))
+	status := r.GetStatus()
+	assert.Equal(t, "degraded", status.State)
+	assert.Equal(t, "docker is down", status.Reason)
+	assert.Equal(t, 1, status.Attempts)
+	assert.Contains(t, r.NotReadyReason(), "docker is down")
+
+	r.setState(StateReady, nil)
+	assert.Equal(t, StateReady, r.GetState())
+	assert.Empty(t, r.GetStatus().Reason)
+}
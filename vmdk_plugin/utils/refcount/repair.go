@@ -0,0 +1,304 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+//
+// Operator repair actions, for when refcounts and the actual state of the
+// volumes went out of sync and waiting for the next discovery isn't an option.
+//
+// Each action which touches a volume first asks the container runtime which
+// running containers use it, and is refused if that would pull the volume
+// from under them:
+// - force unmount and force detach are refused if any running container
+//   uses the volume
+// - refcount changes are refused if the new count is lower than the number
+//   of running containers using the volume
+//
+// Actions are serialized with mount/unmount with StateMtx. The container
+// runtime is asked before StateMtx is taken, a slow runtime mustn't hold up
+// mounts. An action is refused if the refcount changed meanwhile.
+//
+
+package refcount
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
+	"golang.org/x/net/context"
+)
+
+// RepairDriver - driver operations needed by the repair actions
+type RepairDriver interface {
+	drivers.VolumeDriver
+	// Detach the volume from the VM, without unmounting it
+	Detach(name string) error
+	// Forget the Docker mount IDs referring to the volume
+	ForgetMountIDs(name string)
+}
+
+// VolumeInUseError - a repair action was refused since running containers
+// use the volume
+type VolumeInUseError struct {
+	Volume     string
+	Containers []string
+}
+
+func (e *VolumeInUseError) Error() string {
+	return fmt.Sprintf("Volume %s is used by running containers: %s",
+		e.Volume, strings.Join(e.Containers, ", "))
+}
+
+// NotReadyError - a repair action needing refcounts was refused since
+// refcounting isn't complete
+type NotReadyError struct {
+	Reason string
+}
+
+func (e *NotReadyError) Error() string {
+	return e.Reason
+}
+
+// FullVolumeName - return the name the volume is tracked under in the
+// refcounts, for a Docker or backend volume name
+func FullVolumeName(d drivers.VolumeDriver, name string) (string, error) {
+	if mapper, mapNames := d.(nameMapper); mapNames {
+		name = mapper.BackendName(name)
+	}
+	// photon volumes have no datastore
+	if driverName == photonDriver {
+		return name, nil
+	}
+	volumeInfo, err := plugin_utils.GetVolumeInfo(name, "", d)
+	if err != nil {
+		return "", err
+	}
+	return volumeInfo.VolumeName, nil
+}
+
+// VolumeUsers - return the names of the running containers using the volume,
+// as reported by the container runtime. vol is a full volume name.
+func (r *RefCountsMap) VolumeUsers(d drivers.VolumeDriver, vol string) ([]string, error) {
+	policy := r.GetPolicy()
+	ctx, cancel := context.WithTimeout(context.Background(), policy.DiscoveryTimeout)
+	defer cancel()
+
+	ctxList, cancelList := context.WithTimeout(ctx, policy.RuntimeTimeout)
+	containers, err := r.runtime.ListContainers(ctxList)
+	cancelList()
+	if err != nil {
+		return nil, err
+	}
+
+	var users []string
+	for _, res := range inspectAll(ctx, r.runtime, policy, containers) {
+		// unknown usage is as bad as a user, refuse
+		if res.err != nil {
+			return nil, fmt.Errorf("failed to get mounts for %s (%v)", res.container.Names, res.err)
+		}
+		for _, name := range res.volumes {
+			fullName, err := FullVolumeName(d, name)
+			if err != nil {
+				return nil, err
+			}
+			if fullName == vol {
+				users = append(users, containerName(res.container))
+				break
+			}
+		}
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+// returns a printable name of the container
+func containerName(ct Container) string {
+	if len(ct.Names) > 0 {
+		return strings.TrimPrefix(ct.Names[0], "/")
+	}
+	return ct.ID
+}
+
+// SetCount - set the refcount of the volume, drops the entry if count is 0
+func (r *RefCountsMap) SetCount(vol string, count uint) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if count == 0 {
+		delete(r.refMap, vol)
+		return
+	}
+	rc := r.refMap[vol]
+	if rc == nil {
+		rc = newRefCount()
+		r.refMap[vol] = rc
+	}
+	rc.count = count
+}
+
+// returns the running containers using the volume and the refcount before
+// asking the runtime, checked by checkCountUnchanged under StateMtx
+func (r *RefCountsMap) volumeUsersUnlocked(d drivers.VolumeDriver, vol string) ([]string, uint, error) {
+	count := r.GetCount(vol)
+	users, err := r.VolumeUsers(d, vol)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Cannot check if volume %s is in use (%v)", vol, err)
+	}
+	return users, count, nil
+}
+
+// returns an error if running containers use the volume, caller doesn't
+// hold StateMtx. Returns the refcount before the check.
+func (r *RefCountsMap) checkNotInUse(d drivers.VolumeDriver, vol string) (uint, error) {
+	users, count, err := r.volumeUsersUnlocked(d, vol)
+	if err != nil {
+		return 0, err
+	}
+	if len(users) > 0 {
+		return 0, &VolumeInUseError{Volume: vol, Containers: users}
+	}
+	return count, nil
+}
+
+// returns an error if the volume was mounted or unmounted since its
+// refcount was count, caller holds StateMtx
+func (r *RefCountsMap) checkCountUnchanged(vol string, count uint) error {
+	if r.GetCount(vol) != count {
+		return fmt.Errorf("Volume %s was mounted or unmounted while checking its use, try again", vol)
+	}
+	return nil
+}
+
+// ForceUnmount - unmount the volume whatever its refcount, and drop the
+// refcount. The volume stays attached.
+func (r *RefCountsMap) ForceUnmount(d RepairDriver, name string) error {
+	vol, err := FullVolumeName(d, name)
+	if err != nil {
+		return err
+	}
+	count, err := r.checkNotInUse(d, vol)
+	if err != nil {
+		return err
+	}
+
+	r.StateMtx.Lock()
+	defer r.StateMtx.Unlock()
+	if err = r.checkCountUnchanged(vol, count); err != nil {
+		return err
+	}
+	err = fs.Unmount(filepath.Join(mountRoot, vol))
+	if err != nil {
+		return err
+	}
+	r.MarkDirty()
+	r.SetCount(vol, 0)
+	d.ForgetMountIDs(vol)
+	log.WithFields(log.Fields{"name": vol}).Warning("Force unmounted volume ")
+	return nil
+}
+
+// ForceDetach - detach the volume from the VM whatever its refcount.
+// The volume has to be unmounted first.
+func (r *RefCountsMap) ForceDetach(d RepairDriver, name string) error {
+	vol, err := FullVolumeName(d, name)
+	if err != nil {
+		return err
+	}
+	if plugin_utils.AlreadyMounted(vol, mountRoot) {
+		return fmt.Errorf("Volume %s is mounted, unmount it first", vol)
+	}
+	count, err := r.checkNotInUse(d, vol)
+	if err != nil {
+		return err
+	}
+
+	r.StateMtx.Lock()
+	defer r.StateMtx.Unlock()
+	if err = r.checkCountUnchanged(vol, count); err != nil {
+		return err
+	}
+	if plugin_utils.AlreadyMounted(vol, mountRoot) {
+		return fmt.Errorf("Volume %s is mounted, unmount it first", vol)
+	}
+	err = d.Detach(vol)
+	if err != nil {
+		return err
+	}
+	r.MarkDirty()
+	r.SetCount(vol, 0)
+	d.ForgetMountIDs(vol)
+	log.WithFields(log.Fields{"name": vol}).Warning("Force detached volume ")
+	return nil
+}
+
+// SetRefCount - set the refcount of the volume, if relative is set count is
+// added to the current refcount. Returns the full volume name and the new refcount.
+func (r *RefCountsMap) SetRefCount(d RepairDriver, name string, count int, relative bool) (string, uint, error) {
+	// refcounts are rebuilt by discovery, changing them before is pointless
+	if !r.IsInitialized() {
+		return "", 0, &NotReadyError{Reason: r.NotReadyReason()}
+	}
+
+	vol, err := FullVolumeName(d, name)
+	if err != nil {
+		return "", 0, err
+	}
+
+	users, oldCount, err := r.volumeUsersUnlocked(d, vol)
+	if err != nil {
+		return vol, 0, err
+	}
+	newCount := count
+	if relative {
+		newCount += int(oldCount)
+	}
+	if newCount < 0 {
+		return vol, 0, fmt.Errorf("Refcount of volume %s can't go below 0", vol)
+	}
+	if newCount < len(users) {
+		return vol, 0, &VolumeInUseError{Volume: vol, Containers: users}
+	}
+
+	r.StateMtx.Lock()
+	defer r.StateMtx.Unlock()
+	if !r.IsInitialized() {
+		return "", 0, &NotReadyError{Reason: r.NotReadyReason()}
+	}
+	if err = r.checkCountUnchanged(vol, oldCount); err != nil {
+		return vol, 0, err
+	}
+	r.MarkDirty()
+	r.SetCount(vol, uint(newCount))
+	log.WithFields(log.Fields{
+		"name": vol, "from": oldCount, "to": newCount,
+	}).Warning("Refcount changed by operator ")
+	return vol, uint(newCount), nil
+}
+
+// Resync - rerun refcount discovery now
+func (r *RefCountsMap) Resync(d drivers.VolumeDriver) error {
+	err := r.calculate(d, mountRoot, driverName)
+	if err != nil {
+		return err
+	}
+	r.setState(StateReady, nil)
+	return nil
+}
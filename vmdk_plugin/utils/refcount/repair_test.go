@@ -0,0 +1,155 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package refcount
+
+// Test the safety checks of the repair actions
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/volname"
+)
+
+// aliasDriver keeps volumes with invalid Docker names under aliases, ESX
+// doesn't know the Docker names
+type aliasDriver struct {
+	*fakeDriver
+}
+
+func (d *aliasDriver) BackendName(name string) string {
+	return volname.Alias(name)
+}
+
+func (d *aliasDriver) GetVolume(name string) (map[string]interface{}, error) {
+	if err := volname.Validate(name); err != nil {
+		return nil, fmt.Errorf("Volume %s not found", name)
+	}
+	return d.fakeDriver.GetVolume(name)
+}
+
+func TestVolumeUsers(t *testing.T) {
+	rt, d, r := setup(t)
+	defer os.RemoveAll(mountRoot)
+
+	rt.addContainer("c1", "vol1@"+testDatastore)
+	rt.addContainer("c2", "vol1", "vol2@"+testDatastore)
+
+	users, err := r.VolumeUsers(d, "vol1@"+testDatastore)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c1", "c2"}, users)
+
+	users, err = r.VolumeUsers(d, "vol3@"+testDatastore)
+	assert.Nil(t, err)
+	assert.Empty(t, users)
+
+	// unknown usage refuses
+	rt.failures["c1"] = 1
+	_, err = r.VolumeUsers(d, "vol3@"+testDatastore)
+	assert.NotNil(t, err)
+}
+
+func TestSetRefCount(t *testing.T) {
+	rt, d, r := setup(t)
+	defer os.RemoveAll(mountRoot)
+
+	// refused until refcounts are known
+	_, _, err := r.SetRefCount(d, "vol1", 1, false)
+	assert.IsType(t, &NotReadyError{}, err)
+
+	rt.addContainer("c1", "vol1@"+testDatastore)
+	rt.addContainer("c2", "vol1@"+testDatastore)
+	assert.Nil(t, r.discoverAndSync(d, &Reconciliation{}))
+
+	vol, count, err := r.SetRefCount(d, "vol1", 1, true)
+	assert.Nil(t, err)
+	assert.Equal(t, "vol1@"+testDatastore, vol)
+	assert.Equal(t, uint(3), count)
+
+	// can't go below the number of running users
+	_, _, err = r.SetRefCount(d, "vol1", 1, false)
+	assert.IsType(t, &VolumeInUseError{}, err)
+	_, _, err = r.SetRefCount(d, "vol1", -2, true)
+	assert.IsType(t, &VolumeInUseError{}, err)
+	assert.Equal(t, uint(3), r.GetCount(vol))
+
+	_, count, err = r.SetRefCount(d, "vol1", 2, false)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(2), count)
+}
+
+func TestForceDetach(t *testing.T) {
+	rt, d, r := setup(t)
+	defer os.RemoveAll(mountRoot)
+
+	rt.addContainer("c1", "vol1@"+testDatastore)
+	err := r.ForceDetach(d, "vol1@"+testDatastore)
+	assert.IsType(t, &VolumeInUseError{}, err)
+	assert.Empty(t, d.detached)
+
+	r.SetCount("vol2@"+testDatastore, 1)
+	assert.Nil(t, r.ForceDetach(d, "vol2@"+testDatastore))
+	assert.Equal(t, []string{"vol2@" + testDatastore}, d.detached)
+	assert.Equal(t, uint(0), r.GetCount("vol2@"+testDatastore))
+}
+
+func TestRepairOutsideStateLock(t *testing.T) {
+	rt, d, r := setup(t)
+	defer os.RemoveAll(mountRoot)
+
+	// a refused action leaves the refcounts clean
+	rt.addContainer("c1", "vol1@"+testDatastore)
+	assert.IsType(t, &VolumeInUseError{}, r.ForceDetach(d, "vol1@"+testDatastore))
+	assert.False(t, r.IsDirty())
+
+	// the runtime is asked without StateMtx, a mount meanwhile refuses
+	vol := "vol2@" + testDatastore
+	rt.onInspect = func() {
+		r.StateMtx.Lock()
+		r.Incr(vol)
+		r.StateMtx.Unlock()
+	}
+	assert.NotNil(t, r.ForceDetach(d, vol))
+	assert.Empty(t, d.detached)
+	assert.Equal(t, uint(1), r.GetCount(vol))
+}
+
+func TestRepairAliasedVolume(t *testing.T) {
+	rt, fake, r := setup(t)
+	defer os.RemoveAll(mountRoot)
+	d := &aliasDriver{fake}
+
+	rt.addContainer("c1", "my volume")
+	rt.addContainer("c2", "vol1")
+	alias := volname.Alias("my volume") + "@" + testDatastore
+	assert.Nil(t, r.discoverAndSync(d, &Reconciliation{}))
+	assert.Equal(t, uint(1), r.GetCount(alias))
+
+	// a volume without alias can be repaired while an aliased one is used
+	users, err := r.VolumeUsers(d, "vol1@"+testDatastore)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c2"}, users)
+
+	// the operator gives the Docker name
+	vol, err := FullVolumeName(d, "my volume")
+	assert.Nil(t, err)
+	assert.Equal(t, alias, vol)
+	_, _, err = r.SetRefCount(d, "my volume", 0, false)
+	assert.Equal(t, &VolumeInUseError{Volume: alias, Containers: []string{"c1"}}, err)
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+//
+// Container runtimes used for refcount discovery.
+//
+// Refcount discovery needs to know which containers are running and which
+// volumes they have mounted. This file defines the interface a container
+// runtime has to implement for that. Docker is the default, containerd
+// can be used on hosts running containers through containerd directly.
+//
+
+package refcount
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// DockerRuntime - discover volume usage from the Docker engine
+	DockerRuntime = "docker"
+	// ContainerdRuntime - discover volume usage from containerd task state
+	ContainerdRuntime = "containerd"
+)
+
+// Container - a running, paused or restarting container, or one which may
+// be starting
+type Container struct {
+	ID     string
+	Names  []string
+	Labels map[string]string
+}
+
+// Mount - a volume mount of a container
+type Mount struct {
+	Name        string // volume name, empty if the runtime doesn't know it
+	Source      string // path on the host
+	Destination string // path in the container
+	RW          bool
+}
+
+// ContainerNotFoundError - the container is gone, it was removed after it
+// was listed
+type ContainerNotFoundError struct {
+	ID string
+}
+
+func (e *ContainerNotFoundError) Error() string {
+	return fmt.Sprintf("No such container %s", e.ID)
+}
+
+// ContainerRuntime - lists containers and their mounts
+type ContainerRuntime interface {
+	// Name of the runtime and endpoint, for logs
+	Name() string
+
+	// Ping checks that the runtime is answering requests
+	Ping(ctx context.Context) error
+
+	// ListContainers returns running, paused and restarting containers
+	ListContainers(ctx context.Context) ([]Container, error)
+
+	// ContainerMounts returns the mounts of the container with the given ID,
+	// ContainerNotFoundError if the container is gone
+	ContainerMounts(ctx context.Context, id string) ([]Mount, error)
+
+	// StartingContainers returns the containers using the volume which may
+	// be the one starting, the runtime doesn't say which container a mount
+	// request is for. None if the runtime can't tell.
+	StartingContainers(ctx context.Context, volume string) ([]Container, error)
+}
+
+// NewRuntime - creates the runtime with the given name. The endpoint is
+// runtime specific, the runtime default is used if it's empty.
+func NewRuntime(name string, endpoint string) (ContainerRuntime, error) {
+	switch name {
+	case "", DockerRuntime:
+		if endpoint == "" {
+			endpoint = DockerUSocket
+		}
+		return NewDockerRuntime(endpoint)
+	case ContainerdRuntime:
+		if endpoint == "" {
+			endpoint = ContainerdStateDir
+		}
+		return NewContainerdRuntime(endpoint), nil
+	}
+	return nil, fmt.Errorf("Unknown container runtime %s, supported runtimes are %s and %s",
+		name, DockerRuntime, ContainerdRuntime)
+}
@@ -0,0 +1,149 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package userns maps container user and group IDs to host IDs the way
+// Docker does with userns-remap: container ID 0 is the first subordinate
+// ID of the remap user in /etc/subuid (/etc/subgid for groups), the ranges
+// of the user follow each other in file order.
+package userns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultRemap - userns-remap value for the user Docker creates
+	DefaultRemap = "default"
+	defaultUser  = "dockremap"
+
+	subUIDPath = "/etc/subuid"
+	subGIDPath = "/etc/subgid"
+)
+
+// idRange - subordinate IDs from Start, Count of them
+type idRange struct {
+	Start uint64
+	Count uint64
+}
+
+// Mapping - container to host IDs for a userns-remap setting
+type Mapping struct {
+	uids []idRange
+	gids []idRange
+}
+
+// ParseRemap - returns the user and group of a userns-remap setting,
+// "default", "user" or "user:group". The group is the user if not given.
+func ParseRemap(remap string) (string, string, error) {
+	if remap == DefaultRemap {
+		return defaultUser, defaultUser, nil
+	}
+	parts := strings.SplitN(remap, ":", 2)
+	user, group := parts[0], parts[0]
+	if len(parts) == 2 {
+		group = parts[1]
+	}
+	if user == "" || group == "" {
+		return "", "", fmt.Errorf("invalid userns-remap %q, expected default, user or user:group", remap)
+	}
+	return user, group, nil
+}
+
+// Load - reads the subordinate IDs of the userns-remap setting remap
+func Load(remap string) (*Mapping, error) {
+	user, group, err := ParseRemap(remap)
+	if err != nil {
+		return nil, err
+	}
+	uids, err := readRanges(subUIDPath, user)
+	if err != nil {
+		return nil, err
+	}
+	gids, err := readRanges(subGIDPath, group)
+	if err != nil {
+		return nil, err
+	}
+	return &Mapping{uids: uids, gids: gids}, nil
+}
+
+// UID - the host user ID of a container user ID
+func (m *Mapping) UID(id uint64) (uint64, error) {
+	return mapID(m.uids, id, "user")
+}
+
+// GID - the host group ID of a container group ID
+func (m *Mapping) GID(id uint64) (uint64, error) {
+	return mapID(m.gids, id, "group")
+}
+
+func mapID(ranges []idRange, id uint64, kind string) (uint64, error) {
+	offset := id
+	for _, r := range ranges {
+		if offset < r.Count {
+			return r.Start + offset, nil
+		}
+		offset -= r.Count
+	}
+	return 0, fmt.Errorf("Container %s ID %d is out of the remapped range", kind, id)
+}
+
+func readRanges(path string, name string) ([]idRange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the subordinate IDs of %s: %v", name, err)
+	}
+	defer f.Close()
+	ranges, err := parseRanges(f, name)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %v", path, err)
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("%s has no subordinate IDs in %s", name, path)
+	}
+	return ranges, nil
+}
+
+// parses the name:start:count lines of /etc/subuid or /etc/subgid for name
+func parseRanges(r io.Reader, name string) ([]idRange, error) {
+	var ranges []idRange
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		if fields[0] != name {
+			continue
+		}
+		start, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		count, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		ranges = append(ranges, idRange{Start: start, Count: count})
+	}
+	return ranges, scanner.Err()
+}
@@ -0,0 +1,62 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package userns
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRemap(t *testing.T) {
+	for remap, expected := range map[string][2]string{
+		"default":     {"dockremap", "dockremap"},
+		"alice":       {"alice", "alice"},
+		"alice:staff": {"alice", "staff"},
+	} {
+		user, group, err := ParseRemap(remap)
+		if err != nil || user != expected[0] || group != expected[1] {
+			t.Errorf("ParseRemap(%q) = %q, %q, %v, expected %v", remap, user, group, err, expected)
+		}
+	}
+	for _, remap := range []string{"", ":staff", "alice:"} {
+		if _, _, err := ParseRemap(remap); err == nil {
+			t.Errorf("ParseRemap(%q) succeeded", remap)
+		}
+	}
+}
+
+func TestMapping(t *testing.T) {
+	subuid := "# comment\nalice:100000:65536\ndockremap:231072:1000\nbob:300000:10\ndockremap:500000:65536\n"
+	ranges, err := parseRanges(strings.NewReader(subuid), "dockremap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Mapping{uids: ranges}
+	for id, expected := range map[uint64]uint64{0: 231072, 999: 232071, 1000: 500000, 1500: 500500} {
+		if host, err := m.UID(id); err != nil || host != expected {
+			t.Errorf("UID(%d) = %d, %v, expected %d", id, host, err, expected)
+		}
+	}
+	if _, err = m.UID(1000 + 65536); err == nil {
+		t.Errorf("UID out of the ranges succeeded")
+	}
+	if _, err = m.GID(0); err == nil {
+		t.Errorf("GID without ranges succeeded")
+	}
+
+	if _, err = parseRanges(strings.NewReader("dockremap:x:10\n"), "dockremap"); err == nil {
+		t.Errorf("parseRanges of an invalid line succeeded")
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package volname checks volume names before they are sent to ESX, where
+// they become VMDK file names, and maps Docker names which ESX would
+// reject to safe backend names (aliases).
+package volname
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// MaxVolumeLength - max length of the volume part of a name
+	MaxVolumeLength = 100
+	// MaxDatastoreLength - max length of the datastore part of a name
+	MaxDatastoreLength = 100
+
+	// AliasPrefix - start of the backend name of an aliased volume
+	AliasPrefix = "dvs-"
+	// DockerNameKey - volume metadata key of the Docker name of an
+	// aliased volume, recorded by the ESX service
+	DockerNameKey = "docker-name"
+
+	// sanitized Docker name kept in an alias, for readability
+	aliasNameLength = 40
+	// hex digits of the hash of the Docker name in an alias
+	aliasHashLength = 8
+)
+
+var (
+	volumeRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	// ESX reserves -NNNNNN for VMDK snapshots (disk-000001.vmdk)
+	snapshotRegexp = regexp.MustCompile(`-[0-9]{6}$`)
+	unsafeRegexp   = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+)
+
+// Split - returns the volume and datastore of volume[@datastore]. The
+// datastore is after the last '@', empty if there is none.
+func Split(name string) (string, string) {
+	at := strings.LastIndex(name, "@")
+	if at < 0 {
+		return name, ""
+	}
+	return name[:at], name[at+1:]
+}
+
+// Join - returns volume@datastore, or volume if datastore is empty
+func Join(volume string, datastore string) string {
+	if datastore == "" {
+		return volume
+	}
+	return volume + "@" + datastore
+}
+
+// Validate - checks that a new volume can be created with name. Volume
+// names start with a letter or a digit, followed by letters, digits, '_',
+// '.' or '-', and can't end with '-' and 6 digits.
+func Validate(name string) error {
+	volume, datastore := Split(name)
+	switch {
+	case volume == "":
+		return fmt.Errorf("Invalid volume name %q: the volume name is empty", name)
+	case len(volume) > MaxVolumeLength:
+		return fmt.Errorf("Invalid volume name %q: the volume name is longer than %d characters",
+			name, MaxVolumeLength)
+	case !volumeRegexp.MatchString(volume):
+		return fmt.Errorf("Invalid volume name %q: use letters, digits, '_', '.' and '-', "+
+			"starting with a letter or a digit", name)
+	case snapshotRegexp.MatchString(volume):
+		return fmt.Errorf("Invalid volume name %q: names ending with '-' and 6 digits are reserved for snapshots",
+			name)
+	}
+	if strings.Contains(name, "@") {
+		if datastore == "" {
+			return fmt.Errorf("Invalid volume name %q: the datastore name is empty", name)
+		}
+		if len(datastore) > MaxDatastoreLength {
+			return fmt.Errorf("Invalid volume name %q: the datastore name is longer than %d characters",
+				name, MaxDatastoreLength)
+		}
+	}
+	return nil
+}
+
+// Alias - returns the backend name for a Docker volume name. Valid names
+// are kept, others get an alias made of AliasPrefix, the name with unsafe
+// characters replaced and a hash of the name, so the same Docker name
+// always maps to the same alias. The datastore part is kept if valid.
+func Alias(name string) string {
+	if Validate(name) == nil {
+		return name
+	}
+	volume, datastore := Split(name)
+	if !strings.Contains(name, "@") || datastore == "" || len(datastore) > MaxDatastoreLength {
+		volume, datastore = name, ""
+	}
+
+	readable := strings.Trim(unsafeRegexp.ReplaceAllString(volume, "_"), "_.-")
+	if len(readable) > aliasNameLength {
+		readable = readable[:aliasNameLength]
+	}
+	hash := sha256.Sum256([]byte(volume))
+	alias := AliasPrefix
+	if readable != "" {
+		alias += readable + "-"
+	}
+	alias += hex.EncodeToString(hash[:])[:aliasHashLength]
+	return Join(alias, datastore)
+}
+
+// IsAlias - true if the volume part of a backend name looks like an alias
+func IsAlias(name string) bool {
+	volume, _ := Split(name)
+	return strings.HasPrefix(volume, AliasPrefix)
+}
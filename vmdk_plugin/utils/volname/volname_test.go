@@ -0,0 +1,72 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package volname
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := []string{"vol", "Vol-1.data_2", "vol@datastore1", "vol@my datastore",
+		"vol-12345", "vol-1234567", strings.Repeat("v", MaxVolumeLength)}
+	for _, name := range valid {
+		if err := Validate(name); err != nil {
+			t.Errorf("Validate(%q) = %v, expected no error", name, err)
+		}
+	}
+
+	invalid := []string{"", "@datastore1", "vol@", "-vol", ".vol", "my vol", "vol/1",
+		"vol-000001", "vol-000001@datastore1", strings.Repeat("v", MaxVolumeLength+1),
+		"vol@" + strings.Repeat("d", MaxDatastoreLength+1)}
+	for _, name := range invalid {
+		if err := Validate(name); err == nil {
+			t.Errorf("Validate(%q) = nil, expected an error", name)
+		}
+	}
+}
+
+func TestAlias(t *testing.T) {
+	if alias := Alias("vol@datastore1"); alias != "vol@datastore1" {
+		t.Errorf("Alias of a valid name = %q, expected the name", alias)
+	}
+
+	names := []string{"my vol", "my vol@datastore1", "vol/1", "vol-000001",
+		"ünïcode", "@", strings.Repeat("x y", 100)}
+	aliases := make(map[string]string)
+	for _, name := range names {
+		alias := Alias(name)
+		if err := Validate(alias); err != nil {
+			t.Errorf("Alias(%q) = %q, invalid: %v", name, alias, err)
+		}
+		if !IsAlias(alias) {
+			t.Errorf("IsAlias(%q) = false for the alias of %q", alias, name)
+		}
+		if Alias(name) != alias {
+			t.Errorf("Alias(%q) isn't stable", name)
+		}
+		aliases[alias] = name
+	}
+	if len(aliases) != len(names) {
+		t.Errorf("Aliases aren't unique: %v", aliases)
+	}
+
+	// the datastore is kept, the same volume gets the same alias on it
+	alias, datastore := Split(Alias("my vol@datastore1"))
+	if datastore != "datastore1" || Join(alias, "") != Alias("my vol") {
+		t.Errorf("Alias(\"my vol@datastore1\") = %q@%q, expected %q@datastore1",
+			alias, datastore, Alias("my vol"))
+	}
+}
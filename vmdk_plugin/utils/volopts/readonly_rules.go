@@ -0,0 +1,101 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package volopts
+
+// Rules of the ro-for option, selecting the containers which get a volume
+// read-only while others mount it read-write. A rule is a container name
+// pattern, label=KEY or label=KEY=VALUE, rules are separated by commas.
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const labelRulePrefix = "label="
+
+// ReadOnlyRule - a rule of the ro-for option
+type ReadOnlyRule struct {
+	NamePattern string // path.Match pattern of the container name
+	Label       string // label the container must have, if NamePattern is empty
+	Value       string // value of the label, any value if AnyValue
+	AnyValue    bool
+}
+
+// String - the rule as written in ro-for
+func (r ReadOnlyRule) String() string {
+	switch {
+	case r.NamePattern != "":
+		return r.NamePattern
+	case r.AnyValue:
+		return labelRulePrefix + r.Label
+	}
+	return labelRulePrefix + r.Label + "=" + r.Value
+}
+
+// Match - whether the rule selects the container with the given name and
+// labels. Docker names start with a slash, which is ignored.
+func (r ReadOnlyRule) Match(name string, labels map[string]string) bool {
+	if r.NamePattern != "" {
+		matched, _ := path.Match(r.NamePattern, strings.TrimPrefix(name, "/"))
+		return matched
+	}
+	value, exists := labels[r.Label]
+	return exists && (r.AnyValue || value == r.Value)
+}
+
+// ParseReadOnlyRules - parses the value of ro-for, empty rules are skipped
+func ParseReadOnlyRules(value string) ([]ReadOnlyRule, error) {
+	var rules []ReadOnlyRule
+	for _, rule := range strings.Split(value, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		if !strings.HasPrefix(rule, labelRulePrefix) {
+			if _, err := path.Match(rule, ""); err != nil {
+				return nil, fmt.Errorf("invalid container name pattern %s", rule)
+			}
+			rules = append(rules, ReadOnlyRule{NamePattern: rule})
+			continue
+		}
+		label := strings.SplitN(strings.TrimPrefix(rule, labelRulePrefix), "=", 2)
+		if label[0] == "" {
+			return nil, fmt.Errorf("missing label key in %s", rule)
+		}
+		if len(label) == 1 {
+			rules = append(rules, ReadOnlyRule{Label: label[0], AnyValue: true})
+		} else {
+			rules = append(rules, ReadOnlyRule{Label: label[0], Value: label[1]})
+		}
+	}
+	return rules, nil
+}
+
+// normalized list of rules, at least one
+func checkReadOnlyRules(value string) (string, error) {
+	rules, err := ParseReadOnlyRules(value)
+	if err != nil {
+		return "", err
+	}
+	if len(rules) == 0 {
+		return "", fmt.Errorf("expected container name patterns, label=KEY or label=KEY=VALUE, separated by commas")
+	}
+	names := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		names = append(names, rule.String())
+	}
+	return strings.Join(names, ","), nil
+}
@@ -0,0 +1,362 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package volopts checks and normalizes the options of docker volume create
+// in the guest, so mistakes are reported before any request to ESX or
+// Photon. Each driver has a Schema of the options it accepts.
+package volopts
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Option names
+const (
+	Size           = "size"
+	VsanPolicyName = "vsan-policy-name"
+	DiskFormat     = "diskformat"
+	AttachAs       = "attach-as"
+	Access         = "access"
+	Fstype         = "fstype"
+	CloneFrom      = "clone-from"
+	PopulateFrom   = "populate-from"
+	Trim           = "trim"
+	UID            = "uid"
+	GID            = "gid"
+	Mode           = "mode"
+	Subvolumes     = "subvolumes"
+	Parent         = "parent"
+	RoFor          = "ro-for"
+	Flavor         = "flavor"
+)
+
+// Option values
+const (
+	DiskFormatThin             = "thin"
+	DiskFormatZeroedThick      = "zeroedthick"
+	DiskFormatEagerZeroedThick = "eagerzeroedthick"
+
+	AttachAsIndependent = "independent_persistent"
+	AttachAsPersistent  = "persistent"
+
+	AccessReadWrite = "read-write"
+	AccessReadOnly  = "read-only"
+
+	// trim=off opts the volume out of the scheduled trim
+	TrimOn  = "on"
+	TrimOff = "off"
+
+	// subvolumes=on makes a volume which can be the parent of sub-volumes
+	SubvolumesOn  = "on"
+	SubvolumesOff = "off"
+
+	// FstypeRaw - a raw block volume, no filesystem is created and the
+	// container gets the disk device
+	FstypeRaw = "raw"
+)
+
+// Fstypes - filesystems which can be created on a volume. They all support
+// labels, the mkfs of the filesystem must be installed too.
+var Fstypes = []string{"btrfs", "ext2", "ext3", "ext4", "xfs"}
+
+// SubvolumeFstypes - filesystems of parent volumes, with project quotas
+var SubvolumeFstypes = []string{"ext4", "xfs"}
+
+// options of a sub-volume, the others are the ones of its parent
+var subvolumeOptions = []string{Parent, Size, PopulateFrom, UID, GID, Mode}
+
+const (
+	kb = 1
+	mb = 1024 * kb
+	gb = 1024 * mb
+	tb = 1024 * gb
+)
+
+// size units, in KB
+var sizeUnits = map[string]uint64{"kb": kb, "mb": mb, "gb": gb, "tb": tb}
+
+// checks and normalizes the value of an option
+type valueCheck func(value string) (string, error)
+
+// Schema - the create options a driver accepts
+type Schema struct {
+	options  map[string]valueCheck
+	aliases  map[string]string // deprecated option name -> option name
+	required []string
+	// checks on the options together, after the values are checked
+	check func(opts map[string]string) []string
+}
+
+// Vsphere - options of the vsphere driver
+var Vsphere = Schema{
+	options: map[string]valueCheck{
+		Size:           checkSize,
+		VsanPolicyName: checkNotEmpty,
+		DiskFormat:     checkEnum(DiskFormatThin, DiskFormatZeroedThick, DiskFormatEagerZeroedThick),
+		AttachAs:       checkEnum(AttachAsIndependent, AttachAsPersistent),
+		Access:         checkEnum(AccessReadWrite, AccessReadOnly),
+		Fstype:         checkEnum(append(Fstypes[:len(Fstypes):len(Fstypes)], FstypeRaw)...),
+		CloneFrom:      checkNotEmpty,
+		PopulateFrom:   checkAbsPath,
+		Trim:           checkEnum(TrimOn, TrimOff),
+		UID:            checkID,
+		GID:            checkID,
+		Mode:           checkMode,
+		Subvolumes:     checkEnum(SubvolumesOn, SubvolumesOff),
+		Parent:         checkNotEmpty,
+		RoFor:          checkReadOnlyRules,
+	},
+	check: func(opts map[string]string) []string {
+		var problems []string
+		if _, child := opts[Parent]; child {
+			for _, name := range sortedKeys(opts) {
+				if !contains(subvolumeOptions, name) {
+					problems = append(problems, fmt.Sprintf("%s can't be set for a sub-volume, it is the one of the parent", name))
+				}
+			}
+			return problems
+		}
+		if fstype, set := opts[Fstype]; set && opts[Subvolumes] == SubvolumesOn && !contains(SubvolumeFstypes, fstype) {
+			problems = append(problems, fmt.Sprintf("%s=%s needs fstype %s", Subvolumes, SubvolumesOn,
+				strings.Join(SubvolumeFstypes, " or ")))
+		}
+		if _, clone := opts[CloneFrom]; clone {
+			for _, name := range []string{Size, Fstype, Subvolumes} {
+				if _, set := opts[name]; set {
+					problems = append(problems, fmt.Sprintf("%s can't be set for a clone, it is the one of the cloned volume", name))
+				}
+			}
+			if _, set := opts[PopulateFrom]; set {
+				problems = append(problems, fmt.Sprintf("%s can't be used with %s", PopulateFrom, CloneFrom))
+			}
+		}
+		for _, name := range []string{PopulateFrom, UID, GID, Mode} {
+			if _, set := opts[name]; set && opts[Fstype] == FstypeRaw {
+				problems = append(problems, fmt.Sprintf("%s can't be used for a raw volume, it has no filesystem", name))
+			}
+		}
+		if _, set := opts[RoFor]; set && opts[Fstype] == FstypeRaw {
+			problems = append(problems, fmt.Sprintf("%s can't be used for a raw volume, containers get the device", RoFor))
+		}
+		if _, clone := opts[CloneFrom]; clone {
+			for _, name := range []string{UID, GID, Mode} {
+				if _, set := opts[name]; set {
+					problems = append(problems, fmt.Sprintf("%s can't be set for a clone, it has the root of the cloned volume", name))
+				}
+			}
+		}
+		return problems
+	},
+}
+
+// Photon - options of the photon driver
+var Photon = Schema{
+	options: map[string]valueCheck{
+		Size:   checkPhotonSize,
+		Flavor: checkNotEmpty,
+		Fstype: checkEnum(Fstypes...),
+	},
+	aliases:  map[string]string{"Fs_Type": Fstype},
+	required: []string{Flavor},
+}
+
+// Error - all the problems with the options of a create request
+type Error []string
+
+func (e Error) Error() string {
+	return "Invalid volume options: " + strings.Join(e, "; ")
+}
+
+// Validate - checks the names and values of opts. Returns the options with
+// the names of deprecated options replaced and values normalized, or an
+// Error with all the problems.
+func (s Schema) Validate(opts map[string]string) (map[string]string, error) {
+	var problems Error
+	result := make(map[string]string, len(opts))
+	for _, name := range sortedKeys(opts) {
+		value := opts[name]
+		if alias, isAlias := s.aliases[name]; isAlias {
+			name = alias
+		}
+		check, known := s.options[name]
+		if !known {
+			problems = append(problems, fmt.Sprintf("unknown option %s, valid options are %s",
+				name, strings.Join(s.Names(), ", ")))
+			continue
+		}
+		normalized, err := check(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("invalid %s %q: %v", name, value, err))
+			continue
+		}
+		result[name] = normalized
+	}
+	for _, name := range s.required {
+		if _, set := opts[name]; !set {
+			problems = append(problems, fmt.Sprintf("missing option %s", name))
+		}
+	}
+	if len(problems) == 0 && s.check != nil {
+		problems = append(problems, s.check(result)...)
+	}
+
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return result, nil
+}
+
+// Names - the options of the schema, sorted
+func (s Schema) Names() []string {
+	names := make([]string, 0, len(s.options))
+	for name := range s.options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseSize - returns the size in KB of <integer><unit>, where unit is kb,
+// mb, gb or tb, in any case
+func ParseSize(size string) (uint64, error) {
+	lower := strings.ToLower(strings.TrimSpace(size))
+	if len(lower) < 3 {
+		return 0, sizeError(size)
+	}
+	unit, found := sizeUnits[lower[len(lower)-2:]]
+	if !found {
+		return 0, sizeError(size)
+	}
+	value, err := strconv.ParseUint(lower[:len(lower)-2], 10, 64)
+	if err != nil {
+		return 0, sizeError(size)
+	}
+	if value == 0 {
+		return 0, fmt.Errorf("size must be more than 0")
+	}
+	return value * unit, nil
+}
+
+func sizeError(size string) error {
+	msg := "expected an integer followed by kb, mb, gb or tb, e.g. 10gb"
+	// common mistake, a unit without the b
+	lower := strings.ToLower(size)
+	if len(lower) > 1 {
+		if _, err := strconv.ParseUint(lower[:len(lower)-1], 10, 64); err == nil &&
+			strings.ContainsAny(lower[len(lower)-1:], "kmgt") {
+			msg += fmt.Sprintf(", did you mean %sb?", lower)
+		}
+	}
+	return errors.New(msg)
+}
+
+// sizes are sent to ESX in mb, gb or tb
+func checkSize(value string) (string, error) {
+	sizeKB, err := ParseSize(value)
+	if err != nil {
+		return "", err
+	}
+	for _, unit := range []string{"tb", "gb", "mb"} {
+		if sizeKB%sizeUnits[unit] == 0 {
+			return fmt.Sprintf("%d%s", sizeKB/sizeUnits[unit], unit), nil
+		}
+	}
+	return "", fmt.Errorf("size must be a whole number of mb")
+}
+
+// Photon disks are sized in GB
+func checkPhotonSize(value string) (string, error) {
+	sizeKB, err := ParseSize(value)
+	if err != nil {
+		return "", err
+	}
+	if sizeKB < gb {
+		return "", fmt.Errorf("size must be at least 1gb")
+	}
+	return fmt.Sprintf("%dgb", SizeGB(sizeKB)), nil
+}
+
+// SizeGB - size in KB to GB, rounded up
+func SizeGB(sizeKB uint64) uint64 {
+	return (sizeKB + gb - 1) / gb
+}
+
+func checkNotEmpty(value string) (string, error) {
+	if strings.TrimSpace(value) == "" {
+		return "", fmt.Errorf("can't be empty")
+	}
+	return value, nil
+}
+
+// a path on the Docker host, which must be absolute
+func checkAbsPath(value string) (string, error) {
+	if !filepath.IsAbs(value) {
+		return "", fmt.Errorf("must be an absolute path")
+	}
+	return filepath.Clean(value), nil
+}
+
+// a user or group ID, as a decimal number
+func checkID(value string) (string, error) {
+	id, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+	if err != nil || id == math.MaxUint32 {
+		return "", fmt.Errorf("expected a numeric ID")
+	}
+	return strconv.FormatUint(id, 10), nil
+}
+
+// permissions in octal, e.g. 0775 or 1777, normalized to 4 digits
+func checkMode(value string) (string, error) {
+	mode, err := strconv.ParseUint(strings.TrimSpace(value), 8, 32)
+	if err != nil || mode > 07777 {
+		return "", fmt.Errorf("expected permissions in octal, e.g. 0775")
+	}
+	return fmt.Sprintf("%04o", mode), nil
+}
+
+// values are matched without case
+func checkEnum(values ...string) valueCheck {
+	return func(value string) (string, error) {
+		for _, v := range values {
+			if strings.EqualFold(v, value) {
+				return v, nil
+			}
+		}
+		return "", fmt.Errorf("valid values are %s", strings.Join(values, ", "))
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
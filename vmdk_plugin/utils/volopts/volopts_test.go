@@ -0,0 +1,139 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package volopts_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/volopts"
+)
+
+func TestParseSize(t *testing.T) {
+	for size, kb := range map[string]uint64{
+		"512kb": 512,
+		"100mb": 100 * 1024,
+		"10GB":  10 * 1024 * 1024,
+		"2Tb":   2 * 1024 * 1024 * 1024,
+	} {
+		parsed, err := volopts.ParseSize(size)
+		assert.Nil(t, err, size)
+		assert.Equal(t, kb, parsed, size)
+	}
+
+	for _, size := range []string{"", "10", "10G", "gb", "-1gb", "1.5gb", "0mb", "10pb"} {
+		_, err := volopts.ParseSize(size)
+		assert.NotNil(t, err, size)
+	}
+	_, err := volopts.ParseSize("10G")
+	assert.Equal(t, "expected an integer followed by kb, mb, gb or tb, e.g. 10gb, did you mean 10gb?", err.Error())
+}
+
+func TestVsphere(t *testing.T) {
+	opts, err := volopts.Vsphere.Validate(map[string]string{
+		"size": "2048KB", "diskformat": "Thin", "access": "read-only", "fstype": "xfs",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"size": "2mb", "diskformat": "thin", "access": "read-only", "fstype": "xfs",
+	}, opts)
+
+	_, err = volopts.Vsphere.Validate(map[string]string{"size": "10G", "diskformat": "thik", "sise": "1gb"})
+	assert.Equal(t, volopts.Error{
+		`invalid diskformat "thik": valid values are thin, zeroedthick, eagerzeroedthick`,
+		"unknown option sise, valid options are access, attach-as, clone-from, diskformat, fstype, gid, mode, parent, populate-from, ro-for, size, subvolumes, trim, uid, vsan-policy-name",
+		`invalid size "10G": expected an integer followed by kb, mb, gb or tb, e.g. 10gb, did you mean 10gb?`,
+	}, err)
+
+	_, err = volopts.Vsphere.Validate(map[string]string{"clone-from": "vol1", "size": "1gb"})
+	assert.NotNil(t, err)
+	_, err = volopts.Vsphere.Validate(map[string]string{"size": "1000kb"})
+	assert.NotNil(t, err)
+
+	opts, err = volopts.Vsphere.Validate(map[string]string{"fstype": "RAW"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"fstype": "raw"}, opts)
+	_, err = volopts.Photon.Validate(map[string]string{"flavor": "ssd", "fstype": "raw"})
+	assert.NotNil(t, err)
+
+	opts, err = volopts.Vsphere.Validate(map[string]string{"populate-from": "/data/fixtures/"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"populate-from": "/data/fixtures"}, opts)
+	_, err = volopts.Vsphere.Validate(map[string]string{"populate-from": "fixtures.tar"})
+	assert.NotNil(t, err)
+	_, err = volopts.Vsphere.Validate(map[string]string{"populate-from": "/fixtures.tar", "fstype": "raw"})
+	assert.NotNil(t, err)
+	_, err = volopts.Vsphere.Validate(map[string]string{"populate-from": "/fixtures.tar", "clone-from": "vol1"})
+	assert.NotNil(t, err)
+
+	opts, err = volopts.Vsphere.Validate(map[string]string{"uid": "1000", "gid": " 0", "mode": "775"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"uid": "1000", "gid": "0", "mode": "0775"}, opts)
+	for _, bad := range []map[string]string{
+		{"uid": "-1"}, {"gid": "www-data"}, {"mode": "0789"}, {"mode": "17777"},
+		{"uid": "1000", "fstype": "raw"}, {"mode": "0700", "clone-from": "vol1"},
+	} {
+		_, err = volopts.Vsphere.Validate(bad)
+		assert.NotNil(t, err, "%v", bad)
+	}
+
+	opts, err = volopts.Vsphere.Validate(map[string]string{"parent": "shared", "size": "100MB", "uid": "1000"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"parent": "shared", "size": "100mb", "uid": "1000"}, opts)
+	_, err = volopts.Vsphere.Validate(map[string]string{"parent": "shared", "fstype": "xfs"})
+	assert.Equal(t, volopts.Error{"fstype can't be set for a sub-volume, it is the one of the parent"}, err)
+	_, err = volopts.Vsphere.Validate(map[string]string{"subvolumes": "on", "fstype": "btrfs"})
+	assert.Equal(t, volopts.Error{"subvolumes=on needs fstype ext4 or xfs"}, err)
+
+	opts, err = volopts.Vsphere.Validate(map[string]string{"ro-for": " backup-*, label=role=reader ,label=sidecar"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"ro-for": "backup-*,label=role=reader,label=sidecar"}, opts)
+	for _, bad := range []map[string]string{
+		{"ro-for": ","}, {"ro-for": "label="}, {"ro-for": "web[-"}, {"ro-for": "web", "fstype": "raw"},
+	} {
+		_, err = volopts.Vsphere.Validate(bad)
+		assert.NotNil(t, err, "%v", bad)
+	}
+}
+
+func TestReadOnlyRules(t *testing.T) {
+	rules, err := volopts.ParseReadOnlyRules("backup-*,label=role=reader,label=sidecar")
+	assert.Nil(t, err)
+	match := func(name string, labels map[string]string) bool {
+		for _, rule := range rules {
+			if rule.Match(name, labels) {
+				return true
+			}
+		}
+		return false
+	}
+	assert.True(t, match("/backup-nightly", nil))
+	assert.True(t, match("web", map[string]string{"role": "reader"}))
+	assert.True(t, match("web", map[string]string{"sidecar": ""}))
+	assert.False(t, match("/web", map[string]string{"role": "writer"}))
+}
+
+func TestPhoton(t *testing.T) {
+	opts, err := volopts.Photon.Validate(map[string]string{"flavor": "ssd", "size": "1536mb", "Fs_Type": "ext4"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"flavor": "ssd", "size": "2gb", "fstype": "ext4"}, opts)
+
+	_, err = volopts.Photon.Validate(map[string]string{"size": "100mb", "clone-from": "vol1"})
+	assert.Equal(t, volopts.Error{
+		"unknown option clone-from, valid options are flavor, fstype, size",
+		`invalid size "100mb": size must be at least 1gb`,
+		"missing option flavor",
+	}, err)
+}